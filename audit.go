@@ -0,0 +1,219 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditConfig configures the audit log of authentication and administrative events
+type AuditConfig struct {
+	// File is the append-only JSON lines file, no audit log is kept when empty
+	File string `json:"file"`
+}
+
+// audit events
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login_failed"
+	auditLogout         = "logout"
+	auditSessionExpired = "session_expired"
+	auditSessionRevoked = "session_revoked"
+	auditUserRevoked    = "user_sessions_revoked"
+	auditUnlock         = "lockout_cleared"
+	auditAPICall        = "api_call"
+)
+
+// maxAuditRecord bounds a line of the audit log
+const maxAuditRecord = 64 << 10
+
+// AuditRecord is a line of the audit log. Hash is the SHA-256 of the record
+// with an empty Hash, and Prev the Hash of the line before, so removing or
+// changing a line breaks the chain from there on. The hash is not keyed:
+// lines removed from the end leave a valid chain, and whoever can write the
+// file can compute a new chain.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Username     string    `json:"username,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	// Subject is the session or user an administrative event acted on
+	Subject   string `json:"subject,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Module    string `json:"module,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Route     string `json:"route,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Prev      string `json:"prev"`
+	Hash      string `json:"hash"`
+}
+
+// seal chains the record to prev and returns its line
+func (r *AuditRecord) seal(prev string) ([]byte, error) {
+	r.Prev, r.Hash = prev, ""
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	r.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(r)
+}
+
+// auditLog appends records to the audit file. A nil auditLog records nothing.
+type auditLog struct {
+	mtx  sync.Mutex
+	file *os.File
+	// last is the hash of the last record
+	last string
+}
+
+// newAuditLog opens the audit file and continues its chain. A file whose
+// last record can not be read is refused rather than starting a new chain.
+func newAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %v", err)
+	}
+	last, err := lastAuditHash(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s: %v", path, err)
+	}
+	return &auditLog{file: file, last: last}, nil
+}
+
+// lastAuditHash reads the hash of the last line of the file
+func lastAuditHash(file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return "", err
+	}
+	size := info.Size()
+	if size > maxAuditRecord {
+		size = maxAuditRecord
+	}
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, info.Size()-size); err != nil && err != io.EOF {
+		return "", err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	var record AuditRecord
+	if err := json.Unmarshal(buf, &record); err != nil || record.Hash == "" {
+		return "", fmt.Errorf("last record is not readable")
+	}
+	return record.Hash, nil
+}
+
+// record appends the event. The service keeps running when the audit log
+// can not be written, the error is returned for the operational log.
+func (a *auditLog) record(r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	r.Time = time.Now().UTC()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	line, err := r.seal(a.last)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.last = r.Hash
+	return nil
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.file.Close()
+}
+
+// auditReason is the code of API errors, which clients see too, or the error
+func auditReason(err error) string {
+	if apierr, ok := err.(*apiError); ok {
+		return apierr.Code
+	}
+	return err.Error()
+}
+
+// AuditFilter selects the records exported from the audit log. Zero values
+// select everything.
+type AuditFilter struct {
+	From time.Time
+	To   time.Time
+	// Username matches the acting user or the user acted on
+	Username string
+}
+
+func (f AuditFilter) match(r AuditRecord) bool {
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !r.Time.Before(f.To) {
+		return false
+	}
+	return f.Username == "" || r.Username == f.Username || r.Subject == f.Username
+}
+
+// ExportAuditLog verifies the chain of the audit file and writes the lines
+// selected by the filter unchanged. It stops at the first line breaking the
+// chain and returns the number of lines written.
+func ExportAuditLog(path string, filter AuditFilter, w io.Writer) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxAuditRecord)
+	count, prev := 0, ""
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return count, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if record.Prev != prev {
+			return count, fmt.Errorf("%s:%d: chain broken, a record before was changed or removed", path, n)
+		}
+		hash := record.Hash
+		sealed, err := record.seal(prev)
+		if err != nil {
+			return count, err
+		}
+		if record.Hash != hash || !bytes.Equal(sealed, line) {
+			return count, fmt.Errorf("%s:%d: record was changed", path, n)
+		}
+		prev = hash
+		if filter.match(record) {
+			if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAuditFile writes the records chained as the audit log would, but with
+// their own times
+func writeAuditFile(t *testing.T, records []AuditRecord) string {
+	var buf bytes.Buffer
+	prev := ""
+	for _, r := range records {
+		line, err := r.seal(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(line, '\n'))
+		prev = r.Hash
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAuditFile(t *testing.T, path string) []AuditRecord {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var r AuditRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.record(AuditRecord{Event: auditLogin, Username: "alice", Module: "local"})
+	audit.record(AuditRecord{Event: auditLogout, Username: "alice"})
+	audit.file.Close()
+
+	// a reopened log continues the chain
+	if audit, err = newAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	audit.record(AuditRecord{Event: auditSessionRevoked, Username: "admin", Subject: "bob"})
+	audit.file.Close()
+
+	records := readAuditFile(t, path)
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+	prev := ""
+	for i, r := range records {
+		if r.Prev != prev || r.Hash == "" || r.Time.IsZero() {
+			t.Errorf("record %d: prev %q hash %q time %v, want prev %q", i, r.Prev, r.Hash, r.Time, prev)
+		}
+		prev = r.Hash
+	}
+
+	var out bytes.Buffer
+	count, err := ExportAuditLog(path, AuditFilter{}, &out)
+	if err != nil || count != 3 {
+		t.Fatalf("export = %d, %v", count, err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("export changed the records:\n%s", out.Bytes())
+	}
+}
+
+func TestAuditLogUnreadableLastRecord(t *testing.T) {
+	path := writeAuditFile(t, []AuditRecord{{Event: auditLogin, Username: "alice"}})
+	data, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path, append(data, "{\"event\": \"logi"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAuditLog(path); err == nil {
+		t.Fatal("an audit log with a torn last record was continued")
+	}
+}
+
+func TestExportAuditLogFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := writeAuditFile(t, []AuditRecord{
+		{Time: start, Event: auditLogin, Username: "alice"},
+		{Time: start.Add(time.Hour), Event: auditLogin, Username: "bob"},
+		{Time: start.Add(2 * time.Hour), Event: auditUserRevoked, Username: "admin", Subject: "alice"},
+		{Time: start.Add(3 * time.Hour), Event: auditLogout, Username: "bob"},
+	})
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		events []string
+	}{
+		{"everything", AuditFilter{}, []string{auditLogin, auditLogin, auditUserRevoked, auditLogout}},
+		{"acting or acted on user", AuditFilter{Username: "alice"}, []string{auditLogin, auditUserRevoked}},
+		{"from", AuditFilter{From: start.Add(2 * time.Hour)}, []string{auditUserRevoked, auditLogout}},
+		{"to is excluded", AuditFilter{To: start.Add(2 * time.Hour)}, []string{auditLogin, auditLogin}},
+		{"range and user", AuditFilter{From: start.Add(time.Hour), To: start.Add(4 * time.Hour), Username: "bob"}, []string{auditLogin, auditLogout}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		count, err := ExportAuditLog(path, tt.filter, &out)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var events []string
+		for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+			var r AuditRecord
+			if line != "" && json.Unmarshal([]byte(line), &r) == nil {
+				events = append(events, r.Event)
+			}
+		}
+		if count != len(tt.events) || strings.Join(events, ",") != strings.Join(tt.events, ",") {
+			t.Errorf("%s: exported %d %v, want %v", tt.name, count, events, tt.events)
+		}
+	}
+}
+
+func TestExportAuditLogTampering(t *testing.T) {
+	records := []AuditRecord{
+		{Event: auditLogin, Username: "alice"},
+		{Event: auditLogin, Username: "bob"},
+		{Event: auditLogout, Username: "bob"},
+	}
+	lines := func(t *testing.T) []string {
+		data, _ := ioutil.ReadFile(writeAuditFile(t, records))
+		return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		err    string
+	}{
+		{"changed record", func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"bob"`, `"eve"`, 1)
+			return l
+		}, ":2: record was changed"},
+		{"removed record", func(l []string) []string { return append(l[:1], l[2:]...) }, ":2: chain broken"},
+		{"reordered records", func(l []string) []string {
+			l[0], l[1] = l[1], l[0]
+			return l
+		}, ":1: chain broken"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		if err := ioutil.WriteFile(path, []byte(strings.Join(tt.tamper(lines(t)), "")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ExportAuditLog(path, AuditFilter{}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: export error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	// the unkeyed chain can not tell that the newest records were removed
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ioutil.WriteFile(path, []byte(strings.Join(lines(t)[:2], "")), 0600)
+	if count, err := ExportAuditLog(path, AuditFilter{}, ioutil.Discard); err != nil || count != 2 {
+		t.Fatalf("export of a truncated log = %d, %v", count, err)
+	}
+}
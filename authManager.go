@@ -1,44 +1,294 @@
 package session
 
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// policySufficient modules authenticate the user on success, a failure
+	// moves on to the next module
+	policySufficient = "sufficient"
+	// policyRequired modules must accept the credentials, a failure ends the chain
+	policyRequired = "required"
+	// policyOptional modules never decide the login, they only add roles
+	policyOptional = "optional"
+)
+
+// AuthConfig lists the password authentication modules in the order they are tried
+type AuthConfig struct {
+	Modules []authModuleConfig `json:"modules"`
+	// RequireOrganization refuses logins without an organization, so every
+	// session is tied to a tenant
+	RequireOrganization bool `json:"require_organization"`
+}
+
+// authModuleConfig places a module, ldap or local, in the chain
+type authModuleConfig struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+}
+
+// authModule is a module of the chain with its error counters
+type authModule struct {
+	name   string
+	policy string
+	module AuthInterface
+
+	mtx         sync.Mutex
+	errors      int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// authModuleStatus is reported by the admin API
+type authModuleStatus struct {
+	Organization string     `json:"organization,omitempty"`
+	Name         string     `json:"name"`
+	Policy       string     `json:"policy"`
+	Errors       int        `json:"errors"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+}
 
 //AuthManager is responsible for cycling through the different authentication mechanizms
 type AuthManager struct {
-	authModuleCount int64
-	authModules     []AuthInterface
+	authModules []*authModule
+	// orgs have their own module chains, keyed by lower case name
+	orgs map[string]*organization
+	// requireOrganization refuses logins without an organization
+	requireOrganization bool
+	// redirect signs users in at an external identity provider, nil when not configured
+	redirect redirectProvider
+	throttle *loginThrottle
+	// backend keeps the used TOTP steps and recovery codes
+	backend kvBackend
+	logger  log.Logger
 }
 
-func (a *AuthManager) authenticate(cred Credentials) (LoginResponse, error) {
+// authenticate refuses throttled attempts before any module sees the
+// credentials and counts the failures of the others. An unavailable module is
+// not the user's failure and counts nothing.
+func (a *AuthManager) authenticate(cred Credentials, clientIP string) (LoginResponse, error) {
+	if cred.Organization == "" && a.requireOrganization {
+		return LoginResponse{Authenticated: false}, &apiError{
+			status:  http.StatusBadRequest,
+			Code:    "organization_required",
+			Message: "An organization is required to log in",
+		}
+	}
+	if err := a.throttle.check(cred.Username, clientIP); err != nil {
+		return LoginResponse{Authenticated: false, Message: err.Error()}, err
+	}
 	var result LoginResponse
-	var err error
-
-	for _, element := range a.authModules {
-		result, err = element.authenticate(cred)
-		if result.Authenticated{
-			return result, err
+	unavailable := false
+	if cred.Organization == "" {
+		result, unavailable = a.chain(a.authModules, cred)
+	} else if org, ok := a.orgs[strings.ToLower(cred.Organization)]; ok {
+		result, unavailable = a.chain(org.modules, cred)
+		result.Organization = org.name
+		result.Tenant = org.tenant
+	}
+	if result.Authenticated {
+		// with a second factor the counter is only cleared once the
+		// code is verified too
+		if a.enrollment(cred.Username) != nil {
+			result.MFARequired = true
+			return result, nil
+		}
+		if err := a.throttle.succeeded(cred.Username); err != nil {
+			return LoginResponse{Authenticated: false}, err
+		}
+		return result, nil
+	}
+	if unavailable {
+		// the credentials may be right, tell the user to retry instead
+		return LoginResponse{Authenticated: false}, &apiError{
+			status:  http.StatusServiceUnavailable,
+			Code:    "auth_unavailable",
+			Message: "Authentication service unavailable, try again later",
 		}
 	}
+	if err := a.throttle.failed(cred.Username, clientIP); err != nil {
+		return LoginResponse{Authenticated: false}, err
+	}
 	return LoginResponse{Authenticated: false, Message: "Invalid username or password"}, nil
 }
 
-//NewAuthmanager creates a new authentication manager
-func NewAuthmanager() *AuthManager {
-	return &AuthManager{
-		authModuleCount: 1,
-		authModules:     createModules(),
+// chain runs the modules by their policies. It reports whether a sufficient
+// or required module failed with an error rather than a wrong password.
+func (a *AuthManager) chain(modules []*authModule, cred Credentials) (LoginResponse, bool) {
+	invalid := LoginResponse{Authenticated: false, Message: "Invalid username or password"}
+	var roles, accepted []string
+	required, unavailable := false, false
+	for _, m := range modules {
+		result, err := m.module.authenticate(cred)
+		if err != nil {
+			warnLog(a.logger).Log("msg", "authentication module failed", "module", m.name, "organization", cred.Organization, "err", err)
+			m.failed(err)
+			unavailable = unavailable || m.policy != policyOptional
+		}
+		if !result.Authenticated {
+			if m.policy == policyRequired {
+				return invalid, unavailable
+			}
+			continue
+		}
+		accepted = append(accepted, m.name)
+		for _, role := range result.Roles {
+			if contains(roles, role) < 0 {
+				roles = append(roles, role)
+			}
+		}
+		switch m.policy {
+		case policySufficient:
+			return LoginResponse{Authenticated: true, Message: "success", Roles: roles, module: strings.Join(accepted, ",")}, false
+		case policyRequired:
+			required = true
+		}
 	}
+	if required {
+		return LoginResponse{Authenticated: true, Message: "success", Roles: roles, module: strings.Join(accepted, ",")}, false
+	}
+	return invalid, unavailable
 }
 
-func createModules() []AuthInterface {
-	var inter []AuthInterface
-	ldapModule := NewLdapAuth()
-	inter = append(inter, ldapModule)
-	localAuthModule := NewLocalAuth();
-	inter = append(inter, localAuthModule)
-	return inter
+// failed records an error of the module itself, like an unreachable server
+func (m *authModule) failed(err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.errors++
+	m.lastError = err.Error()
+	m.lastErrorAt = time.Now()
+}
+
+func (m *authModule) status(org string) authModuleStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	status := authModuleStatus{Organization: org, Name: m.name, Policy: m.policy, Errors: m.errors, LastError: m.lastError}
+	if !m.lastErrorAt.IsZero() {
+		lastErrorAt := m.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+func (a *AuthManager) status() []authModuleStatus {
+	result := []authModuleStatus{}
+	for _, m := range a.authModules {
+		result = append(result, m.status(""))
+	}
+	for _, org := range a.orgs {
+		for _, m := range org.modules {
+			result = append(result, m.status(org.name))
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Organization < result[j].Organization
+	})
+	return result
+}
+
+// chains returns the module chain of every organization after the default one
+func (a *AuthManager) chains() [][]*authModule {
+	chains := [][]*authModule{a.authModules}
+	for _, org := range a.orgs {
+		chains = append(chains, org.modules)
+	}
+	return chains
+}
+
+// redirectProvider returns the module that signs users in at an external
+// identity provider, nil when none is configured
+func (a *AuthManager) redirectProvider() redirectProvider {
+	return a.redirect
+}
+
+//NewAuthmanager creates a new authentication manager. The login failure
+//counters are kept in the session store backend.
+func NewAuthmanager(config Config, backend kvBackend, logger log.Logger) *AuthManager {
+	// the members of organizations sharing the ldap section get no session
+	// without their organization
+	ldap := config.LDAP
+	for _, o := range config.Organizations {
+		if o.LDAP == nil {
+			ldap.excluded = append(ldap.excluded, o.LDAPGroups...)
+		}
+	}
+	a := &AuthManager{
+		authModules:         newModuleChain(config.Auth.Modules, ldap, config.LocalAuthFile, logger),
+		orgs:                newOrganizations(config, logger),
+		requireOrganization: config.Auth.RequireOrganization,
+		throttle:            newLoginThrottle(config.Lockout, backend),
+		backend:             backend,
+		logger:              logger,
+	}
+	if config.OIDC.Enabled {
+		a.redirect = NewOIDCAuth(config.OIDC, logger)
+	}
+	return a
+}
+
+// newModuleChain builds the modules of a chain. A disabled ldap module is
+// left out.
+func newModuleChain(chain []authModuleConfig, ldap ldapConfig, localAuthFile string, logger log.Logger) []*authModule {
+	var modules []*authModule
+	for _, m := range chain {
+		var module AuthInterface
+		switch m.Name {
+		case "ldap":
+			if !ldap.Enabled {
+				continue
+			}
+			module = NewLdapAuth(ldap)
+		case "local":
+			module = NewLocalAuth(localAuthFile, logger)
+		default:
+			continue
+		}
+		modules = append(modules, &authModule{name: m.Name, policy: m.Policy, module: module})
+	}
+	return modules
+}
+
+func validateModules(prefix string, chain []authModuleConfig, ldapEnabled bool) []string {
+	var problems []string
+	seen := map[string]bool{}
+	deciding := false
+	for _, m := range chain {
+		switch m.Name {
+		case "ldap", "local":
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown module %q", prefix, m.Name))
+		}
+		if seen[m.Name] {
+			problems = append(problems, fmt.Sprintf("%s: module %q is listed twice", prefix, m.Name))
+		}
+		seen[m.Name] = true
+		switch m.Policy {
+		case policySufficient, policyRequired:
+			deciding = deciding || m.Name != "ldap" || ldapEnabled
+		case policyOptional:
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown policy %q of module %q", prefix, m.Policy, m.Name))
+		}
+		if m.Name == "ldap" && m.Policy == policyRequired && !ldapEnabled {
+			problems = append(problems, prefix+": ldap is required but ldap.enabled is false")
+		}
+	}
+	if !deciding {
+		problems = append(problems, prefix+": at least one enabled module must be sufficient or required")
+	}
+	return problems
 }
 
 //AuthInterface - all authentication modules should implement this interface
 type AuthInterface interface {
 	authenticate(cred Credentials) (LoginResponse, error)
 }
-
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeAuthModule accepts the listed users with their roles, whatever the
+// password, or fails with err
+type fakeAuthModule struct {
+	users map[string][]string
+	err   error
+	calls int
+}
+
+func (m *fakeAuthModule) authenticate(cred Credentials) (LoginResponse, error) {
+	m.calls++
+	if m.err != nil {
+		return LoginResponse{}, m.err
+	}
+	roles, ok := m.users[cred.Username]
+	return LoginResponse{Authenticated: ok, Roles: roles}, nil
+}
+
+var (
+	acceptAlice = map[string][]string{"alice": {"operator"}}
+	errDown     = errors.New("connection refused")
+)
+
+func TestAuthChainPolicies(t *testing.T) {
+	type step struct {
+		policy string
+		users  map[string][]string
+		err    error
+	}
+	tests := []struct {
+		name  string
+		chain []step
+		// called are the modules that saw the credentials
+		called        []string
+		authenticated bool
+		module        string
+		roles         []string
+		unavailable   bool
+	}{
+		{"sufficient accepts", []step{{policySufficient, acceptAlice, nil}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0"}, true, "m0", []string{"operator"}, false},
+		{"sufficient refuses, the next accepts", []step{{policySufficient, nil, nil}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0", "m1"}, true, "m1", []string{"operator"}, false},
+		{"required refuses", []step{{policyRequired, nil, nil}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0"}, false, "", nil, false},
+		{"required then optional", []step{{policyRequired, acceptAlice, nil}, {policyOptional, map[string][]string{"alice": {"auditor", "operator"}}, nil}},
+			[]string{"m0", "m1"}, true, "m0,m1", []string{"operator", "auditor"}, false},
+		{"required then sufficient", []step{{policyRequired, acceptAlice, nil}, {policySufficient, map[string][]string{"alice": {"admin"}}, nil}, {policyOptional, acceptAlice, nil}},
+			[]string{"m0", "m1"}, true, "m0,m1", []string{"operator", "admin"}, false},
+		{"optional alone", []step{{policyOptional, acceptAlice, nil}},
+			[]string{"m0"}, false, "", nil, false},
+		{"optional errors", []step{{policyOptional, nil, errDown}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0", "m1"}, true, "m1", []string{"operator"}, false},
+		{"sufficient errors, the next accepts", []step{{policySufficient, nil, errDown}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0", "m1"}, true, "m1", []string{"operator"}, false},
+		{"sufficient errors, the next refuses", []step{{policySufficient, nil, errDown}, {policySufficient, nil, nil}},
+			[]string{"m0", "m1"}, false, "", nil, true},
+		{"required errors", []step{{policyRequired, nil, errDown}, {policySufficient, acceptAlice, nil}},
+			[]string{"m0"}, false, "", nil, true},
+	}
+	for _, tt := range tests {
+		var modules []*authModule
+		var fakes []*fakeAuthModule
+		for i, s := range tt.chain {
+			fake := &fakeAuthModule{users: s.users, err: s.err}
+			fakes = append(fakes, fake)
+			modules = append(modules, &authModule{name: "m" + strconv.Itoa(i), policy: s.policy, module: fake})
+		}
+		a := &AuthManager{logger: log.NewNopLogger()}
+		result, unavailable := a.chain(modules, Credentials{Username: "alice", Password: "pw"})
+
+		var called []string
+		for i, fake := range fakes {
+			if fake.calls > 0 {
+				called = append(called, modules[i].name)
+			}
+		}
+		if !reflect.DeepEqual(called, tt.called) {
+			t.Errorf("%s: called %v, want %v", tt.name, called, tt.called)
+		}
+		if result.Authenticated != tt.authenticated || result.module != tt.module || !reflect.DeepEqual(result.Roles, tt.roles) || unavailable != tt.unavailable {
+			t.Errorf("%s: %+v (module %q), unavailable %v, want authenticated %v, module %q, roles %v, unavailable %v",
+				tt.name, result, result.module, unavailable, tt.authenticated, tt.module, tt.roles, tt.unavailable)
+		}
+		for i, fake := range fakes {
+			if fake.err != nil && fake.calls > 0 && modules[i].status("").Errors != 1 {
+				t.Errorf("%s: %s error not counted", tt.name, modules[i].name)
+			}
+		}
+	}
+}
+
+func TestAuthenticateUnavailable(t *testing.T) {
+	for _, policy := range []string{policySufficient, policyRequired} {
+		down := &fakeAuthModule{err: errDown}
+		a := &AuthManager{
+			authModules: []*authModule{{name: "ldap", policy: policy, module: down}, {name: "local", policy: policySufficient, module: &fakeAuthModule{}}},
+			throttle:    testThrottle(LockoutConfig{MaxFailures: 2, IPMaxFailures: 2, Duration: 10, Backoff: 1, MaxBackoff: 10, Window: 15}),
+			logger:      log.NewNopLogger(),
+		}
+		// more attempts than lock the user or the IP, none backs off
+		for i := 0; i < 4; i++ {
+			_, err := a.authenticate(Credentials{Username: "alice", Password: "pw"}, "192.0.2.1")
+			if apierr, ok := err.(*apiError); !ok || apierr.status != http.StatusServiceUnavailable || apierr.Code != "auth_unavailable" {
+				t.Fatalf("%s: attempt %d = %#v, want auth_unavailable", policy, i+1, err)
+			}
+		}
+		for _, key := range []string{lockoutUserKey("alice"), lockoutIPKey("192.0.2.1")} {
+			if c, _ := a.throttle.load(key); c.Failures != 0 {
+				t.Errorf("%s: counter %+v during an outage", policy, c)
+			}
+		}
+
+		// once the module is back wrong passwords count again
+		down.err = nil
+		a.authenticate(Credentials{Username: "alice", Password: "wrong"}, "192.0.2.1")
+		if c, _ := a.throttle.load(lockoutUserKey("alice")); c.Failures != 1 {
+			t.Errorf("%s: counter %+v after a wrong password", policy, c)
+		}
+	}
+}
+
+func TestHTTPLoginRecordsModule(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Auth.Modules = []authModuleConfig{{Name: "local", Policy: policyRequired}}
+	})
+	// a module adding roles to the users of the local file
+	groups := &authModule{name: "groups", policy: policyOptional, module: &fakeAuthModule{users: map[string][]string{"operator": {"auditor"}}}}
+	ts.service.authmanager.authModules = append(ts.service.authmanager.authModules, groups)
+
+	admin, operator := ts.client(t), ts.client(t)
+	ts.login(t, admin, "admin", "admin-pw")
+	if result := ts.login(t, operator, "operator", "operator-pw"); !reflect.DeepEqual(result.Roles, []string{"operator", "auditor"}) {
+		t.Fatalf("operator roles %v", result.Roles)
+	}
+	var list []sessionInfo
+	ts.do(t, admin, "GET", "/admin/sessions/", "", nil, &list)
+	modules := map[string]string{}
+	for _, info := range list {
+		modules[info.Username] = info.AuthModule
+	}
+	if !reflect.DeepEqual(modules, map[string]string{"admin": "local", "operator": "local,groups"}) {
+		t.Fatalf("session modules %v", modules)
+	}
+}
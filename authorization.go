@@ -0,0 +1,38 @@
+package session
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// authorize checks that the user holds one of the roles the route requires for
+// the method. Routes without authorization are open to any logged-in user.
+func authorize(route routedetail, method string, roles []string) error {
+	if !route.Authorization {
+		return nil
+	}
+	required, ok := route.Roles[method]
+	if !ok {
+		required = route.Roles["*"]
+	}
+	for _, role := range roles {
+		if contains(required, role) >= 0 {
+			return nil
+		}
+	}
+	return &apiError{
+		status:  http.StatusForbidden,
+		Code:    "forbidden",
+		Message: "user does not have a role required for " + method + " " + route.Api,
+		Route:   route.Api,
+		Method:  method,
+		Roles:   required,
+	}
+}
+
+// sessionRoles returns the roles stored in the session at login
+func sessionRoles(session *sessions.Session) []string {
+	roles, _ := session.Values["Roles"].([]string)
+	return roles
+}
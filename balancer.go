@@ -0,0 +1,401 @@
+package session
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/sony/gobreaker"
+)
+
+// balancerconfig selects how a route spreads requests over its destinations
+type balancerconfig struct {
+	// Policy is "round_robin" (default), "least_connections" or "consistent_hash"
+	Policy string `json:"policy"`
+	// HashKey is "user" (default), "client_ip" or "header:<name>" for consistent_hash
+	HashKey string `json:"hash_key"`
+	// MaxFailures consecutive failed calls eject a destination for EjectionTime seconds
+	MaxFailures  int               `json:"max_failures"`
+	EjectionTime int               `json:"ejection_time"`
+	HealthCheck  healthcheckconfig `json:"health_check"`
+}
+
+// healthcheckconfig enables active health checking when Path is set
+type healthcheckconfig struct {
+	Path     string `json:"path"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+}
+
+// upstream is one destination, shared by every route that lists it
+type upstream struct {
+	url    string
+	active int64
+	// call sends a proxyCall through the destination's circuit breaker
+	call    endpoint.Endpoint
+	breaker *gobreaker.CircuitBreaker
+	// breakerConfig is the circuit breaker setting every route must agree on
+	breakerConfig breakerconfig
+	// openUntil is when the open circuit lets a trial request through, in
+	// Unix nanoseconds. It is atomic since the breaker reports state changes
+	// while available holds mtx.
+	openUntil int64
+
+	mtx          sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+	lastCheck    time.Time
+	lastError    string
+	routes       []string
+}
+
+// upstreamStatus is the health state reported by the admin endpoint
+type upstreamStatus struct {
+	Destination         string     `json:"destination"`
+	Available           bool       `json:"available"`
+	Healthy             bool       `json:"healthy"`
+	Circuit             string     `json:"circuit"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	ActiveRequests      int64      `json:"active_requests"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	Routes              []string   `json:"routes"`
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil) && u.breaker.State() != gobreaker.StateOpen
+}
+
+// retryAfter returns the seconds until the open circuit of the destination
+// lets a trial request through, at least one
+func (u *upstream) retryAfter(now time.Time) int {
+	wait := time.Unix(0, atomic.LoadInt64(&u.openUntil)).Sub(now)
+	if wait < time.Second {
+		return 1
+	}
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+// report records the outcome of a proxied call for passive ejection
+func (u *upstream) report(failed bool, reason string, maxFailures int, ejection time.Duration) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	u.lastError = reason
+	if u.failures >= maxFailures {
+		u.ejectedUntil = time.Now().Add(ejection)
+		u.failures = 0
+	}
+}
+
+func (u *upstream) status() upstreamStatus {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	status := upstreamStatus{
+		Destination:         u.url,
+		Available:           u.healthy && !time.Now().Before(u.ejectedUntil) && u.breaker.State() != gobreaker.StateOpen,
+		Healthy:             u.healthy,
+		Circuit:             u.breaker.State().String(),
+		ConsecutiveFailures: u.failures,
+		ActiveRequests:      atomic.LoadInt64(&u.active),
+		LastError:           u.lastError,
+		Routes:              append([]string(nil), u.routes...),
+	}
+	if time.Now().Before(u.ejectedUntil) {
+		ejectedUntil := u.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+	if !u.lastCheck.IsZero() {
+		lastCheck := u.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+// check runs one active health check against the destination
+func (u *upstream) check(client *http.Client, path string) {
+	resp, err := client.Get(strings.TrimSuffix(u.url, "/") + path)
+	healthy, reason := err == nil, ""
+	if err != nil {
+		reason = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			healthy, reason = false, "health check returned "+resp.Status
+		}
+	}
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.healthy = healthy
+	u.lastCheck = time.Now()
+	if reason != "" {
+		u.lastError = reason
+	}
+}
+
+// upstreamRegistry keeps one upstream per destination URL
+type upstreamRegistry struct {
+	mtx       sync.Mutex
+	upstreams map[string]*upstream
+	checked   map[string]bool
+	// stop ends the health checks when closed
+	stop   chan struct{}
+	closed bool
+}
+
+func newUpstreamRegistry() *upstreamRegistry {
+	return &upstreamRegistry{
+		upstreams: make(map[string]*upstream),
+		checked:   make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+}
+
+// close stops the health checks, none are started afterwards
+func (g *upstreamRegistry) close() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !g.closed {
+		close(g.stop)
+		g.closed = true
+	}
+}
+
+// get returns the upstream of a destination. The destination has one circuit
+// breaker, so the routes listing it must have the same settings for it.
+func (g *upstreamRegistry) get(destination, route string, breaker breakerconfig) (*upstream, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	breaker = breaker.withDefaults()
+	u, ok := g.upstreams[destination]
+	if !ok {
+		u = &upstream{url: destination, healthy: true, breakerConfig: breaker}
+		opened := func(until time.Time) { atomic.StoreInt64(&u.openUntil, until.UnixNano()) }
+		u.call, u.breaker = newBreakerEndpoint(destination, breaker, opened)
+		g.upstreams[destination] = u
+	} else if u.breakerConfig != breaker {
+		return nil, fmt.Errorf("destination %q has circuit_breaker failures %d, open %d in route %q, not failures %d, open %d",
+			destination, u.breakerConfig.Failures, u.breakerConfig.Open, u.routes[0], breaker.Failures, breaker.Open)
+	}
+	u.routes = append(u.routes, route)
+	return u, nil
+}
+
+// startHealthCheck starts the active checker of a destination, once
+func (g *upstreamRegistry) startHealthCheck(u *upstream, config healthcheckconfig) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if config.Path == "" || g.checked[u.url] || g.closed {
+		return
+	}
+	g.checked[u.url] = true
+
+	interval := time.Duration(config.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	stop := g.stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			u.check(client, config.Path)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (g *upstreamRegistry) status() []upstreamStatus {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	var result []upstreamStatus
+	for _, u := range g.upstreams {
+		result = append(result, u.status())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Destination < result[j].Destination
+	})
+	return result
+}
+
+// balancer picks the destination of a route for each request
+type balancer struct {
+	config    balancerconfig
+	upstreams []*upstream
+	next      uint32
+	ring      []ringEntry
+}
+
+type ringEntry struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// ringReplicas is the number of points each destination takes on the hash ring
+const ringReplicas = 64
+
+func newBalancer(route routedetail, registry *upstreamRegistry) (*balancer, error) {
+	destinations := route.Destinations
+	if len(destinations) == 0 && route.Destination != "" {
+		destinations = []string{route.Destination}
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no destination")
+	}
+
+	b := &balancer{config: route.Balancer}
+	switch b.config.Policy {
+	case "":
+		b.config.Policy = "round_robin"
+	case "round_robin", "least_connections", "consistent_hash":
+	default:
+		return nil, fmt.Errorf("unknown balancer policy %q", b.config.Policy)
+	}
+	if b.config.HashKey == "" {
+		b.config.HashKey = "user"
+	}
+	if b.config.MaxFailures <= 0 {
+		b.config.MaxFailures = 3
+	}
+	if b.config.EjectionTime <= 0 {
+		b.config.EjectionTime = 30
+	}
+
+	for _, destination := range destinations {
+		if u, err := url.Parse(destination); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("bad destination %q", destination)
+		}
+		u, err := registry.get(destination, route.Api, route.CircuitBreaker)
+		if err != nil {
+			return nil, err
+		}
+		registry.startHealthCheck(u, b.config.HealthCheck)
+		b.upstreams = append(b.upstreams, u)
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(destination + "#" + strconv.Itoa(i)))
+			b.ring = append(b.ring, ringEntry{hash: hash, upstream: u})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return b, nil
+}
+
+// pick returns an available destination, or nil when all are down
+func (b *balancer) pick(r apiRequest) *upstream {
+	now := time.Now()
+	switch b.config.Policy {
+	case "least_connections":
+		var best *upstream
+		for _, u := range b.upstreams {
+			if u.available(now) && (best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active)) {
+				best = u
+			}
+		}
+		return best
+	case "consistent_hash":
+		hash := crc32.ChecksumIEEE([]byte(b.hashKey(r)))
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+		for i := 0; i < len(b.ring); i++ {
+			entry := b.ring[(start+i)%len(b.ring)]
+			if entry.upstream.available(now) {
+				return entry.upstream
+			}
+		}
+		return nil
+	}
+	start := atomic.AddUint32(&b.next, 1)
+	for i := 0; i < len(b.upstreams); i++ {
+		u := b.upstreams[(int(start)+i)%len(b.upstreams)]
+		if u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// unavailable is the error of a request for which pick found no destination.
+// When the circuits of all destinations are open the client may retry once
+// the first of them lets a trial request through, so it gets the circuit_open
+// error of a single destination with Retry-After.
+func (b *balancer) unavailable(route string) *apiError {
+	now := time.Now()
+	retryAfter := 0
+	for _, u := range b.upstreams {
+		if u.breaker.State() != gobreaker.StateOpen {
+			return &apiError{status: http.StatusServiceUnavailable, Code: "no_healthy_destination", Message: "no healthy destination for " + route, Route: route}
+		}
+		if wait := u.retryAfter(now); retryAfter == 0 || wait < retryAfter {
+			retryAfter = wait
+		}
+	}
+	return &apiError{status: http.StatusServiceUnavailable, Code: "circuit_open", Message: "the circuit breakers of all destinations of " + route + " are open", Route: route, RetryAfter: retryAfter}
+}
+
+func (b *balancer) hashKey(r apiRequest) string {
+	switch {
+	case b.config.HashKey == "client_ip":
+		host, _, _ := net.SplitHostPort(r.httpreq.RemoteAddr)
+		return host
+	case strings.HasPrefix(b.config.HashKey, "header:"):
+		return r.httpreq.Header.Get(strings.TrimPrefix(b.config.HashKey, "header:"))
+	}
+	return r.username
+}
+
+// report feeds the outcome of a call into passive ejection. Gateway errors
+// count as failures, other statuses come from a working destination.
+func (b *balancer) report(u *upstream, resp *http.Response, err error) {
+	ejection := time.Duration(b.config.EjectionTime) * time.Second
+	switch {
+	case err != nil:
+		u.report(true, err.Error(), b.config.MaxFailures, ejection)
+	case resp.StatusCode == http.StatusBadGateway, resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		u.report(true, "upstream returned "+resp.Status, b.config.MaxFailures, ejection)
+	default:
+		u.report(false, "", b.config.MaxFailures, ejection)
+	}
+}
+
+// upstreamBody keeps the destination's connection count until the streamed
+// response body is closed
+type upstreamBody struct {
+	io.ReadCloser
+	once     sync.Once
+	upstream *upstream
+}
+
+func (b *upstreamBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.upstream.active, -1) })
+	return b.ReadCloser.Close()
+}
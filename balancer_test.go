@@ -0,0 +1,278 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tripBreaker fails calls through the destination's breaker until it opens
+func tripBreaker(u *upstream, failures int) {
+	for i := 0; i < failures; i++ {
+		u.breaker.Execute(func() (interface{}, error) { return nil, errors.New("down") })
+	}
+}
+
+func TestForwardCircuitOpen(t *testing.T) {
+	routes := []routedetail{{
+		Api:            "/api/v1/",
+		Methods:        []string{"GET"},
+		Destinations:   []string{"http://127.0.0.1:9997", "http://127.0.0.1:9998"},
+		CircuitBreaker: breakerconfig{Failures: 2, Open: 20},
+	}}
+	routes, err := compileRoutes(routes, newUpstreamRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0]
+	request := apiRequest{httpreq: httptest.NewRequest("GET", "/api/v1/networks/", nil)}
+
+	tripBreaker(route.balancer.upstreams[0], 2)
+	if _, err := forward(route, request); err == nil || err.(*apiError).Code != "bad_gateway" {
+		// the other destination is still picked and refuses the connection
+		t.Fatalf("forward with one open circuit = %v, want bad_gateway", err)
+	}
+
+	tripBreaker(route.balancer.upstreams[1], 2)
+	_, err = forward(route, request)
+	apierr, ok := err.(*apiError)
+	if !ok || apierr.Code != "circuit_open" || apierr.status != http.StatusServiceUnavailable {
+		t.Fatalf("forward with all circuits open = %#v, want circuit_open", err)
+	}
+	if apierr.RetryAfter < 19 || apierr.RetryAfter > 20 {
+		t.Errorf("Retry-After = %d, want the 20s the circuits stay open", apierr.RetryAfter)
+	}
+}
+
+// testBalancer compiles a route over the destinations and stops its health
+// checks when the test ends
+func testBalancer(t *testing.T, config balancerconfig, destinations ...string) *balancer {
+	registry := newUpstreamRegistry()
+	t.Cleanup(registry.close)
+	routes, err := compileRoutes([]routedetail{{
+		Api:          "/api/v1/",
+		Methods:      []string{"GET"},
+		Destinations: destinations,
+		Balancer:     config,
+	}}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes[0].balancer
+}
+
+func userRequest(username string) apiRequest {
+	return apiRequest{httpreq: httptest.NewRequest("GET", "/api/v1/networks/", nil), username: username}
+}
+
+// eject takes the destination out until re-admitted with a zero time
+func eject(u *upstream, until time.Time) {
+	u.mtx.Lock()
+	u.ejectedUntil = until
+	u.mtx.Unlock()
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := testBalancer(t, balancerconfig{}, "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3")
+	counts := map[string]int{}
+	prev := ""
+	for i := 0; i < 6; i++ {
+		u := b.pick(userRequest("alice"))
+		if u.url == prev {
+			t.Fatalf("pick %d: %s twice in a row", i, u.url)
+		}
+		counts[u.url]++
+		prev = u.url
+	}
+	for _, u := range b.upstreams {
+		if counts[u.url] != 2 {
+			t.Errorf("%s picked %d times in 6, want 2", u.url, counts[u.url])
+		}
+	}
+
+	eject(b.upstreams[1], time.Now().Add(time.Hour))
+	for i := 0; i < 4; i++ {
+		if u := b.pick(userRequest("alice")); u == b.upstreams[1] {
+			t.Fatalf("pick %d: the ejected %s", i, u.url)
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := testBalancer(t, balancerconfig{Policy: "least_connections"}, "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3")
+	atomic.StoreInt64(&b.upstreams[0].active, 4)
+	atomic.StoreInt64(&b.upstreams[1].active, 1)
+	atomic.StoreInt64(&b.upstreams[2].active, 2)
+	if u := b.pick(userRequest("alice")); u != b.upstreams[1] {
+		t.Fatalf("picked %s, want the one with the fewest requests", u.url)
+	}
+	eject(b.upstreams[1], time.Now().Add(time.Hour))
+	if u := b.pick(userRequest("alice")); u != b.upstreams[2] {
+		t.Fatalf("picked %s, want the available one with the fewest requests", u.url)
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b := testBalancer(t, balancerconfig{Policy: "consistent_hash"}, "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3")
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy"}
+	picked := map[string]*upstream{}
+	used := map[*upstream]bool{}
+	for _, user := range users {
+		picked[user] = b.pick(userRequest(user))
+		used[picked[user]] = true
+		for i := 0; i < 3; i++ {
+			if u := b.pick(userRequest(user)); u != picked[user] {
+				t.Fatalf("%s: picked %s then %s", user, picked[user].url, u.url)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("%d users all went to one destination", len(users))
+	}
+
+	// only the users of an unavailable destination move, and they come back
+	down := picked["alice"]
+	eject(down, time.Now().Add(time.Hour))
+	for _, user := range users {
+		u := b.pick(userRequest(user))
+		if u == down || (picked[user] != down && u != picked[user]) {
+			t.Errorf("%s: picked %s with %s down, was %s", user, u.url, down.url, picked[user].url)
+		}
+	}
+	eject(down, time.Time{})
+	if u := b.pick(userRequest("alice")); u != down {
+		t.Errorf("alice: picked %s after re-admission, want %s", u.url, down.url)
+	}
+
+	// the key can come from a header instead of the user
+	b = testBalancer(t, balancerconfig{Policy: "consistent_hash", HashKey: "header:X-Tenant"}, "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3")
+	tenant := func(user, name string) apiRequest {
+		r := userRequest(user)
+		r.httpreq.Header.Set("X-Tenant", name)
+		return r
+	}
+	for _, name := range []string{"t1", "t2", "t3"} {
+		first := b.pick(tenant("alice", name))
+		for _, user := range users {
+			if u := b.pick(tenant(user, name)); u != first {
+				t.Fatalf("tenant %s: %s picked %s, want %s", name, user, u.url, first.url)
+			}
+		}
+	}
+}
+
+func TestBalancerPassiveEjection(t *testing.T) {
+	b := testBalancer(t, balancerconfig{MaxFailures: 2, EjectionTime: 60}, "http://10.0.0.1", "http://10.0.0.2")
+	u := b.upstreams[0]
+	badGateway := &http.Response{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+
+	// a working call resets the consecutive failures
+	b.report(u, badGateway, nil)
+	b.report(u, &http.Response{StatusCode: http.StatusNotFound}, nil)
+	b.report(u, nil, errors.New("connection refused"))
+	if !u.available(time.Now()) {
+		t.Fatal("ejected after failures that were not consecutive")
+	}
+	b.report(u, badGateway, nil)
+	if u.available(time.Now()) {
+		t.Fatal("not ejected after 2 consecutive failures")
+	}
+	if status := u.status(); status.EjectedUntil == nil || status.LastError != "upstream returned 502 Bad Gateway" {
+		t.Errorf("status %+v", status)
+	}
+	for i := 0; i < 4; i++ {
+		if picked := b.pick(userRequest("alice")); picked == u {
+			t.Fatalf("pick %d: the ejected destination", i)
+		}
+	}
+	if !u.available(time.Now().Add(61 * time.Second)) {
+		t.Fatal("still ejected after the ejection time")
+	}
+
+	// re-admitted once the ejection time has passed
+	eject(u, time.Now().Add(-time.Second))
+	picks := map[*upstream]bool{}
+	for i := 0; i < 4; i++ {
+		picks[b.pick(userRequest("alice"))] = true
+	}
+	if !picks[u] {
+		t.Fatal("not picked after the ejection time")
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	var status, checks int32 = http.StatusServiceUnavailable, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			atomic.AddInt32(&checks, 1)
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}
+	}))
+	defer server.Close()
+
+	registry := newUpstreamRegistry()
+	defer registry.close()
+	routes, err := compileRoutes([]routedetail{{
+		Api:          "/api/v1/",
+		Methods:      []string{"GET"},
+		Destinations: []string{server.URL},
+		Balancer:     balancerconfig{HealthCheck: healthcheckconfig{Path: "/health", Interval: 1}},
+	}}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := routes[0].balancer.upstreams[0]
+	waitFor := func(available bool) {
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if u.available(time.Now()) == available {
+				return
+			}
+		}
+		t.Fatalf("available = %v after 3s, want %v", !available, available)
+	}
+	waitFor(false)
+	if lastError := u.status().LastError; lastError != "health check returned 503 Service Unavailable" {
+		t.Errorf("last error %q", lastError)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitFor(true)
+
+	// no checks run after close, nor are new ones started
+	registry.close()
+	time.Sleep(50 * time.Millisecond)
+	before := atomic.LoadInt32(&checks)
+	registry.startHealthCheck(&upstream{url: server.URL + "/other", healthy: true}, healthcheckconfig{Path: "/health", Interval: 1})
+	time.Sleep(1500 * time.Millisecond)
+	if after := atomic.LoadInt32(&checks); after != before {
+		t.Errorf("%d health checks after close", after-before)
+	}
+}
+
+func TestSharedDestinationBreaker(t *testing.T) {
+	route := func(api string, breaker breakerconfig) routedetail {
+		return routedetail{Api: api, Methods: []string{"GET"}, Destination: "http://10.0.0.1", CircuitBreaker: breaker}
+	}
+	// unset settings agree with the defaults written out
+	routes, err := compileRoutes([]routedetail{
+		route("/api/v1/", breakerconfig{}),
+		route("/api/v2/", breakerconfig{Failures: 5, Open: 30}),
+	}, newUpstreamRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].balancer.upstreams[0] != routes[1].balancer.upstreams[0] {
+		t.Error("the routes do not share the destination")
+	}
+
+	_, err = compileRoutes([]routedetail{
+		route("/api/v1/", breakerconfig{Failures: 2}),
+		route("/api/v2/", breakerconfig{Failures: 10}),
+	}, newUpstreamRegistry())
+	if err == nil || !strings.Contains(err.Error(), `route "/api/v2/": destination "http://10.0.0.1" has circuit_breaker failures 2, open 30 in route "/api/v1/"`) {
+		t.Fatalf("conflicting breakers: %v", err)
+	}
+}
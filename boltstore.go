@@ -0,0 +1,171 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBackend stores sessions in a local BoltDB file for single node installs.
+// Each value is prefixed with its expiry as unix nanoseconds, zero for none.
+type boltBackend struct {
+	db        *bolt.DB
+	bucket    []byte
+	mtx       sync.Mutex
+	lastSweep time.Time
+}
+
+func newBoltBackend(path, prefix string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	bucket := []byte(prefix)
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltBackend{db: db, bucket: bucket, lastSweep: time.Now()}, nil
+}
+
+func (b *boltBackend) get(key string) ([]byte, error) {
+	var value []byte
+	expired := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(b.bucket).Get([]byte(key))
+		if len(data) < 8 {
+			return nil
+		}
+		if boltExpired(data, time.Now()) {
+			expired = true
+			return nil
+		}
+		value = append([]byte(nil), data[8:]...)
+		return nil
+	})
+	if err == nil && expired {
+		err = b.expire(key)
+	}
+	return value, err
+}
+
+// expire deletes the key if it is still expired, a value written since the
+// read is kept
+func (b *boltBackend) expire(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if data := bucket.Get([]byte(key)); len(data) < 8 || !boltExpired(data, time.Now()) {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) set(key string, value []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(b.bucket).Put([]byte(key), boltValue(value, ttl)); err != nil {
+			return err
+		}
+		return b.sweep(tx)
+	})
+}
+
+func (b *boltBackend) create(key string, value []byte, ttl time.Duration) (bool, error) {
+	created := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if data := bucket.Get([]byte(key)); len(data) >= 8 && !boltExpired(data, time.Now()) {
+			return nil
+		}
+		created = true
+		return bucket.Put([]byte(key), boltValue(value, ttl))
+	})
+	return created, err
+}
+
+func (b *boltBackend) replace(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	replaced := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		data := bucket.Get([]byte(key))
+		if len(data) < 8 || boltExpired(data, time.Now()) || !bytes.Equal(data[8:], old) {
+			return nil
+		}
+		replaced = true
+		return bucket.Put([]byte(key), boltValue(value, ttl))
+	})
+	return replaced, err
+}
+
+func boltValue(value []byte, ttl time.Duration) []byte {
+	data := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(data[:8], uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(data[8:], value)
+	return data
+}
+
+func boltExpired(data []byte, now time.Time) bool {
+	expires := int64(binary.BigEndian.Uint64(data[:8]))
+	return expires != 0 && now.UnixNano() > expires
+}
+
+// sweep drops expired entries that were never read again, at most once a minute
+func (b *boltBackend) sweep(tx *bolt.Tx) error {
+	b.mtx.Lock()
+	now := time.Now()
+	due := now.Sub(b.lastSweep) > time.Minute
+	if due {
+		b.lastSweep = now
+	}
+	b.mtx.Unlock()
+	if !due {
+		return nil
+	}
+
+	// deleting under the cursor would skip the key after each deleted one
+	bucket := tx.Bucket(b.bucket)
+	var expired [][]byte
+	c := bucket.Cursor()
+	for k, data := c.First(); k != nil; k, data = c.Next() {
+		if len(data) >= 8 && boltExpired(data, now) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltBackend) list(prefix string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := tx.Bucket(b.bucket).Cursor()
+		for k, data := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, data = c.Next() {
+			if len(data) < 8 || boltExpired(data, now) {
+				continue
+			}
+			result[string(k)] = append([]byte(nil), data[8:]...)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (b *boltBackend) delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+}
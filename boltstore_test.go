@@ -0,0 +1,55 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltSweep(t *testing.T) {
+	b := testBackends()["bolt"](t).(*boltBackend)
+	// neighbouring expired keys are all dropped, a cursor deleting as it
+	// iterates skips every second one
+	for i := 0; i < 20; i++ {
+		if err := b.set(fmt.Sprintf("expired/%02d", i), []byte("v"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.set("kept", []byte("v"), time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	b.mtx.Lock()
+	b.lastSweep = time.Now().Add(-2 * time.Minute)
+	b.mtx.Unlock()
+	if err := b.set("trigger", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).ForEach(func(k, v []byte) error {
+			left = append(left, string(k))
+			return nil
+		})
+	})
+	if len(left) != 2 || left[0] != "kept" || left[1] != "trigger" {
+		t.Fatalf("keys after the sweep: %v", left)
+	}
+}
+
+func TestBoltExpireKeepsNewValue(t *testing.T) {
+	b := testBackends()["bolt"](t).(*boltBackend)
+	b.set("key", []byte("old"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	// a value written between the read of the expired one and its deletion
+	if created, err := b.create("key", []byte("new"), time.Hour); !created || err != nil {
+		t.Fatalf("create = %v, %v", created, err)
+	}
+	if err := b.expire("key"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.get("key"); string(value) != "new" || err != nil {
+		t.Fatalf("get = %q, %v", value, err)
+	}
+}
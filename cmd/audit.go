@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"../../session-microservice"
+)
+
+// exportAuditCommand verifies the audit log and prints the records of a time
+// range and user
+func exportAuditCommand(args []string) error {
+	fs := flag.NewFlagSet("export-audit", flag.ExitOnError)
+	file := fs.String("file", "", "audit log file")
+	from := fs.String("from", "", "first time to export, RFC 3339")
+	to := fs.String("to", "", "time to export up to, excluded, RFC 3339")
+	user := fs.String("user", "", "only records of this user, acting or acted on")
+	fs.Parse(args)
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	filter := session.AuditFilter{Username: *user}
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("-from: %v", err)
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("-to: %v", err)
+		}
+	}
+	count, err := session.ExportAuditLog(*file, filter, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d record(s), the chain of %s is intact up to its last record\n", count, *file)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"../../session-microservice"
+)
+
+// hashPasswordCommand prints the hash of a password read from stdin
+func hashPasswordCommand(args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	algorithm := fs.String("algorithm", session.HashBcrypt, "hash algorithm (bcrypt or argon2id)")
+	fs.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := session.HashPassword(password, *algorithm)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// migrateAuthFileCommand hashes every plaintext password in a local authorization file
+func migrateAuthFileCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-authfile", flag.ExitOnError)
+	in := fs.String("in", session.DefaultConfig().LocalAuthFile, "local authorization file to migrate")
+	out := fs.String("out", "", "output file (defaults to rewriting -in)")
+	algorithm := fs.String("algorithm", session.HashBcrypt, "hash algorithm (bcrypt or argon2id)")
+	fs.Parse(args)
+
+	if *out == "" {
+		*out = *in
+	}
+	count, err := session.MigrateLocalAuthFile(*in, *out, *algorithm)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "migrated %d password(s) to %s\n", count, *algorithm)
+	return nil
+}
+
+// enrollTOTPCommand enrolls a user of the local authorization file for the
+// TOTP second login step
+func enrollTOTPCommand(args []string) error {
+	fs := flag.NewFlagSet("enroll-totp", flag.ExitOnError)
+	user := fs.String("user", "", "user to enroll")
+	file := fs.String("file", session.DefaultConfig().LocalAuthFile, "local authorization file")
+	issuer := fs.String("issuer", "Contiv", "issuer shown by authenticator apps")
+	fs.Parse(args)
+
+	if *user == "" {
+		return errors.New("-user is required")
+	}
+	uri, codes, err := session.EnrollTOTP(*file, *user, *issuer)
+	if err != nil {
+		return err
+	}
+	fmt.Println(uri)
+	fmt.Fprintln(os.Stderr, "recovery codes, each can be used once:")
+	for _, code := range codes {
+		fmt.Println(code)
+	}
+	return nil
+}
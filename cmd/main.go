@@ -1,31 +1,66 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"../../session-microservice"
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	
 )
 
+// commands are subcommands selected by the first argument
+var commands = map[string]func(args []string) error{
+	"hash-password":    hashPasswordCommand,
+	"migrate-authfile": migrateAuthFileCommand,
+	"enroll-totp":      enrollTOTPCommand,
+	"export-audit":     exportAuditCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var (
-		httpAddr = flag.String("http.addr", ":8085", "HTTP listen address")
+		loader      = session.NewConfigLoader(flag.CommandLine)
+		printConfig = flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
 	)
 	flag.Parse()
 
+	config, err := loader.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		buf, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+		fmt.Println(string(buf))
+		if err := config.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var logger log.Logger
 	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
-		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
+		logger = session.NewLogger(config.Log, os.Stderr)
 	}
 
 	var ctx context.Context
@@ -35,10 +70,25 @@ func main() {
 
 	var s session.Service
 	{
-		s = session.NewSessionService()
+		s, err = session.NewSessionService(config, logger)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
 		s = session.LoggingMiddleware(logger)(s)
 	}
 
+	var metrics *session.Metrics
+	{
+		metrics = session.NewPrometheusMetrics()
+		s = session.InstrumentingMiddleware(metrics)(s)
+		// the gauges scan the session store, nothing reads them without the
+		// admin listener
+		if config.AdminAddr != "" {
+			go metrics.Poll(ctx, s, 15*time.Second)
+		}
+	}
+
 	var h http.Handler
 	{
 		h = session.MakeHTTPHandler(ctx, s, log.NewContext(logger).With("component", "HTTP"))
@@ -52,9 +102,19 @@ func main() {
 	}()
 
 	go func() {
-		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errs <- http.ListenAndServe(*httpAddr, h)
+		logger.Log("transport", "HTTP", "addr", config.HTTPAddr)
+		errs <- http.ListenAndServe(config.HTTPAddr, h)
 	}()
 
+	if config.AdminAddr != "" {
+		go func() {
+			m := http.NewServeMux()
+			m.Handle("/metrics", promhttp.Handler())
+			logger.Log("transport", "HTTP", "admin_addr", config.AdminAddr)
+			errs <- http.ListenAndServe(config.AdminAddr, m)
+		}()
+	}
+
 	logger.Log("exit", <-errs)
+	s.Close()
 }
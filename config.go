@@ -0,0 +1,471 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Config holds every setting of the session service. The defaults are
+// overridden by the configuration file, then by SESSION_* environment
+// variables and finally by command line flags.
+type Config struct {
+	HTTPAddr string        `json:"http_addr"`
+	Log      LogConfig     `json:"log"`
+	Session  SessionConfig `json:"session"`
+	CSRF     CSRFConfig    `json:"csrf"`
+	Auth     AuthConfig    `json:"auth"`
+	Lockout  LockoutConfig `json:"lockout"`
+	MFA      MFAConfig     `json:"mfa"`
+	Audit    AuditConfig   `json:"audit"`
+	Store    StoreConfig   `json:"store"`
+	LDAP     ldapConfig    `json:"ldap"`
+	OIDC     oidcConfig    `json:"oidc"`
+	// Organizations users log in to, each with its own module chain
+	Organizations []OrganizationConfig `json:"organizations"`
+	// LocalAuthFile lists the local users, APIConfigFile the proxied routes
+	LocalAuthFile string `json:"local_auth_file"`
+	APIConfigFile string `json:"api_config_file"`
+	// AdminRole is required by the administrative endpoints
+	AdminRole string `json:"admin_role"`
+	// AdminAddr serves /metrics, no admin listener is started when empty
+	AdminAddr string `json:"admin_addr"`
+}
+
+// SessionConfig configures the session cookie
+type SessionConfig struct {
+	Name string `json:"name"`
+	// Secret signs the session cookie. When it is empty a random secret is
+	// generated at startup and sessions do not survive a restart.
+	Secret string `json:"secret"`
+	// IdleTimeout ends a session after this many minutes without activity.
+	// Logins and proxied API requests are activity, validateapp is not.
+	IdleTimeout float64 `json:"idle_timeout"`
+	// MaxLifetime ends a session this many minutes after login regardless of
+	// activity, zero for no limit
+	MaxLifetime float64 `json:"max_lifetime"`
+	// RenewInterval is the number of seconds after which activity is recorded
+	// again, so that not every request writes the session back to the store
+	RenewInterval int `json:"renew_interval"`
+	// CookieSecure sends the session cookie over HTTPS only
+	CookieSecure bool `json:"cookie_secure"`
+}
+
+// redacted replaces secrets in the printed configuration
+const redacted = "********"
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		HTTPAddr: ":8085",
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+		Session: SessionConfig{
+			Name:          "contiv-session",
+			IdleTimeout:   30,
+			MaxLifetime:   720,
+			RenewInterval: 60,
+		},
+		CSRF: CSRFConfig{
+			Header: "X-CSRF-Token",
+		},
+		Auth: AuthConfig{
+			Modules: []authModuleConfig{
+				{Name: "ldap", Policy: policySufficient},
+				{Name: "local", Policy: policySufficient},
+			},
+		},
+		Lockout: LockoutConfig{
+			Enabled:       true,
+			MaxFailures:   5,
+			IPMaxFailures: 50,
+			Duration:      15,
+			Backoff:       1,
+			MaxBackoff:    30,
+			Window:        15,
+		},
+		MFA: MFAConfig{
+			PendingTimeout: 300,
+		},
+		Store: StoreConfig{
+			Type:      "etcd",
+			Prefix:    "contivSession",
+			Endpoints: []string{"http://127.0.0.1:2379"},
+			Path:      "sessions.db",
+			Address:   "127.0.0.1:6379",
+		},
+		LocalAuthFile: "localauthfile.json",
+		APIConfigFile: "apiconfig.json",
+		AdminRole:     "admin",
+	}
+}
+
+// setting is a configuration value that can be set from the environment or a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// value points into the Config, one of *string, *int, *float64, *bool or *[]string
+	value interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"http.addr", "SESSION_HTTP_ADDR", "HTTP listen address", &c.HTTPAddr},
+		{"admin.addr", "SESSION_ADMIN_ADDR", "admin listen address serving /metrics, empty to disable", &c.AdminAddr},
+		{"log.level", "SESSION_LOG_LEVEL", "least severe log level written: debug, info, warn or error", &c.Log.Level},
+		{"log.format", "SESSION_LOG_FORMAT", "log format: logfmt or json", &c.Log.Format},
+		{"session.name", "SESSION_NAME", "session cookie name", &c.Session.Name},
+		{"session.secret", "SESSION_SECRET", "secret signing the session cookie, at least 32 bytes", &c.Session.Secret},
+		{"session.idle-timeout", "SESSION_IDLE_TIMEOUT", "minutes without activity after which a session ends", &c.Session.IdleTimeout},
+		{"session.max-lifetime", "SESSION_MAX_LIFETIME", "minutes after login after which a session ends, 0 for no limit", &c.Session.MaxLifetime},
+		{"session.renew-interval", "SESSION_RENEW_INTERVAL", "seconds after which session activity is recorded again", &c.Session.RenewInterval},
+		{"session.cookie-secure", "SESSION_COOKIE_SECURE", "send the session cookie over HTTPS only", &c.Session.CookieSecure},
+		{"csrf.header", "SESSION_CSRF_HEADER", "request header carrying the CSRF token", &c.CSRF.Header},
+		{"csrf.exempt-paths", "SESSION_CSRF_EXEMPT_PATHS", "comma separated path prefixes that do not require the CSRF token", &c.CSRF.ExemptPaths},
+		{"auth.require-organization", "SESSION_AUTH_REQUIRE_ORGANIZATION", "refuse logins without an organization", &c.Auth.RequireOrganization},
+		{"lockout.enabled", "SESSION_LOCKOUT_ENABLED", "throttle and lock out failed logins", &c.Lockout.Enabled},
+		{"lockout.max-failures", "SESSION_LOCKOUT_MAX_FAILURES", "failed logins that lock a username", &c.Lockout.MaxFailures},
+		{"lockout.ip-max-failures", "SESSION_LOCKOUT_IP_MAX_FAILURES", "failed logins that lock a client IP", &c.Lockout.IPMaxFailures},
+		{"lockout.duration", "SESSION_LOCKOUT_DURATION", "lockout duration in minutes", &c.Lockout.Duration},
+		{"lockout.backoff", "SESSION_LOCKOUT_BACKOFF", "seconds a client waits after its first failed login, doubled per failure", &c.Lockout.Backoff},
+		{"lockout.max-backoff", "SESSION_LOCKOUT_MAX_BACKOFF", "longest wait between failed logins in seconds", &c.Lockout.MaxBackoff},
+		{"lockout.window", "SESSION_LOCKOUT_WINDOW", "minutes after the last failed login that reset the counters", &c.Lockout.Window},
+		{"mfa.pending-timeout", "SESSION_MFA_PENDING_TIMEOUT", "seconds to enter the second factor after the password", &c.MFA.PendingTimeout},
+		{"audit.file", "SESSION_AUDIT_FILE", "append-only audit log file, empty to disable", &c.Audit.File},
+		{"store.type", "SESSION_STORE_TYPE", "session store backend: etcd, memory, bolt or redis", &c.Store.Type},
+		{"store.prefix", "SESSION_STORE_PREFIX", "key prefix of the session store", &c.Store.Prefix},
+		{"store.endpoints", "SESSION_STORE_ENDPOINTS", "comma separated etcd endpoints", &c.Store.Endpoints},
+		{"store.path", "SESSION_STORE_PATH", "bolt database file", &c.Store.Path},
+		{"store.address", "SESSION_STORE_ADDRESS", "redis address", &c.Store.Address},
+		{"store.password", "SESSION_STORE_PASSWORD", "redis password", &c.Store.Password},
+		{"store.database", "SESSION_STORE_DATABASE", "redis database", &c.Store.Database},
+		{"store.legacy-secret", "SESSION_STORE_LEGACY_SECRET", "secret of the etcd store of earlier versions, whose sessions are taken over", &c.Store.LegacySecret},
+		{"ldap.enabled", "SESSION_LDAP_ENABLED", "enable the ldap authentication module", &c.LDAP.Enabled},
+		{"ldap.type", "SESSION_LDAP_TYPE", "directory type: ldap or ad", &c.LDAP.Type},
+		{"ldap.version", "SESSION_LDAP_VERSION", "ldap protocol version", &c.LDAP.Version},
+		{"ldap.host", "SESSION_LDAP_HOST", "ldap server host", &c.LDAP.Host},
+		{"ldap.port", "SESSION_LDAP_PORT", "ldap server port", &c.LDAP.Port},
+		{"ldap.use-ssl", "SESSION_LDAP_USE_SSL", "connect to the ldap server with TLS", &c.LDAP.UseSSL},
+		{"ldap.start-tls", "SESSION_LDAP_START_TLS", "upgrade the ldap connection with StartTLS", &c.LDAP.StartTLS},
+		{"ldap.insecure-skip-verify", "SESSION_LDAP_INSECURE_SKIP_VERIFY", "do not verify the certificate of the ldap server", &c.LDAP.InsecureSkipVerify},
+		{"ldap.bind-dn", "SESSION_LDAP_BIND_DN", "DN of the ldap service account", &c.LDAP.BindDN},
+		{"ldap.bind-password", "SESSION_LDAP_BIND_PASSWORD", "password of the ldap service account", &c.LDAP.BindPassword},
+		{"ldap.base-dn", "SESSION_LDAP_BASE_DN", "base DN of the ldap user search", &c.LDAP.BaseDN},
+		{"ldap.user-filter", "SESSION_LDAP_USER_FILTER", "ldap user search filter, {username} is replaced with the login name", &c.LDAP.UserFilter},
+		{"ldap.group-attribute", "SESSION_LDAP_GROUP_ATTRIBUTE", "ldap attribute listing the groups of a user", &c.LDAP.GroupAttribute},
+		{"ldap.default-roles", "SESSION_LDAP_DEFAULT_ROLES", "comma separated roles of every ldap user", &c.LDAP.DefaultRoles},
+		{"ldap.pool-size", "SESSION_LDAP_POOL_SIZE", "idle ldap connections kept open", &c.LDAP.PoolSize},
+		{"ldap.timeout", "SESSION_LDAP_TIMEOUT", "ldap connect and request timeout in seconds", &c.LDAP.Timeout},
+		{"oidc.enabled", "SESSION_OIDC_ENABLED", "enable OpenID Connect login", &c.OIDC.Enabled},
+		{"oidc.issuer", "SESSION_OIDC_ISSUER", "OpenID Connect issuer URL", &c.OIDC.Issuer},
+		{"oidc.client-id", "SESSION_OIDC_CLIENT_ID", "OpenID Connect client ID", &c.OIDC.ClientID},
+		{"oidc.client-secret", "SESSION_OIDC_CLIENT_SECRET", "OpenID Connect client secret", &c.OIDC.ClientSecret},
+		{"oidc.redirect-url", "SESSION_OIDC_REDIRECT_URL", "callback URL registered at the provider", &c.OIDC.RedirectURL},
+		{"oidc.scopes", "SESSION_OIDC_SCOPES", "comma separated scopes requested from the provider", &c.OIDC.Scopes},
+		{"oidc.username-claim", "SESSION_OIDC_USERNAME_CLAIM", "ID token claim naming the user", &c.OIDC.UsernameClaim},
+		{"oidc.role-claim", "SESSION_OIDC_ROLE_CLAIM", "ID token claim holding the groups mapped to roles", &c.OIDC.RoleClaim},
+		{"oidc.default-roles", "SESSION_OIDC_DEFAULT_ROLES", "comma separated roles of every OpenID Connect user", &c.OIDC.DefaultRoles},
+		{"oidc.post-login-redirect", "SESSION_OIDC_POST_LOGIN_REDIRECT", "where the browser is sent after login", &c.OIDC.PostLoginRedirect},
+		{"oidc.timeout", "SESSION_OIDC_TIMEOUT", "timeout of the requests to the provider in seconds", &c.OIDC.Timeout},
+		{"local-auth-file", "SESSION_LOCAL_AUTH_FILE", "local authorization file", &c.LocalAuthFile},
+		{"api-config-file", "SESSION_API_CONFIG_FILE", "api configuration file", &c.APIConfigFile},
+		{"admin-role", "SESSION_ADMIN_ROLE", "role required by the administrative endpoints", &c.AdminRole},
+	}
+}
+
+func (s setting) set(v string) error {
+	switch p := s.value.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*p = f
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	}
+	return nil
+}
+
+func (s setting) String() string {
+	switch p := s.value.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *float64:
+		return strconv.FormatFloat(*p, 'f', -1, 64)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *[]string:
+		return strings.Join(*p, ",")
+	}
+	return ""
+}
+
+// settingFlag keeps the raw flag value until the configuration is loaded
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
+
+// ConfigLoader loads the configuration from the file named by the -config flag
+// or SESSION_CONFIG, the environment and the flags it registers
+type ConfigLoader struct {
+	fs   *flag.FlagSet
+	file *string
+}
+
+// NewConfigLoader registers -config and one flag per setting on fs
+func NewConfigLoader(fs *flag.FlagSet) *ConfigLoader {
+	file := "config.json"
+	if v, ok := os.LookupEnv("SESSION_CONFIG"); ok {
+		file = v
+	}
+	l := &ConfigLoader{
+		fs:   fs,
+		file: fs.String("config", file, "configuration file, JSON or YAML"),
+	}
+	defaults := DefaultConfig()
+	for _, s := range defaults.settings() {
+		_, isBool := s.value.(*bool)
+		fs.Var(&settingFlag{value: s.String(), isBool: isBool}, s.flag, s.usage+" (env "+s.env+")")
+	}
+	return l
+}
+
+// Load returns the configuration. It must be called after the flags are parsed.
+// A missing default configuration file is not an error.
+func (l *ConfigLoader) Load() (Config, error) {
+	config := DefaultConfig()
+
+	_, fromEnv := os.LookupEnv("SESSION_CONFIG")
+	required := fromEnv
+	l.fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			required = true
+		}
+	})
+	if err := config.readFile(*l.file); err != nil {
+		if required || !os.IsNotExist(err) {
+			return config, err
+		}
+	}
+
+	settings := config.settings()
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(v); err != nil {
+				return config, fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+	var err error
+	l.fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(f.Value.String()); e != nil {
+					err = fmt.Errorf("-%s: %v", f.Name, e)
+				}
+			}
+		}
+	})
+	return config, err
+}
+
+// readFile merges a JSON or YAML configuration file into the configuration.
+// Unknown keys are rejected so that misspelled settings do not go unnoticed.
+func (c *Config) readFile(filename string) error {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.YAMLToJSON(file)
+	if err != nil {
+		return fmt.Errorf("error in parsing %s: %v", filename, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("error in parsing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting together
+func (c Config) Validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		problems = append(problems, fmt.Sprintf("http_addr: %v", err))
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("admin_addr: %v", err))
+		} else if c.AdminAddr == c.HTTPAddr {
+			problems = append(problems, "admin_addr: must differ from http_addr")
+		}
+	}
+	if contains(logLevels, c.Log.Level) < 0 {
+		problems = append(problems, fmt.Sprintf("log.level: unknown level %q", c.Log.Level))
+	}
+	if contains(logFormats, c.Log.Format) < 0 {
+		problems = append(problems, fmt.Sprintf("log.format: unknown format %q", c.Log.Format))
+	}
+
+	if c.Session.Name == "" || strings.ContainsAny(c.Session.Name, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		problems = append(problems, fmt.Sprintf("session.name: %q is not a valid cookie name", c.Session.Name))
+	}
+	if c.Session.Secret != "" && len(c.Session.Secret) < 32 {
+		problems = append(problems, "session.secret must be at least 32 bytes")
+	}
+	if c.Session.IdleTimeout <= 0 {
+		problems = append(problems, "session.idle_timeout must be positive")
+	}
+	if c.Session.MaxLifetime < 0 {
+		problems = append(problems, "session.max_lifetime must not be negative")
+	}
+	if c.Session.RenewInterval < 0 || float64(c.Session.RenewInterval) >= c.Session.IdleTimeout*60 {
+		problems = append(problems, "session.renew_interval must be between 0 and the idle timeout")
+	}
+
+	if c.CSRF.Header == "" || strings.ContainsAny(c.CSRF.Header, " \t\r\n:") {
+		problems = append(problems, fmt.Sprintf("csrf.header: %q is not a valid header name", c.CSRF.Header))
+	}
+	for _, exempt := range c.CSRF.ExemptPaths {
+		if _, err := compileRoute("prefix", exempt); err != nil {
+			problems = append(problems, fmt.Sprintf("csrf.exempt_paths: %q: %v", exempt, err))
+		}
+	}
+
+	problems = append(problems, validateModules("auth.modules", c.Auth.Modules, c.LDAP.Enabled)...)
+	problems = append(problems, validateOrganizations(c)...)
+
+	if c.Lockout.Enabled {
+		if c.Lockout.MaxFailures <= 0 || c.Lockout.IPMaxFailures <= 0 {
+			problems = append(problems, "lockout.max_failures and lockout.ip_max_failures must be positive")
+		}
+		if c.Lockout.Duration <= 0 || c.Lockout.Window <= 0 {
+			problems = append(problems, "lockout.duration and lockout.window must be positive")
+		}
+		if c.Lockout.Backoff < 0 || c.Lockout.MaxBackoff < c.Lockout.Backoff {
+			problems = append(problems, "lockout.backoff must be between 0 and lockout.max_backoff")
+		}
+	}
+
+	if c.MFA.PendingTimeout <= 0 {
+		problems = append(problems, "mfa.pending_timeout must be positive")
+	}
+
+	switch c.Store.Type {
+	case "etcd":
+		if len(c.Store.Endpoints) == 0 {
+			problems = append(problems, "store.endpoints is required for the etcd store")
+		}
+		for _, endpoint := range c.Store.Endpoints {
+			if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("store.endpoints: bad endpoint %q", endpoint))
+			}
+		}
+	case "memory":
+	case "bolt":
+		if c.Store.Path == "" {
+			problems = append(problems, "store.path is required for the bolt store")
+		}
+	case "redis":
+		if c.Store.Address == "" {
+			problems = append(problems, "store.address is required for the redis store")
+		}
+		if c.Store.Database < 0 {
+			problems = append(problems, "store.database must not be negative")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("store.type: unknown session store type %q", c.Store.Type))
+	}
+	if c.Store.LegacySecret != "" && c.Store.Type != "etcd" {
+		problems = append(problems, "store.legacy_secret is only supported by the etcd store")
+	}
+
+	if c.LDAP.Enabled {
+		if err := c.LDAP.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("ldap: %v", err))
+		}
+	}
+	if c.OIDC.Enabled {
+		if err := c.OIDC.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("oidc: %v", err))
+		}
+		// OpenID Connect logins have no organization
+		if c.Auth.RequireOrganization {
+			problems = append(problems, "oidc: cannot be enabled with auth.require_organization")
+		}
+	}
+	if c.LocalAuthFile == "" {
+		problems = append(problems, "local_auth_file is required")
+	}
+	if c.APIConfigFile == "" {
+		problems = append(problems, "api_config_file is required")
+	}
+	if c.AdminRole == "" {
+		problems = append(problems, "admin_role is required")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with its secrets masked
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.Session.Secret, &c.Store.Password, &c.Store.LegacySecret, &c.LDAP.BindPassword, &c.OIDC.ClientSecret} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	// the organizations are copied, c shares them with the caller
+	c.Organizations = append([]OrganizationConfig(nil), c.Organizations...)
+	for i, o := range c.Organizations {
+		if o.LDAP != nil && o.LDAP.BindPassword != "" {
+			ldap := *o.LDAP
+			ldap.BindPassword = redacted
+			c.Organizations[i].LDAP = &ldap
+		}
+	}
+	return c
+}
@@ -0,0 +1,70 @@
+package session
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestSettingsCoverScalars checks that every scalar and string list of the
+// configuration can be overridden, as the README promises
+func TestSettingsCoverScalars(t *testing.T) {
+	var config Config
+	covered := make(map[interface{}]bool)
+	for _, s := range config.settings() {
+		covered[s.value] = true
+	}
+	var walk func(v reflect.Value, name string)
+	walk = func(v reflect.Value, name string) {
+		for i := 0; i < v.NumField(); i++ {
+			field, value := v.Type().Field(i), v.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			switch value.Kind() {
+			case reflect.Struct:
+				walk(value, name+field.Name+".")
+			case reflect.String, reflect.Int, reflect.Float64, reflect.Bool:
+			case reflect.Slice:
+				if value.Type().Elem().Kind() != reflect.String {
+					continue
+				}
+			default:
+				continue
+			}
+			if value.Kind() != reflect.Struct && !covered[value.Addr().Interface()] {
+				t.Errorf("%s%s has no environment variable or flag", name, field.Name)
+			}
+		}
+	}
+	walk(reflect.ValueOf(&config).Elem(), "")
+}
+
+func TestConfigLoaderOverrides(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"ldap": {"type": "ldap", "start_tls": false}, "lockout": {"window": 15}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SESSION_CONFIG", file)
+	t.Setenv("SESSION_LDAP_START_TLS", "true")
+	t.Setenv("SESSION_LDAP_USER_FILTER", "(cn={username})")
+	t.Setenv("SESSION_LOCKOUT_WINDOW", "5")
+	fs := flag.NewFlagSet("session", flag.ContinueOnError)
+	loader := NewConfigLoader(fs)
+	if err := fs.Parse([]string{"-lockout.window=7.5", "-ldap.type=ad"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.LDAP.StartTLS || config.LDAP.UserFilter != "(cn={username})" {
+		t.Errorf("ldap = %+v, want the environment applied", config.LDAP)
+	}
+	// flags win over the environment
+	if config.LDAP.Type != "ad" || config.Lockout.Window != 7.5 {
+		t.Errorf("ldap.type = %q, lockout.window = %v, want the flags applied", config.LDAP.Type, config.Lockout.Window)
+	}
+}
@@ -2,36 +2,72 @@ package session
 
 import (
 	"fmt"
+	"net/http"
 	"io/ioutil"
 	"encoding/json"
+
+	"github.com/go-kit/kit/log"
 )
 
 type apiConfig struct {
 	routelist	[]routedetail
+	upstreams	*upstreamRegistry
 }
 
 type routedetail struct {
 	Api string		`json:"api"`
+	// Match is one of "prefix" (default), "exact", "glob" or "template"
+	Match string		`json:"match"`
 	Methods []string	`json:"methods"`
 	Destination string	`json:"destination"`
+	// Destinations replaces Destination when the route is served by several nodes
+	Destinations []string	`json:"destinations"`
+	Balancer balancerconfig	`json:"balancer"`
 	Authorization bool	`json:"authorization"`
+	// Roles lists the roles allowed per method, "*" applies to any other method
+	Roles map[string][]string	`json:"roles"`
+	Forwarding forwardpolicy	`json:"forwarding"`
+	Rewrite rewriterule	`json:"rewrite"`
+	Timeouts timeoutconfig	`json:"timeouts"`
+	Retry retryconfig	`json:"retry"`
+	CircuitBreaker breakerconfig	`json:"circuit_breaker"`
+	// TenantScope tells how tenant sessions are restricted, see tenant.go.
+	// TenantField names the tenant in JSON objects, "tenantName" by default.
+	TenantScope string	`json:"tenant_scope"`
+	TenantField string	`json:"tenant_field"`
+	matcher *routematcher
+	balancer *balancer
+	transport http.RoundTripper
 }
 
-func GetApiConfig() *apiConfig {
-	return &apiConfig{
-		routelist: getapidetails(Apiconfigfile),
+// GetApiConfig loads the routes and rejects invalid or ambiguous definitions
+func GetApiConfig(configfile string, logger log.Logger) (*apiConfig, error) {
+	routes, err := getapidetails(configfile)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := newUpstreamRegistry()
+	routes, err = compileRoutes(routes, upstreams)
+	if err != nil {
+		return nil, err
 	}
+	return &apiConfig{
+		routelist: routes,
+		upstreams: upstreams,
+	}, nil
 }
 
 
-func getapidetails(configfile string) []routedetail {
+func getapidetails(configfile string) ([]routedetail, error) {
 	file, e := ioutil.ReadFile(configfile)
 	if e != nil {
-		fmt.Println("Error in reading file")
-		return []routedetail{}
+		// a service proxying nothing is a broken deployment, not a default
+		return nil, fmt.Errorf("api config file: %v", e)
 	}
 
 	var jsondata []routedetail
-	json.Unmarshal(file, &jsondata)
-	return jsondata
-}
\ No newline at end of file
+	if e := json.Unmarshal(file, &jsondata); e != nil {
+		return nil, fmt.Errorf("error in parsing %s: %v", configfile, e)
+	}
+	return jsondata, nil
+}
@@ -11,11 +11,21 @@ var (
 	ErrNotFound = errors.New("not found")
 )
 
-var (
-	//Local authorization file location
-	LocalAuthFileLoc = "localauthfile.json"
-	//api configuration file
-	Apiconfigfile = "apiconfig.json"
-	// Session timeout
-	SessionTimeOut = 0.4
-)
+// apiError is a business-logic error reported to the client as a JSON body
+// with its own HTTP status code
+type apiError struct {
+	status  int
+	Code    string   `json:"error"`
+	Message string   `json:"message"`
+	Route   string   `json:"route,omitempty"`
+	Method  string   `json:"method,omitempty"`
+	Roles   []string `json:"required_roles,omitempty"`
+	// RetryAfter is also sent as Retry-After header, in seconds
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Allow lists the methods of the route, also sent as Allow header
+	Allow []string `json:"allowed_methods,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// CSRFConfig configures the synchronizer token required on unsafe proxied
+// and admin requests. The token is bound to the session and returned by login and
+// validateapp, the client sends it back in Header.
+type CSRFConfig struct {
+	Header string `json:"header"`
+	// ExemptPaths are path prefixes that do not require the token
+	ExemptPaths []string `json:"exempt_paths"`
+}
+
+// safeMethods do not change state and are sent without a token
+var safeMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE"}
+
+// csrfToken returns the token of the session, creating it when the session
+// has none yet. It reports whether the session changed.
+func csrfToken(session *sessions.Session) (string, bool) {
+	if token, ok := session.Values["CSRFToken"].(string); ok && token != "" {
+		return token, false
+	}
+	token := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	session.Values["CSRFToken"] = token
+	return token, true
+}
+
+// checkCSRF requires the session's token on requests with an unsafe method
+func (s *sessionService) checkCSRF(session *sessions.Session, r *http.Request) error {
+	if contains(safeMethods, r.Method) >= 0 {
+		return nil
+	}
+	for _, exempt := range s.csrfExempt {
+		if exempt.match(r.URL.Path) {
+			return nil
+		}
+	}
+	token, _ := session.Values["CSRFToken"].(string)
+	sent := r.Header.Get(s.config.CSRF.Header)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sent)) != 1 {
+		return &apiError{
+			status:  http.StatusForbidden,
+			Code:    "csrf_token_invalid",
+			Message: "missing or invalid " + s.config.CSRF.Header + " header",
+			Method:  r.Method,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	exempt, err := compileRoute("prefix", "/api/v1/hooks/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sessionService{config: Config{CSRF: CSRFConfig{Header: "X-Custom-Csrf"}}, csrfExempt: []*routematcher{exempt}}
+	session := sessions.NewSession(nil, "contiv-session")
+	token, created := csrfToken(session)
+	if !created || token == "" {
+		t.Fatalf("csrfToken = %q, %v", token, created)
+	}
+	if again, created := csrfToken(session); again != token || created {
+		t.Fatalf("second csrfToken = %q, %v, want the same token", again, created)
+	}
+
+	tests := []struct {
+		name, method, path string
+		header             http.Header
+		ok                 bool
+	}{
+		{"safe method", "GET", "/api/v1/networks/", nil, true},
+		{"missing token", "POST", "/api/v1/networks/", nil, false},
+		{"wrong token", "POST", "/api/v1/networks/", http.Header{"X-Custom-Csrf": {"forged"}}, false},
+		{"valid token", "DELETE", "/api/v1/networks/n1/", http.Header{"X-Custom-Csrf": {token}}, true},
+		{"token in the default header", "PUT", "/api/v1/networks/n1/", http.Header{"X-Csrf-Token": {token}}, false},
+		{"exempt path", "POST", "/api/v1/hooks/build", nil, true},
+		{"admin endpoint", "DELETE", "/admin/sessions/s1", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for key, values := range tt.header {
+			r.Header[key] = values
+		}
+		err := s.checkCSRF(session, r)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if apierr, ok := err.(*apiError); !ok || apierr.status != http.StatusForbidden || apierr.Code != "csrf_token_invalid" || apierr.Method != tt.method {
+			t.Errorf("%s: error %#v, want csrf_token_invalid", tt.name, err)
+		}
+	}
+
+	// a session without a token accepts none, not even an empty one
+	r := httptest.NewRequest("POST", "/api/v1/networks/", nil)
+	r.Header.Set("X-Custom-Csrf", "")
+	if err := s.checkCSRF(sessions.NewSession(nil, "contiv-session"), r); err == nil {
+		t.Error("a session without a token accepted an empty one")
+	}
+}
+
+func TestHTTPAdminCSRF(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.CSRF.Header = "X-Admin-Token" })
+	admin, operator := ts.client(t), ts.client(t)
+	token := ts.login(t, admin, "admin", "admin-pw").CSRFToken
+	ts.login(t, operator, "operator", "operator-pw")
+
+	for _, header := range []http.Header{nil, {"X-Admin-Token": {"forged"}}, {"X-Csrf-Token": {token}}} {
+		var apierr apiError
+		resp := ts.do(t, admin, "DELETE", "/admin/users/operator/sessions/", "", header, &apierr)
+		if resp.StatusCode != http.StatusForbidden || apierr.Code != "csrf_token_invalid" {
+			t.Fatalf("revoke with %v = %d %+v", header, resp.StatusCode, apierr)
+		}
+	}
+	if !ts.validate(t, operator).Authenticated {
+		t.Fatal("a request without the CSRF token revoked the sessions")
+	}
+
+	// reads need no token
+	if resp := ts.do(t, admin, "GET", "/admin/sessions/", "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("list = %d", resp.StatusCode)
+	}
+	var revoked revokeResponse
+	resp := ts.do(t, admin, "DELETE", "/admin/users/operator/sessions/", "", http.Header{"X-Admin-Token": {token}}, &revoked)
+	if resp.StatusCode != http.StatusOK || revoked.Revoked != 1 {
+		t.Fatalf("revoke with the token = %d %+v", resp.StatusCode, revoked)
+	}
+	if resp := ts.do(t, admin, "DELETE", "/admin/lockouts/users/operator", "", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unlock without the token = %d", resp.StatusCode)
+	}
+}
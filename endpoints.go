@@ -9,18 +9,36 @@ import (
 // Endpoints exposed by the service
 type Endpoints struct {
 	loginEndpoint endpoint.Endpoint
+	mfaEndpoint endpoint.Endpoint
+	oidcLoginEndpoint endpoint.Endpoint
+	oidcCallbackEndpoint endpoint.Endpoint
 	logoutEndpoint endpoint.Endpoint
 	validateappEndpoint endpoint.Endpoint
 	apiEndpoint endpoint.Endpoint
+	upstreamsEndpoint endpoint.Endpoint
+	authModulesEndpoint endpoint.Endpoint
+	listSessionsEndpoint endpoint.Endpoint
+	revokeSessionEndpoint endpoint.Endpoint
+	revokeUserSessionsEndpoint endpoint.Endpoint
+	unlockEndpoint endpoint.Endpoint
 }
 
 // MakeServerEndpoints function prepares the server Endpoints
 func MakeServerEndpoints(s Service) Endpoints {
 	return Endpoints{
 		loginEndpoint: MakeLoginEnpoint(s),
+		mfaEndpoint: MakeMFAEndpoint(s),
+		oidcLoginEndpoint: MakeOIDCLoginEndpoint(s),
+		oidcCallbackEndpoint: MakeOIDCCallbackEndpoint(s),
 		logoutEndpoint: MakeLogoutEndpoint(s),
 		validateappEndpoint: MakeValidateappEndpoint(s),
 		apiEndpoint: MakeApiEndpoint(s),
+		upstreamsEndpoint: MakeUpstreamsEndpoint(s),
+		authModulesEndpoint: MakeAuthModulesEndpoint(s),
+		listSessionsEndpoint: MakeListSessionsEndpoint(s),
+		revokeSessionEndpoint: MakeRevokeSessionEndpoint(s),
+		revokeUserSessionsEndpoint: MakeRevokeUserSessionsEndpoint(s),
+		unlockEndpoint: MakeUnlockEndpoint(s),
 	}
 }
 
@@ -33,6 +51,30 @@ func MakeLoginEnpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+func MakeMFAEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(MFARequest)
+		result, err := s.verifymfa(ctx, req)
+		return result, err
+	}
+}
+
+func MakeOIDCLoginEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(oidcRequest)
+		result, err := s.oidclogin(ctx, req)
+		return result, err
+	}
+}
+
+func MakeOIDCCallbackEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(oidcRequest)
+		result, err := s.oidccallback(ctx, req)
+		return result, err
+	}
+}
+
 func MakeLogoutEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(LogoutRequest)
@@ -56,3 +98,51 @@ func MakeApiEndpoint(s Service) endpoint.Endpoint {
 		return result, err
 	}
 }
+
+func MakeUpstreamsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.upstreamstatus(ctx, req)
+		return result, err
+	}
+}
+
+func MakeAuthModulesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.authmodulestatus(ctx, req)
+		return result, err
+	}
+}
+
+func MakeListSessionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.listsessions(ctx, req)
+		return result, err
+	}
+}
+
+func MakeRevokeSessionEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.revokesession(ctx, req)
+		return result, err
+	}
+}
+
+func MakeRevokeUserSessionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.revokeusersessions(ctx, req)
+		return result, err
+	}
+}
+
+func MakeUnlockEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(adminRequest)
+		result, err := s.unlock(ctx, req)
+		return result, err
+	}
+}
@@ -0,0 +1,277 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/shampur/etcdstore"
+)
+
+// etcdBackend stores sessions in etcd through the JSON gateway of the v3 API,
+// which etcd serves by default. Keys are named "<prefix>/<key>" and expire
+// with a lease of their TTL. The lease a key was written with is revoked when
+// the key is written again or deleted, and when a conditional write fails.
+type etcdBackend struct {
+	endpoints []string
+	prefix    string
+	client    *http.Client
+}
+
+// etcdKeyValue is a key of a range response, keys and values are base64
+// encoded by encoding/json
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutResponse struct {
+	PrevKv *etcdKeyValue `json:"prev_kv"`
+}
+
+type etcdDeleteResponse struct {
+	PrevKvs []etcdKeyValue `json:"prev_kvs"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+	Responses []struct {
+		ResponsePut etcdPutResponse `json:"response_put"`
+	} `json:"responses"`
+}
+
+type etcdLeaseResponse struct {
+	ID string `json:"ID"`
+}
+
+// etcdCompare is a condition of a transaction
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+type etcdPut struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value"`
+	Lease  string `json:"lease,omitempty"`
+	PrevKv bool   `json:"prev_kv,omitempty"`
+}
+
+type etcdRequestOp struct {
+	RequestPut *etcdPut `json:"request_put,omitempty"`
+}
+
+type etcdError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func newEtcdBackend(endpoints []string, prefix string) (*etcdBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("etcd session store requires at least one endpoint")
+	}
+	return &etcdBackend{
+		endpoints: endpoints,
+		prefix:    prefix + "/",
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (b *etcdBackend) get(key string) ([]byte, error) {
+	var resp etcdRangeResponse
+	if err := b.call("kv/range", map[string]interface{}{"key": []byte(b.prefix + key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (b *etcdBackend) set(key string, value []byte, ttl time.Duration) error {
+	put, err := b.put(key, value, ttl)
+	if err != nil {
+		return err
+	}
+	var resp etcdPutResponse
+	if err := b.call("kv/put", put, &resp); err != nil {
+		b.revoke(put.Lease)
+		return err
+	}
+	b.replaced(resp.PrevKv, put.Lease)
+	return nil
+}
+
+// create writes the key in a transaction that only succeeds while it does
+// not exist
+func (b *etcdBackend) create(key string, value []byte, ttl time.Duration) (bool, error) {
+	put, err := b.put(key, value, ttl)
+	if err != nil {
+		return false, err
+	}
+	missing := etcdCompare{Key: put.Key, Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}
+	return b.txn(missing, put)
+}
+
+// replace writes the key in a transaction that only succeeds while it holds
+// the old value
+func (b *etcdBackend) replace(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	put, err := b.put(key, value, ttl)
+	if err != nil {
+		return false, err
+	}
+	unchanged := etcdCompare{Key: put.Key, Target: "VALUE", Result: "EQUAL", Value: old}
+	return b.txn(unchanged, put)
+}
+
+func (b *etcdBackend) txn(compare etcdCompare, put *etcdPut) (bool, error) {
+	var resp etcdTxnResponse
+	err := b.call("kv/txn", map[string]interface{}{
+		"compare": []etcdCompare{compare},
+		"success": []etcdRequestOp{{RequestPut: put}},
+	}, &resp)
+	if err != nil || !resp.Succeeded {
+		b.revoke(put.Lease)
+		return false, err
+	}
+	if len(resp.Responses) > 0 {
+		b.replaced(resp.Responses[0].ResponsePut.PrevKv, put.Lease)
+	}
+	return true, nil
+}
+
+// put builds the put request of the key, with a lease for its TTL
+func (b *etcdBackend) put(key string, value []byte, ttl time.Duration) (*etcdPut, error) {
+	put := &etcdPut{Key: []byte(b.prefix + key), Value: value, PrevKv: true}
+	if ttl > 0 {
+		var lease etcdLeaseResponse
+		seconds := int64((ttl + time.Second - 1) / time.Second)
+		if err := b.call("lease/grant", map[string]interface{}{"TTL": seconds}, &lease); err != nil {
+			return nil, err
+		}
+		put.Lease = lease.ID
+	}
+	return put, nil
+}
+
+// replaced revokes the lease of the value a put overwrote
+func (b *etcdBackend) replaced(prev *etcdKeyValue, lease string) {
+	if prev != nil && prev.Lease != lease {
+		b.revoke(prev.Lease)
+	}
+}
+
+// revoke releases a lease that no key uses any more. A lease that can not be
+// revoked still ends with its TTL, so the error is not reported.
+func (b *etcdBackend) revoke(lease string) {
+	if lease == "" || lease == "0" {
+		return
+	}
+	b.call("lease/revoke", map[string]interface{}{"ID": lease}, nil)
+}
+
+func (b *etcdBackend) list(prefix string) (map[string][]byte, error) {
+	start := []byte(b.prefix + prefix)
+	var resp etcdRangeResponse
+	if err := b.call("kv/range", map[string]interface{}{"key": start, "range_end": etcdRangeEnd(start)}, &resp); err != nil {
+		return nil, err
+	}
+	result := make(map[string][]byte)
+	for _, kv := range resp.Kvs {
+		result[string(kv.Key[len(b.prefix):])] = kv.Value
+	}
+	return result, nil
+}
+
+// etcdRangeEnd returns the end of the range of keys starting with prefix
+func etcdRangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every key is greater than a prefix of 0xff bytes
+	return []byte{0}
+}
+
+func (b *etcdBackend) delete(key string) error {
+	var resp etcdDeleteResponse
+	if err := b.call("kv/deleterange", map[string]interface{}{"key": []byte(b.prefix + key), "prev_kv": true}, &resp); err != nil {
+		return err
+	}
+	for _, kv := range resp.PrevKvs {
+		b.revoke(kv.Lease)
+	}
+	return nil
+}
+
+// call posts the request to each endpoint in turn until one of them answers
+// and decodes the response into result
+func (b *etcdBackend) call(method string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range b.endpoints {
+		resp, err := b.client.Post(strings.TrimRight(endpoint, "/")+"/v3/"+method, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return etcdDecode(method, resp, result)
+	}
+	return lastErr
+}
+
+func etcdDecode(method string, resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure etcdError
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Message == "" {
+			failure.Message = failure.Error
+		}
+		return fmt.Errorf("etcd %s: %s %s", method, resp.Status, failure.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// legacyEtcdStore reads the sessions written by the etcd store of earlier
+// versions, so that users stay logged in across the upgrade. It is nil unless
+// store.legacy_secret is set.
+func legacyEtcdStore(config StoreConfig) sessions.Store {
+	if config.Type != "etcd" || config.LegacySecret == "" {
+		return nil
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "contivSession"
+	}
+	return etcdstore.NewEtcdStore(config.Endpoints, prefix, []byte(config.LegacySecret))
+}
+
+// discardResponse is the response of the requests deleting legacy sessions
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
@@ -0,0 +1,269 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd serves the part of the etcd v3 JSON gateway the etcd backend uses
+type fakeEtcd struct {
+	server *httptest.Server
+
+	mtx       sync.Mutex
+	revision  int64
+	keys      map[string]fakeEtcdKey
+	leases    map[string]time.Time
+	nextLease int64
+}
+
+type fakeEtcdKey struct {
+	value          []byte
+	lease          string
+	createRevision int64
+}
+
+func newFakeEtcd(t testing.TB) *fakeEtcd {
+	e := &fakeEtcd{keys: make(map[string]fakeEtcdKey), leases: make(map[string]time.Time)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", e.handle(e.rangeKeys))
+	mux.HandleFunc("/v3/kv/put", e.handle(e.put))
+	mux.HandleFunc("/v3/kv/deleterange", e.handle(e.deleteRange))
+	mux.HandleFunc("/v3/kv/txn", e.handle(e.txn))
+	mux.HandleFunc("/v3/lease/grant", e.handle(e.grant))
+	mux.HandleFunc("/v3/lease/revoke", e.handle(e.revoke))
+	e.server = httptest.NewServer(mux)
+	t.Cleanup(e.server.Close)
+	return e
+}
+
+type fakeEtcdRequest struct {
+	Key      []byte          `json:"key"`
+	RangeEnd []byte          `json:"range_end"`
+	Value    []byte          `json:"value"`
+	Lease    string          `json:"lease"`
+	PrevKv   bool            `json:"prev_kv"`
+	ID       string          `json:"ID"`
+	TTL      int64           `json:"TTL"`
+	Compare  []etcdCompare   `json:"compare"`
+	Success  []etcdRequestOp `json:"success"`
+}
+
+func (e *fakeEtcd) handle(op func(fakeEtcdRequest) (interface{}, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req fakeEtcdRequest
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, `{"error": "bad request", "code": 3}`, http.StatusBadRequest)
+			return
+		}
+		e.mtx.Lock()
+		e.expire()
+		resp, status := op(req)
+		e.mtx.Unlock()
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// expire drops the keys of expired leases, the caller holds the lock
+func (e *fakeEtcd) expire() {
+	now := time.Now()
+	for id, expires := range e.leases {
+		if now.After(expires) {
+			delete(e.leases, id)
+		}
+	}
+	for key, kv := range e.keys {
+		if _, ok := e.leases[kv.lease]; kv.lease != "" && !ok {
+			delete(e.keys, key)
+		}
+	}
+}
+
+func (e *fakeEtcd) rangeKeys(req fakeEtcdRequest) (interface{}, int) {
+	var names []string
+	for key := range e.keys {
+		if key == string(req.Key) || len(req.RangeEnd) > 0 && key >= string(req.Key) && key < string(req.RangeEnd) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	kvs := []etcdKeyValue{}
+	for _, key := range names {
+		kvs = append(kvs, etcdKeyValue{Key: []byte(key), Value: e.keys[key].value})
+	}
+	return map[string]interface{}{"kvs": kvs, "count": strconv.Itoa(len(kvs))}, http.StatusOK
+}
+
+func (e *fakeEtcd) put(req fakeEtcdRequest) (interface{}, int) {
+	if _, ok := e.leases[req.Lease]; req.Lease != "" && !ok {
+		return map[string]interface{}{"error": "etcdserver: requested lease not found", "code": 5}, http.StatusNotFound
+	}
+	e.revision++
+	kv := fakeEtcdKey{value: req.Value, lease: req.Lease, createRevision: e.revision}
+	if old, ok := e.keys[string(req.Key)]; ok {
+		kv.createRevision = old.createRevision
+	}
+	old, existed := e.keys[string(req.Key)]
+	e.keys[string(req.Key)] = kv
+	if req.PrevKv && existed {
+		return map[string]interface{}{"prev_kv": e.keyValue(string(req.Key), old)}, http.StatusOK
+	}
+	return map[string]interface{}{}, http.StatusOK
+}
+
+func (e *fakeEtcd) keyValue(key string, kv fakeEtcdKey) etcdKeyValue {
+	return etcdKeyValue{Key: []byte(key), Value: kv.value, Lease: kv.lease}
+}
+
+func (e *fakeEtcd) deleteRange(req fakeEtcdRequest) (interface{}, int) {
+	old, existed := e.keys[string(req.Key)]
+	delete(e.keys, string(req.Key))
+	if req.PrevKv && existed {
+		return map[string]interface{}{"prev_kvs": []etcdKeyValue{e.keyValue(string(req.Key), old)}}, http.StatusOK
+	}
+	return map[string]interface{}{}, http.StatusOK
+}
+
+func (e *fakeEtcd) txn(req fakeEtcdRequest) (interface{}, int) {
+	for _, c := range req.Compare {
+		kv, exists := e.keys[string(c.Key)]
+		var ok bool
+		switch c.Target {
+		case "CREATE":
+			revision, _ := strconv.ParseInt(c.CreateRevision, 10, 64)
+			switch c.Result {
+			case "EQUAL":
+				ok = kv.createRevision == revision
+			case "GREATER":
+				ok = kv.createRevision > revision
+			}
+		case "VALUE":
+			ok = exists && c.Result == "EQUAL" && bytes.Equal(kv.value, c.Value)
+		}
+		if !ok {
+			// the gateway leaves out false fields
+			return map[string]interface{}{}, http.StatusOK
+		}
+	}
+	var responses []interface{}
+	for _, op := range req.Success {
+		if op.RequestPut != nil {
+			put := fakeEtcdRequest{Key: op.RequestPut.Key, Value: op.RequestPut.Value, Lease: op.RequestPut.Lease, PrevKv: op.RequestPut.PrevKv}
+			resp, status := e.put(put)
+			if status != http.StatusOK {
+				return resp, status
+			}
+			responses = append(responses, map[string]interface{}{"response_put": resp})
+		}
+	}
+	return map[string]interface{}{"succeeded": true, "responses": responses}, http.StatusOK
+}
+
+func (e *fakeEtcd) grant(req fakeEtcdRequest) (interface{}, int) {
+	e.nextLease++
+	id := strconv.FormatInt(7587850000+e.nextLease, 10)
+	e.leases[id] = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	return map[string]interface{}{"ID": id, "TTL": strconv.FormatInt(req.TTL, 10)}, http.StatusOK
+}
+
+// revoke ends the lease and deletes its keys
+func (e *fakeEtcd) revoke(req fakeEtcdRequest) (interface{}, int) {
+	if _, ok := e.leases[req.ID]; !ok {
+		return map[string]interface{}{"error": "etcdserver: requested lease not found", "code": 5}, http.StatusNotFound
+	}
+	delete(e.leases, req.ID)
+	for key, kv := range e.keys {
+		if kv.lease == req.ID {
+			delete(e.keys, key)
+		}
+	}
+	return map[string]interface{}{}, http.StatusOK
+}
+
+func (e *fakeEtcd) leaseCount() int {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return len(e.leases)
+}
+
+func TestEtcdLeases(t *testing.T) {
+	etcd := newFakeEtcd(t)
+	backend, err := newEtcdBackend([]string{etcd.server.URL}, "contivSession")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		op   func() error
+	}{
+		{"set", func() error { return backend.set("key", []byte("v1"), time.Hour) }},
+		{"overwrite", func() error { return backend.set("key", []byte("v2"), time.Hour) }},
+		{"replace", func() error {
+			_, err := backend.replace("key", []byte("v2"), []byte("v3"), time.Hour)
+			return err
+		}},
+		{"failed replace", func() error {
+			_, err := backend.replace("key", []byte("stale"), []byte("v4"), time.Hour)
+			return err
+		}},
+		{"failed create", func() error {
+			_, err := backend.create("key", []byte("v5"), time.Hour)
+			return err
+		}},
+	}
+	for _, step := range steps {
+		if err := step.op(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if leases := etcd.leaseCount(); leases != 1 {
+			t.Fatalf("%d leases after %s, want the one of the key", leases, step.name)
+		}
+	}
+	if value, err := backend.get("key"); string(value) != "v3" || err != nil {
+		t.Fatalf("get = %q, %v", value, err)
+	}
+	if err := backend.delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if leases := etcd.leaseCount(); leases != 0 {
+		t.Fatalf("%d leases after delete", leases)
+	}
+}
+
+func TestEtcdRangeEnd(t *testing.T) {
+	tests := []struct {
+		prefix, end string
+	}{
+		{"contivSession/users/", "contivSession/users0"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	}
+	for _, tt := range tests {
+		if end := string(etcdRangeEnd([]byte(tt.prefix))); end != tt.end {
+			t.Errorf("etcdRangeEnd(%q) = %q, want %q", tt.prefix, end, tt.end)
+		}
+	}
+}
+
+func TestEtcdEndpointFailover(t *testing.T) {
+	etcd := newFakeEtcd(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	backend, err := newEtcdBackend([]string{down.URL, etcd.server.URL + "/"}, "contivSession")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.set("key", []byte("value"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if value, err := backend.get("key"); err != nil || string(value) != "value" {
+		t.Fatalf("get = %q, %v", value, err)
+	}
+}
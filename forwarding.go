@@ -0,0 +1,131 @@
+package session
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// forwardpolicy controls what part of the client request reaches the destination
+type forwardpolicy struct {
+	// Headers lists request headers passed upstream in addition to Accept and
+	// Content-Type, "*" passes every header except Cookie and hop-by-hop headers.
+	// A listed Cookie header is passed without the session cookie.
+	Headers []string `json:"headers"`
+	// Query is "preserve" (default), "drop" or "allow"
+	Query string `json:"query"`
+	// QueryParams lists the parameters kept when Query is "allow"
+	QueryParams []string `json:"query_params"`
+	// ContentTypes lists the media types accepted for request bodies, such as
+	// "multipart/form-data" or "text/*". Only JSON is accepted when empty.
+	ContentTypes []string `json:"content_types"`
+}
+
+var defaultContentTypes = []string{"application/json"}
+
+// upstreamQuery returns the query string sent to the destination
+func (p forwardpolicy) upstreamQuery(in *url.URL) string {
+	switch p.Query {
+	case "drop":
+		return ""
+	case "allow":
+		values := in.Query()
+		for name := range values {
+			if contains(p.QueryParams, name) < 0 {
+				values.Del(name)
+			}
+		}
+		return values.Encode()
+	}
+	return in.RawQuery
+}
+
+// copyHeaders copies the request headers allowed by the policy
+func (p forwardpolicy) copyHeaders(dst, src http.Header, sessionCookie string) {
+	for _, h := range forwardedHeaders {
+		if v, ok := src[h]; ok {
+			dst[h] = v
+		}
+	}
+	if contains(p.Headers, "*") >= 0 {
+		for k, v := range src {
+			if k != "Cookie" && contains(hopHeaders, k) < 0 {
+				dst[k] = v
+			}
+		}
+		return
+	}
+	for _, h := range p.Headers {
+		h = http.CanonicalHeaderKey(h)
+		v, ok := src[h]
+		if !ok || contains(hopHeaders, h) >= 0 {
+			continue
+		}
+		if h == "Cookie" {
+			if v = withoutCookie(v, sessionCookie); len(v) == 0 {
+				continue
+			}
+		}
+		dst[h] = v
+	}
+}
+
+// withoutCookie removes the named cookie from Cookie header values
+func withoutCookie(values []string, name string) []string {
+	var kept []string
+	for _, value := range values {
+		var pairs []string
+		for _, pair := range strings.Split(value, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" || strings.SplitN(pair, "=", 2)[0] == name {
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+		if len(pairs) > 0 {
+			kept = append(kept, strings.Join(pairs, "; "))
+		}
+	}
+	return kept
+}
+
+// checkContentType rejects request bodies whose media type the route does not accept
+func (p forwardpolicy) checkContentType(route string, in *http.Request) error {
+	if in.ContentLength == 0 || in.Body == nil {
+		return nil
+	}
+	allowed := p.ContentTypes
+	if len(allowed) == 0 {
+		allowed = defaultContentTypes
+	}
+	mediatype, _, err := mime.ParseMediaType(in.Header.Get("Content-Type"))
+	if err != nil && contains(allowed, "*/*") >= 0 {
+		return nil
+	}
+	if err == nil {
+		for _, pattern := range allowed {
+			if mediaTypeMatches(pattern, mediatype) {
+				return nil
+			}
+		}
+	}
+	return &apiError{
+		status:  http.StatusUnsupportedMediaType,
+		Code:    "unsupported_media_type",
+		Message: "content type " + in.Header.Get("Content-Type") + " is not accepted by " + route,
+		Route:   route,
+		Method:  in.Method,
+	}
+}
+
+func mediaTypeMatches(pattern, mediatype string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" || pattern == mediatype {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediatype, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamQuery(t *testing.T) {
+	in, _ := url.Parse("/api/v1/networks/?tenant=t1&debug=1&tenant=t2")
+	tests := []struct {
+		policy forwardpolicy
+		query  string
+	}{
+		{forwardpolicy{}, "tenant=t1&debug=1&tenant=t2"},
+		{forwardpolicy{Query: "preserve"}, "tenant=t1&debug=1&tenant=t2"},
+		{forwardpolicy{Query: "drop"}, ""},
+		{forwardpolicy{Query: "allow", QueryParams: []string{"tenant"}}, "tenant=t1&tenant=t2"},
+		{forwardpolicy{Query: "allow"}, ""},
+	}
+	for _, tt := range tests {
+		if query := tt.policy.upstreamQuery(in); query != tt.query {
+			t.Errorf("%+v: query %q, want %q", tt.policy, query, tt.query)
+		}
+	}
+}
+
+func TestCopyHeaders(t *testing.T) {
+	src := http.Header{
+		"Accept":        {"application/json"},
+		"Content-Type":  {"application/json"},
+		"X-Request-Id":  {"req-1"},
+		"X-Trace":       {"abc"},
+		"Authorization": {"Bearer t"},
+		"Connection":    {"keep-alive"},
+		"Cookie":        {"contiv-session=secret; theme=dark", "contiv-session=other"},
+	}
+	tests := []struct {
+		name    string
+		headers []string
+		want    http.Header
+	}{
+		{"default", nil, http.Header{"Accept": {"application/json"}, "Content-Type": {"application/json"}}},
+		{"listed", []string{"x-request-id", "connection"}, http.Header{
+			"Accept": {"application/json"}, "Content-Type": {"application/json"}, "X-Request-Id": {"req-1"}}},
+		{"all", []string{"*"}, http.Header{
+			"Accept": {"application/json"}, "Content-Type": {"application/json"}, "X-Request-Id": {"req-1"},
+			"X-Trace": {"abc"}, "Authorization": {"Bearer t"}}},
+		{"listed cookie", []string{"Cookie"}, http.Header{
+			"Accept": {"application/json"}, "Content-Type": {"application/json"}, "Cookie": {"theme=dark"}}},
+	}
+	for _, tt := range tests {
+		dst := http.Header{}
+		forwardpolicy{Headers: tt.headers}.copyHeaders(dst, src, "contiv-session")
+		if !reflect.DeepEqual(dst, tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.name, dst, tt.want)
+		}
+	}
+
+	// no Cookie header is sent when the session cookie was the only one
+	dst := http.Header{}
+	forwardpolicy{Headers: []string{"Cookie"}}.copyHeaders(dst, http.Header{"Cookie": {"contiv-session=secret"}}, "contiv-session")
+	if _, ok := dst["Cookie"]; ok {
+		t.Errorf("Cookie %q was forwarded", dst["Cookie"])
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		accepted    []string
+		contentType string
+		body        string
+		ok          bool
+	}{
+		{"json by default", nil, "application/json; charset=utf-8", "{}", true},
+		{"text by default", nil, "text/plain", "x", false},
+		{"no body", nil, "text/plain", "", true},
+		{"listed type", []string{"multipart/form-data"}, "multipart/form-data; boundary=x", "x", true},
+		{"wildcard subtype", []string{"text/*"}, "text/csv", "x", true},
+		{"wildcard other type", []string{"text/*"}, "application/json", "{}", false},
+		{"any type", []string{"*/*"}, "", "x", true},
+		{"missing type", nil, "", "x", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/v1/networks/", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		err := forwardpolicy{ContentTypes: tt.accepted}.checkContentType("/api/v1/networks/", req)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if apierr, ok := err.(*apiError); !ok || apierr.status != http.StatusUnsupportedMediaType || apierr.Code != "unsupported_media_type" {
+			t.Errorf("%s: error %#v, want 415", tt.name, err)
+		}
+	}
+}
+
+func TestUpstreamRequestDropsSessionCookie(t *testing.T) {
+	in := httptest.NewRequest("GET", "/api/v1/networks/?a=1", nil)
+	in.Header.Set("Cookie", "contiv-session=secret; lang=en")
+	in.RemoteAddr = "192.0.2.7:50000"
+	in.Header.Set("X-Forwarded-For", "198.51.100.1")
+	route := routedetail{Api: "/api/v1/networks/", Forwarding: forwardpolicy{Headers: []string{"Cookie"}}}
+	out, err := newUpstreamRequest("http://upstream:9999/", route, in, "contiv-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.URL.String() != "http://upstream:9999/api/v1/networks/?a=1" {
+		t.Errorf("url %s", out.URL)
+	}
+	if cookie := out.Header.Get("Cookie"); cookie != "lang=en" {
+		t.Errorf("Cookie %q", cookie)
+	}
+	if xff := out.Header.Get("X-Forwarded-For"); xff != "198.51.100.1, 192.0.2.7" {
+		t.Errorf("X-Forwarded-For %q", xff)
+	}
+}
@@ -0,0 +1,285 @@
+package session
+
+import (
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are recorded by the instrumenting middleware
+type Metrics struct {
+	// RequestCount and RequestLatency are labeled by service method and error
+	RequestCount   metrics.Counter
+	RequestLatency metrics.Histogram
+	// Logins is labeled by auth module and result
+	Logins metrics.Counter
+	// Validations is labeled by result of validateapp
+	Validations metrics.Counter
+	// ProxyRequests and ProxyLatency are labeled by route and status
+	ProxyRequests metrics.Counter
+	ProxyLatency  metrics.Histogram
+	// ActiveSessions is labeled by organization, AuthModuleErrors by
+	// organization and module. Both are set by Poll.
+	ActiveSessions   metrics.Gauge
+	AuthModuleErrors metrics.Gauge
+}
+
+// NewPrometheusMetrics registers the metrics with the default Prometheus registry
+func NewPrometheusMetrics() *Metrics {
+	const namespace, subsystem = "contiv", "session"
+	return &Metrics{
+		RequestCount: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "requests_total", Help: "Number of requests received.",
+		}, []string{"method", "error"}),
+		RequestLatency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "request_duration_seconds", Help: "Time spent serving requests.",
+		}, []string{"method", "error"}),
+		Logins: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "logins_total", Help: "Login attempts by auth module and result.",
+		}, []string{"module", "result"}),
+		Validations: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "validations_total", Help: "validateapp requests by result.",
+		}, []string{"result"}),
+		ProxyRequests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "proxy_requests_total", Help: "Proxied requests by route and status.",
+		}, []string{"route", "status"}),
+		ProxyLatency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "proxy_duration_seconds", Help: "Time until the upstream response headers.",
+		}, []string{"route", "status"}),
+		ActiveSessions: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "active_sessions", Help: "Logged in sessions by organization.",
+		}, []string{"organization"}),
+		AuthModuleErrors: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "auth_module_errors", Help: "Errors of the auth modules since the start.",
+		}, []string{"organization", "module"}),
+	}
+}
+
+// Poll sets the session and auth module gauges every interval until ctx is done
+func (m *Metrics) Poll(ctx context.Context, s Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if stats, err := s.stats(ctx); err == nil {
+			for org, count := range stats.sessions {
+				m.ActiveSessions.With("organization", org).Set(float64(count))
+			}
+			for _, module := range stats.modules {
+				m.AuthModuleErrors.With("organization", module.Organization, "module", module.Name).Set(float64(module.Errors))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// InstrumentingMiddleware records the metrics of the service
+func InstrumentingMiddleware(m *Metrics) Middleware {
+	return func(next Service) Service {
+		return &instrumentingMiddleware{
+			next:    next,
+			metrics: m,
+		}
+	}
+}
+
+type instrumentingMiddleware struct {
+	next    Service
+	metrics *Metrics
+}
+
+func (mw instrumentingMiddleware) observe(method string, begin time.Time, err error) {
+	lvs := []string{"method", method, "error", strconv.FormatBool(err != nil)}
+	mw.metrics.RequestCount.With(lvs...).Add(1)
+	mw.metrics.RequestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+}
+
+// login records the result of a login by the modules that accepted the user
+func (mw instrumentingMiddleware) login(ctx context.Context, r LoginRequest) (resp LoginResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("login", begin, err)
+		mw.metrics.Logins.With("module", loginModule(resp), "result", loginResult(resp, err)).Add(1)
+	}(time.Now())
+	resp, err = mw.next.login(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) verifymfa(ctx context.Context, r MFARequest) (resp LoginResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("verifymfa", begin, err)
+		mw.metrics.Logins.With("module", loginModule(resp), "result", loginResult(resp, err)).Add(1)
+	}(time.Now())
+	resp, err = mw.next.verifymfa(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) oidclogin(ctx context.Context, r oidcRequest) (resp redirectResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("oidclogin", begin, err)
+	}(time.Now())
+	resp, err = mw.next.oidclogin(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) oidccallback(ctx context.Context, r oidcRequest) (resp redirectResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("oidccallback", begin, err)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		mw.metrics.Logins.With("module", "oidc", "result", result).Add(1)
+	}(time.Now())
+	resp, err = mw.next.oidccallback(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) logout(ctx context.Context, r LogoutRequest) (resp LogoutResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("logout", begin, err)
+	}(time.Now())
+	resp, err = mw.next.logout(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) validateapp(ctx context.Context, r validateAppRequest) (resp LoginResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("validateapp", begin, err)
+		result := "invalid"
+		switch {
+		case err != nil:
+			result = "error"
+		case resp.Authenticated:
+			result = "valid"
+		case resp.MFARequired:
+			result = "mfa_pending"
+		}
+		mw.metrics.Validations.With("result", result).Add(1)
+	}(time.Now())
+	resp, err = mw.next.validateapp(ctx, r)
+	return
+}
+
+// apiprocess records proxied requests by route and upstream status. Requests
+// refused before they reach the upstream carry the status of the refusal.
+func (mw instrumentingMiddleware) apiprocess(ctx context.Context, r apiRequest) (resp interface{}, err error) {
+	defer func(begin time.Time) {
+		mw.observe("apiprocess", begin, err)
+		result, _ := resp.(apiresponse)
+		route, status := result.route, "unauthenticated"
+		switch {
+		case err != nil:
+			status = "error"
+			if apierr, ok := err.(*apiError); ok {
+				status = strconv.Itoa(apierr.status)
+			} else if err == ErrNotFound {
+				status = "404"
+			}
+		case result.result != nil:
+			status = strconv.Itoa(result.result.StatusCode)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		lvs := []string{"route", route, "status", status}
+		mw.metrics.ProxyRequests.With(lvs...).Add(1)
+		mw.metrics.ProxyLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	resp, err = mw.next.apiprocess(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) upstreamstatus(ctx context.Context, r adminRequest) (resp []upstreamStatus, err error) {
+	defer func(begin time.Time) {
+		mw.observe("upstreamstatus", begin, err)
+	}(time.Now())
+	resp, err = mw.next.upstreamstatus(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) authmodulestatus(ctx context.Context, r adminRequest) (resp []authModuleStatus, err error) {
+	defer func(begin time.Time) {
+		mw.observe("authmodulestatus", begin, err)
+	}(time.Now())
+	resp, err = mw.next.authmodulestatus(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) listsessions(ctx context.Context, r adminRequest) (resp []sessionInfo, err error) {
+	defer func(begin time.Time) {
+		mw.observe("listsessions", begin, err)
+	}(time.Now())
+	resp, err = mw.next.listsessions(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) revokesession(ctx context.Context, r adminRequest) (resp revokeResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("revokesession", begin, err)
+	}(time.Now())
+	resp, err = mw.next.revokesession(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) revokeusersessions(ctx context.Context, r adminRequest) (resp revokeResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("revokeusersessions", begin, err)
+	}(time.Now())
+	resp, err = mw.next.revokeusersessions(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) unlock(ctx context.Context, r adminRequest) (resp unlockResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("unlock", begin, err)
+	}(time.Now())
+	resp, err = mw.next.unlock(ctx, r)
+	return
+}
+
+func (mw instrumentingMiddleware) stats(ctx context.Context) (serviceStats, error) {
+	return mw.next.stats(ctx)
+}
+
+func (mw instrumentingMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// loginModule is "none" when no module accepted the user
+func loginModule(resp LoginResponse) string {
+	if resp.module == "" {
+		return "none"
+	}
+	return resp.module
+}
+
+func loginResult(resp LoginResponse, err error) string {
+	switch {
+	case err != nil:
+		if apierr, ok := err.(*apiError); ok && apierr.Code == "too_many_attempts" {
+			return "throttled"
+		}
+		return "error"
+	case resp.Authenticated:
+		return "success"
+	case resp.MFARequired:
+		return "mfa_required"
+	}
+	return "failure"
+}
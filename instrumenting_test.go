@@ -0,0 +1,117 @@
+package session
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+)
+
+var (
+	testMetricsOnce sync.Once
+	testMetrics     *Metrics
+)
+
+// scrapeMetrics returns the samples of the default registry by series, e.g.
+// contiv_session_logins_total{module="local",result="success"}
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "contiv_session_") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	// the metrics register with the default registry, once per test binary
+	testMetricsOnce.Do(func() { testMetrics = NewPrometheusMetrics() })
+	ts := newTestServer(t)
+	instrumented := *ts
+	instrumented.Server = httptest.NewServer(MakeHTTPHandler(context.Background(), InstrumentingMiddleware(testMetrics)(ts.service), log.NewNopLogger()))
+	defer instrumented.Server.Close()
+
+	before := scrapeMetrics(t)
+	admin, operator, anonymous := instrumented.client(t), instrumented.client(t), instrumented.client(t)
+	instrumented.login(t, admin, "admin", "wrong")
+	instrumented.login(t, admin, "admin", "admin-pw")
+	instrumented.login(t, operator, "operator", "operator-pw")
+	instrumented.validate(t, operator)
+	instrumented.validate(t, anonymous)
+	for _, path := range []string{"/api/v1/networks/net1/", "/api/v1/networks/net2/", "/api/v1/networks/net3/?debug=1"} {
+		if resp := instrumented.do(t, admin, "GET", path, "", nil, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("GET %s = %d", path, resp.StatusCode)
+		}
+	}
+	instrumented.do(t, operator, "GET", "/api/v1/tenants/t1/", "", nil, nil)
+	for _, path := range []string{"/api/v2/a/", "/api/v2/b/", "/other/c"} {
+		instrumented.do(t, admin, "GET", path, "", nil, nil)
+	}
+	instrumented.do(t, anonymous, "GET", "/api/v1/networks/net4/", "", nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a done context polls once
+	testMetrics.Poll(ctx, ts.service, time.Hour)
+	after := scrapeMetrics(t)
+
+	tests := []struct {
+		series string
+		delta  float64
+	}{
+		{`contiv_session_logins_total{module="local",result="success"}`, 2},
+		{`contiv_session_logins_total{module="none",result="failure"}`, 1},
+		{`contiv_session_validations_total{result="valid"}`, 1},
+		{`contiv_session_validations_total{result="invalid"}`, 1},
+		{`contiv_session_requests_total{error="false",method="login"}`, 3},
+		{`contiv_session_proxy_requests_total{route="/api/v1/networks/",status="201"}`, 3},
+		{`contiv_session_proxy_duration_seconds_count{route="/api/v1/networks/",status="201"}`, 3},
+		{`contiv_session_proxy_requests_total{route="/api/v1/tenants/",status="201"}`, 1},
+		{`contiv_session_proxy_requests_total{route="unmatched",status="404"}`, 3},
+		{`contiv_session_proxy_requests_total{route="/api/v1/networks/",status="unauthenticated"}`, 1},
+	}
+	for _, tt := range tests {
+		if delta := after[tt.series] - before[tt.series]; delta != tt.delta {
+			t.Errorf("%s grew by %v, want %v", tt.series, delta, tt.delta)
+		}
+	}
+	// the gauges hold the state at the last poll
+	if sessions := after[`contiv_session_active_sessions{organization=""}`]; sessions != 2 {
+		t.Errorf("active sessions %v, want 2", sessions)
+	}
+	if errors, ok := after[`contiv_session_auth_module_errors{module="local",organization=""}`]; !ok || errors != 0 {
+		t.Errorf("local module errors %v (%v), want 0", errors, ok)
+	}
+
+	// the route label is the configured route, never the request path
+	routes := map[string]bool{"/api/v1/networks/": true, "/api/v1/tenants/": true, "/api/v1/globals/": true, "unmatched": true}
+	for series := range after {
+		if !strings.HasPrefix(series, "contiv_session_proxy_requests_total{") {
+			continue
+		}
+		route := strings.SplitN(strings.SplitN(series, `route="`, 2)[1], `"`, 2)[0]
+		if !routes[route] {
+			t.Errorf("series %s has a route label outside the configured routes", series)
+		}
+	}
+}
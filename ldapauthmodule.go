@@ -1,22 +1,269 @@
 package session
 
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// default user search filters, {username} is replaced with the escaped login name
+	ldapDefaultUserFilter = "(&(objectClass=person)(uid={username}))"
+	adDefaultUserFilter   = "(&(objectClass=user)(sAMAccountName={username}))"
+)
 
 type ldapAuth struct {
-	ldapType    string
-	ldapVersion string
+	config *ldapConfig
+	pool   *ldapPool
+}
+
+// ldapConfig describes the LDAP or Active Directory server used by the ldap module
+type ldapConfig struct {
+	Enabled            bool   `json:"enabled"`
+	Type               string `json:"type"`
+	Version            string `json:"version"`
+	Host               string `json:"host"`
+	Port               int    `json:"port"`
+	UseSSL             bool   `json:"use_ssl"`
+	StartTLS           bool   `json:"start_tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	BindDN             string `json:"bind_dn"`
+	BindPassword       string `json:"bind_password"`
+	BaseDN             string `json:"base_dn"`
+	UserFilter         string `json:"user_filter"`
+	GroupAttribute     string `json:"group_attribute"`
+	// RoleMapping maps group DNs found in GroupAttribute to session roles
+	RoleMapping  map[string][]string `json:"role_mapping"`
+	DefaultRoles []string            `json:"default_roles"`
+	PoolSize     int                 `json:"pool_size"`
+	Timeout      int                 `json:"timeout"`
+
+	// groups restricts the module to the members of an organization's
+	// ldap_groups, every directory user is accepted when empty. The members
+	// of excluded belong to an organization and are refused without it.
+	groups   []string
+	excluded []string
+}
+
+// NewLdapAuth function initializes the ldap module, a disabled module
+// never authenticates
+func NewLdapAuth(config ldapConfig) *ldapAuth {
+	if !config.Enabled {
+		return &ldapAuth{}
+	}
+	return newLdapAuthFromConfig(&config)
 }
 
-// NewLdap function initializes the ldap module
-func NewLdapAuth() *ldapAuth {
+func newLdapAuthFromConfig(config *ldapConfig) *ldapAuth {
+	if config.Type == "" {
+		config.Type = "ldap"
+	}
+	if config.Version == "" {
+		config.Version = "3"
+	}
+	if config.Port == 0 {
+		config.Port = 389
+		if config.UseSSL {
+			config.Port = 636
+		}
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = ldapDefaultUserFilter
+		if config.Type == "ad" {
+			config.UserFilter = adDefaultUserFilter
+		}
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 4
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
 	return &ldapAuth{
-		ldapType:    "ldap-server1",
-		ldapVersion: "ldap3v",
+		config: config,
+		pool:   newLdapPool(config),
 	}
 }
 
+func (c *ldapConfig) validate() error {
+	if c.Host == "" {
+		return errors.New("host is required")
+	}
+	if c.BaseDN == "" {
+		return errors.New("base_dn is required")
+	}
+	if c.Type != "" && c.Type != "ldap" && c.Type != "ad" {
+		return fmt.Errorf("unsupported type %q", c.Type)
+	}
+	if c.Version != "" && c.Version != "3" {
+		return fmt.Errorf("unsupported protocol version %q", c.Version)
+	}
+	if c.UseSSL && c.StartTLS {
+		return errors.New("use_ssl and start_tls are mutually exclusive")
+	}
+	if c.UserFilter != "" && !strings.Contains(c.UserFilter, "{username}") {
+		return errors.New("user_filter must contain {username}")
+	}
+	return nil
+}
+
 func (l *ldapAuth) authenticate(cred Credentials) (LoginResponse, error) {
-	if cred.Username == "contiv" && cred.Password == "123" {
-		return LoginResponse{Authenticated: true, Message: "success"}, nil
+	invalid := LoginResponse{Authenticated: false, Message: "Invalid username or password"}
+	// an empty password would turn the user bind into an unauthenticated bind
+	if l.config == nil || cred.Username == "" || cred.Password == "" {
+		return invalid, nil
+	}
+
+	conn, err := l.pool.get()
+	if err != nil {
+		return invalid, err
+	}
+
+	if l.config.BindDN != "" {
+		if err = conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+			conn.Close()
+			return invalid, err
+		}
+	}
+
+	filter := strings.Replace(l.config.UserFilter, "{username}", ldap.EscapeFilter(cred.Username), -1)
+	search := ldap.NewSearchRequest(l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, l.config.Timeout, false, filter, []string{"dn", l.config.GroupAttribute}, nil)
+	result, err := conn.Search(search)
+	if err != nil {
+		conn.Close()
+		return invalid, err
+	}
+	if len(result.Entries) != 1 {
+		l.release(conn)
+		return invalid, nil
+	}
+
+	entry := result.Entries[0]
+	err = conn.Bind(entry.DN, cred.Password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		l.release(conn)
+		return invalid, nil
+	}
+	if err != nil {
+		conn.Close()
+		return invalid, err
+	}
+	l.release(conn)
+	groups := entry.GetAttributeValues(l.config.GroupAttribute)
+	if len(l.config.groups) > 0 && !anyEqualFold(l.config.groups, groups) || anyEqualFold(l.config.excluded, groups) {
+		return invalid, nil
+	}
+	return LoginResponse{Authenticated: true, Message: "success", Roles: l.roles(groups)}, nil
+}
+
+// anyEqualFold reports whether the lists share a group DN, compared
+// case-insensitively
+func anyEqualFold(list, groups []string) bool {
+	for _, group := range groups {
+		for _, item := range list {
+			if strings.EqualFold(item, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roles maps the user's groups to session roles, group DNs compare case-insensitively
+func (l *ldapAuth) roles(groups []string) []string {
+	roles := append([]string(nil), l.config.DefaultRoles...)
+	for group, mapped := range l.config.RoleMapping {
+		for _, member := range groups {
+			if !strings.EqualFold(group, member) {
+				continue
+			}
+			for _, role := range mapped {
+				if contains(roles, role) < 0 {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// release hands a connection back to the pool. Without a service account the
+// connection stays bound as the last user, so it is not reused.
+func (l *ldapAuth) release(conn *ldap.Conn) {
+	if l.config.BindDN == "" {
+		conn.Close()
+		return
+	}
+	l.pool.put(conn)
+}
+
+// ldapPool keeps idle connections to the directory server
+type ldapPool struct {
+	config *ldapConfig
+	conns  chan *ldap.Conn
+}
+
+func newLdapPool(config *ldapConfig) *ldapPool {
+	return &ldapPool{
+		config: config,
+		conns:  make(chan *ldap.Conn, config.PoolSize),
+	}
+}
+
+func (p *ldapPool) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-p.conns:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+			conn.Close()
+		default:
+			return p.dial()
+		}
+	}
+}
+
+func (p *ldapPool) put(conn *ldap.Conn) {
+	select {
+	case p.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *ldapPool) dial() (*ldap.Conn, error) {
+	timeout := time.Duration(p.config.Timeout) * time.Second
+	tlsConfig := &tls.Config{
+		ServerName:         p.config.Host,
+		InsecureSkipVerify: p.config.InsecureSkipVerify,
+	}
+	scheme := "ldap"
+	if p.config.UseSSL {
+		scheme = "ldaps"
+	}
+	addr := scheme + "://" + net.JoinHostPort(p.config.Host, strconv.Itoa(p.config.Port))
+
+	conn, err := ldap.DialURL(addr, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if p.config.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
-	return LoginResponse{Authenticated: false, Message: "Invalid username or password"}, nil
+	return conn, nil
 }
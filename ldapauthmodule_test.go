@@ -0,0 +1,228 @@
+package session
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAPUser is an entry of the fake directory
+type fakeLDAPUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// fakeDirectory is an in-process LDAP server answering the simple binds and
+// user searches of the ldap module
+type fakeDirectory struct {
+	listener net.Listener
+	// users are keyed by uid, the service account is a user too
+	users map[string]fakeLDAPUser
+
+	mtx   sync.Mutex
+	conns []net.Conn
+	binds int
+}
+
+var fakeUIDFilter = regexp.MustCompile(`\(uid=([^)]*)\)`)
+
+func newFakeDirectory(t *testing.T, users map[string]fakeLDAPUser) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{listener: listener, users: users}
+	go d.serve()
+	t.Cleanup(d.close)
+	return d
+}
+
+// config is an ldap section for the directory with a service account
+func (d *fakeDirectory) config() ldapConfig {
+	addr := d.listener.Addr().(*net.TCPAddr)
+	return ldapConfig{
+		Enabled:      true,
+		Host:         "127.0.0.1",
+		Port:         addr.Port,
+		BindDN:       "cn=svc,dc=example,dc=org",
+		BindPassword: "svc-secret",
+		BaseDN:       "dc=example,dc=org",
+		RoleMapping: map[string][]string{
+			"cn=netadmins,ou=groups,dc=example,dc=org": {"admin"},
+			"cn=netops,ou=groups,dc=example,dc=org":    {"operator"},
+		},
+		DefaultRoles: []string{"viewer"},
+		Timeout:      2,
+	}
+}
+
+// close stops the server and drops its connections, like an outage
+func (d *fakeDirectory) close() {
+	d.listener.Close()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.mtx.Lock()
+		d.conns = append(d.conns, conn)
+		d.mtx.Unlock()
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := d.bind(op.Children[1].Value.(string), op.Children[2].Data.String())
+			conn.Write(fakeLDAPResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			if m := fakeUIDFilter.FindStringSubmatch(filter); m != nil {
+				if user, ok := d.users[m[1]]; ok {
+					conn.Write(fakeLDAPEntry(id, user).Bytes())
+				}
+			}
+			conn.Write(fakeLDAPResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(dn, password string) uint16 {
+	d.mtx.Lock()
+	d.binds++
+	d.mtx.Unlock()
+	for _, user := range d.users {
+		if strings.EqualFold(user.dn, dn) && user.password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func fakeLDAPMessage(id int64, op *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	message.AppendChild(op)
+	return message
+}
+
+func fakeLDAPResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return fakeLDAPMessage(id, op)
+}
+
+func fakeLDAPEntry(id int64, user fakeLDAPUser) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, user.dn, "objectName"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+	attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "type"))
+	values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+	for _, group := range user.groups {
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, "value"))
+	}
+	attribute.AppendChild(values)
+	attributes.AppendChild(attribute)
+	op.AppendChild(attributes)
+	return fakeLDAPMessage(id, op)
+}
+
+var fakeLDAPUsers = map[string]fakeLDAPUser{
+	"svc": {dn: "cn=svc,dc=example,dc=org", password: "svc-secret"},
+	"alice": {dn: "uid=alice,ou=people,dc=example,dc=org", password: "alice-pw",
+		groups: []string{"CN=NetAdmins,OU=Groups,DC=example,DC=org", "cn=unmapped,ou=groups,dc=example,dc=org"}},
+	"bob": {dn: "uid=bob,ou=people,dc=example,dc=org", password: "bob-pw",
+		groups: []string{"cn=netops,ou=groups,dc=example,dc=org"}},
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	directory := newFakeDirectory(t, fakeLDAPUsers)
+	module := NewLdapAuth(directory.config())
+
+	tests := []struct {
+		name     string
+		cred     Credentials
+		accepted bool
+		roles    []string
+	}{
+		{"group mapped to admin", Credentials{Username: "alice", Password: "alice-pw"}, true, []string{"viewer", "admin"}},
+		{"group mapped to operator", Credentials{Username: "bob", Password: "bob-pw"}, true, []string{"viewer", "operator"}},
+		{"wrong password", Credentials{Username: "alice", Password: "bob-pw"}, false, nil},
+		{"unknown user", Credentials{Username: "mallory", Password: "alice-pw"}, false, nil},
+		{"empty password", Credentials{Username: "alice"}, false, nil},
+		{"filter injection", Credentials{Username: "*)(uid=alice", Password: "alice-pw"}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := module.authenticate(tt.cred)
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if result.Authenticated != tt.accepted {
+				t.Fatalf("authenticated = %v, want %v", result.Authenticated, tt.accepted)
+			}
+			if tt.accepted && !reflect.DeepEqual(result.Roles, tt.roles) {
+				t.Errorf("roles = %v, want %v", result.Roles, tt.roles)
+			}
+		})
+	}
+}
+
+func TestLdapServiceAccountBindFailure(t *testing.T) {
+	directory := newFakeDirectory(t, fakeLDAPUsers)
+	config := directory.config()
+	config.BindPassword = "wrong"
+	result, err := NewLdapAuth(config).authenticate(Credentials{Username: "alice", Password: "alice-pw"})
+	if err == nil || result.Authenticated {
+		t.Fatalf("authenticate = %+v, %v, want an error", result, err)
+	}
+}
+
+func TestLdapOutage(t *testing.T) {
+	directory := newFakeDirectory(t, fakeLDAPUsers)
+	module := NewLdapAuth(directory.config())
+	if result, err := module.authenticate(Credentials{Username: "bob", Password: "bob-pw"}); err != nil || !result.Authenticated {
+		t.Fatalf("authenticate before the outage = %+v, %v", result, err)
+	}
+	directory.close()
+	result, err := module.authenticate(Credentials{Username: "bob", Password: "bob-pw"})
+	if err == nil || result.Authenticated {
+		t.Fatalf("authenticate during the outage = %+v, %v, want an error", result, err)
+	}
+}
+
+func TestLdapDisabled(t *testing.T) {
+	result, err := NewLdapAuth(ldapConfig{}).authenticate(Credentials{Username: "alice", Password: "alice-pw"})
+	if err != nil || result.Authenticated {
+		t.Fatalf("authenticate = %+v, %v", result, err)
+	}
+}
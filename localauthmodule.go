@@ -1,47 +1,159 @@
 package session
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
 )
 
 type localAuth struct {
-	localAuthFileData 	[]fileFormat
+	localAuthFileData []fileFormat
 }
 
 type fileFormat struct {
-	Username	string 	`json:"username"`
-	Password	string	`json:"password"`
-	Active		bool	`json:"active"`
-
+	Username          string   `json:"username"`
+	Password          string   `json:"password"`
+	Active            bool     `json:"active"`
+	DisplayName       string   `json:"display_name,omitempty"`
+	Organization      string   `json:"organization,omitempty"`
+	Organizations     []string `json:"organizations,omitempty"`
+	Roles             []string `json:"roles,omitempty"`
+	PasswordChangedAt string   `json:"password_changed_at,omitempty"`
+	PasswordExpiresAt string   `json:"password_expires_at,omitempty"`
+	// TOTPSecret enables the second login step, see EnrollTOTP
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
-// NewLdap function initializes the ldap module
-func NewLocalAuth() *localAuth {
+// NewLocalAuth function initializes the local authentication module
+func NewLocalAuth(filepath string, logger log.Logger) *localAuth {
 	return &localAuth{
-		localAuthFileData: 	getSuperAdminUsers(LocalAuthFileLoc),
+		localAuthFileData: getSuperAdminUsers(filepath, logger),
+	}
+}
+
+func getSuperAdminUsers(filepath string, logger log.Logger) []fileFormat {
+	jsondata, e := readLocalAuthFile(filepath)
+	if e != nil {
+		errorLog(logger).Log("msg", "local auth file could not be read", "file", filepath, "err", e)
+		return []fileFormat{}
 	}
+	for _, element := range jsondata {
+		switch hashType(element.Password) {
+		case hashPlaintext:
+			warnLog(logger).Log("msg", "local user has a plaintext password, run the migrate-authfile command", "username", element.Username)
+		case hashUnknown:
+			warnLog(logger).Log("msg", "local user has no password or an unsupported hash and can not log in", "username", element.Username)
+		}
+	}
+	return jsondata
 }
 
-func getSuperAdminUsers(filepath string) []fileFormat {
+func readLocalAuthFile(filepath string) ([]fileFormat, error) {
 	file, e := ioutil.ReadFile(filepath)
-    	if e != nil {
-		fmt.Println("Error in reading file")
-        	return []fileFormat{}
-    	}
-    	var jsondata []fileFormat
-    	json.Unmarshal(file, &jsondata)
-    	return jsondata
+	if e != nil {
+		return nil, e
+	}
+	var jsondata []fileFormat
+	if e := json.Unmarshal(file, &jsondata); e != nil {
+		return nil, e
+	}
+	return jsondata, nil
+}
+
+// MigrateLocalAuthFile rewrites plaintext passwords in a local authorization
+// file as hashes of the given algorithm. Entries that are already hashed are
+// kept, an entry without a password or with an unsupported hash fails it.
+func MigrateLocalAuthFile(in, out, algorithm string) (int, error) {
+	jsondata, e := readLocalAuthFile(in)
+	if e != nil {
+		return 0, e
+	}
+	migrated := 0
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i := range jsondata {
+		switch hashType(jsondata[i].Password) {
+		case hashPlaintext:
+		case hashUnknown:
+			return 0, fmt.Errorf("user %q has no password or an unsupported hash", jsondata[i].Username)
+		default:
+			continue
+		}
+		hash, e := HashPassword(jsondata[i].Password, algorithm)
+		if e != nil {
+			return 0, e
+		}
+		jsondata[i].Password = hash
+		if jsondata[i].PasswordChangedAt == "" {
+			jsondata[i].PasswordChangedAt = now
+		}
+		migrated++
+	}
+	buf, e := json.MarshalIndent(jsondata, "", "  ")
+	if e != nil {
+		return 0, e
+	}
+	return migrated, ioutil.WriteFile(out, append(buf, '\n'), 0600)
 }
 
 func (l *localAuth) authenticate(cred Credentials) (LoginResponse, error) {
 	for _, element := range l.localAuthFileData {
-		if (element.Username == cred.Username){
-			if(element.Password == cred.Password && element.Active==true){
-				return LoginResponse{Authenticated: true, Message: "success"}, nil
-			}
+		if element.Username != cred.Username {
+			continue
 		}
+		ok, err := verifyPassword(element.Password, cred.Password)
+		if err != nil {
+			return LoginResponse{Authenticated: false, Message: "Invalid username or password"}, err
+		}
+		if !ok || !element.Active || !element.member(cred.Organization) {
+			break
+		}
+		if element.passwordExpired() {
+			return LoginResponse{Authenticated: false, Message: "Password expired"}, nil
+		}
+		return LoginResponse{Authenticated: true, Message: "success", Roles: element.Roles}, nil
 	}
 	return LoginResponse{Authenticated: false, Message: "Invalid username or password"}, nil
 }
+
+func (l *localAuth) enrollment(username string) *totpEnrollment {
+	for _, element := range l.localAuthFileData {
+		if element.Username == username && element.TOTPSecret != "" {
+			return &totpEnrollment{Secret: element.TOTPSecret, RecoveryCodes: element.RecoveryCodes}
+		}
+	}
+	return nil
+}
+
+// member reports whether the user belongs to the organization, only users of
+// no organization may log in without one
+func (f fileFormat) member(org string) bool {
+	if org == "" {
+		return f.Organization == "" && len(f.Organizations) == 0
+	}
+	if strings.EqualFold(f.Organization, org) {
+		return true
+	}
+	for _, o := range f.Organizations {
+		if strings.EqualFold(o, org) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fileFormat) passwordExpired() bool {
+	if f.PasswordExpiresAt == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, f.PasswordExpiresAt)
+	if err != nil {
+		// an unparsable expiry is treated as expired rather than never expiring
+		return true
+	}
+	return time.Now().After(expires)
+}
@@ -0,0 +1,58 @@
+package session
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMigrateLocalAuthFile(t *testing.T) {
+	dir := t.TempDir()
+	bcryptHash, err := HashPassword("bob-pw", HashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := writeTestJSON(t, filepath.Join(dir, "in.json"), []fileFormat{
+		{Username: "alice", Password: "alice-pw", Active: true},
+		{Username: "bob", Password: bcryptHash, Active: true, PasswordChangedAt: "2024-01-01T00:00:00Z"},
+	})
+	out := filepath.Join(dir, "out.json")
+	migrated, err := MigrateLocalAuthFile(in, out, HashArgon2id)
+	if err != nil || migrated != 1 {
+		t.Fatalf("migrate = %d, %v", migrated, err)
+	}
+	users, err := readLocalAuthFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashType(users[0].Password) != HashArgon2id || users[0].PasswordChangedAt == "" {
+		t.Errorf("alice = %+v, want an argon2id hash and a change time", users[0])
+	}
+	if users[1].Password != bcryptHash || users[1].PasswordChangedAt != "2024-01-01T00:00:00Z" {
+		t.Errorf("bob = %+v, want the entry kept", users[1])
+	}
+
+	// the migrated file logs both users in
+	local := NewLocalAuth(out, log.NewNopLogger())
+	for _, cred := range []Credentials{{Username: "alice", Password: "alice-pw"}, {Username: "bob", Password: "bob-pw"}} {
+		if res, err := local.authenticate(cred); err != nil || !res.Authenticated {
+			t.Errorf("%s: %+v, %v", cred.Username, res, err)
+		}
+	}
+
+	// entries that can not be migrated fail the migration
+	for _, stored := range []string{"", "{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="} {
+		in := writeTestJSON(t, filepath.Join(dir, "bad.json"), []fileFormat{{Username: "carol", Password: stored, Active: true}})
+		if _, err := MigrateLocalAuthFile(in, filepath.Join(dir, "bad-out.json"), HashBcrypt); err == nil {
+			t.Errorf("%q was migrated", stored)
+		}
+	}
+}
+
+func TestLocalAuthEmptyPassword(t *testing.T) {
+	file := writeTestJSON(t, filepath.Join(t.TempDir(), "localauthfile.json"), []fileFormat{{Username: "carol", Active: true}})
+	if res, _ := NewLocalAuth(file, log.NewNopLogger()).authenticate(Credentials{Username: "carol"}); res.Authenticated {
+		t.Fatal("a user without a password logged in with an empty one")
+	}
+}
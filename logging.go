@@ -0,0 +1,139 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/go-kit/kit/log"
+)
+
+// LogConfig configures the operational log
+type LogConfig struct {
+	// Level is the least severe level written: debug, info, warn or error
+	Level string `json:"level"`
+	// Format is logfmt or json
+	Format string `json:"format"`
+}
+
+const (
+	levelKey        = "level"
+	requestIDKey    = "request_id"
+	requestIDHeader = "X-Request-Id"
+	// maxRequestID bounds the request IDs taken from clients
+	maxRequestID = 64
+)
+
+var (
+	logLevels  = []string{"debug", "info", "warn", "error"}
+	logFormats = []string{"logfmt", "json"}
+	// redactedKeys are masked whatever logs them, so a credential or
+	// payload passed by mistake never reaches the log
+	redactedKeys = []string{"password", "secret", "client_secret", "token", "code", "recovery_code",
+		"csrf_token", "cookie", "authorization", "body", "data"}
+)
+
+// NewLogger builds the operational log. Records below the configured level
+// are dropped and the values of credentials and bodies are redacted.
+func NewLogger(config LogConfig, w io.Writer) log.Logger {
+	var logger log.Logger
+	if config.Format == "json" {
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	} else {
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	}
+	logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
+	min := contains(logLevels, config.Level)
+	if min < 0 {
+		min = contains(logLevels, "info")
+	}
+	return policyLogger{next: logger, min: min}
+}
+
+// policyLogger applies the level and redaction policy. Records without a
+// level, like those of go-kit itself, are always written.
+type policyLogger struct {
+	next log.Logger
+	min  int
+}
+
+func (l policyLogger) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		key := strings.ToLower(fmt.Sprint(kvs[i]))
+		if key == levelKey {
+			if level := contains(logLevels, fmt.Sprint(kvs[i+1])); level >= 0 && level < l.min {
+				return nil
+			}
+		}
+		if contains(redactedKeys, key) >= 0 {
+			kvs[i+1] = redacted
+		}
+	}
+	return l.next.Log(kvs...)
+}
+
+func debugLog(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(levelKey, "debug")
+}
+
+func infoLog(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(levelKey, "info")
+}
+
+func warnLog(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(levelKey, "warn")
+}
+
+func errorLog(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(levelKey, "error")
+}
+
+// withRequestID gives every request an ID, the client's X-Request-Id when it
+// is sane or a random one. It is set on the request, so routes forwarding the
+// header pass it upstream, and on the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey int
+
+const requestIDContextKey contextKey = 0
+
+// requestIDToContext passes the request ID set by withRequestID to the service
+func requestIDToContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, r.Header.Get(requestIDHeader))
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
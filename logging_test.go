@@ -0,0 +1,147 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	tests := []struct {
+		key      string
+		redacted bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"secret", true},
+		{"client_secret", true},
+		{"token", true},
+		{"csrf_token", true},
+		{"code", true},
+		{"recovery_code", true},
+		{"cookie", true},
+		{"Authorization", true},
+		{"body", true},
+		{"data", true},
+		{"username", false},
+		{"ip", false},
+		{"passwords_changed", false},
+	}
+	for _, format := range logFormats {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			infoLog(NewLogger(LogConfig{Level: "debug", Format: format}, &buf)).Log(tt.key, "s3cret-value", "event", "login")
+			out := buf.String()
+			if strings.Contains(out, "s3cret-value") == tt.redacted || strings.Contains(out, redacted) != tt.redacted {
+				t.Errorf("%s: %s logged as %q, redacted %v", format, tt.key, out, tt.redacted)
+			}
+			if !strings.Contains(out, "login") {
+				t.Errorf("%s: %s: the other values are missing from %q", format, tt.key, out)
+			}
+		}
+	}
+
+	// a key logged without a value is left alone
+	var buf bytes.Buffer
+	NewLogger(LogConfig{Level: "info", Format: "json"}, &buf).Log("msg", "odd", "password")
+	if strings.Contains(buf.String(), redacted) {
+		t.Errorf("a dangling key was given a redacted value: %q", buf.String())
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	tests := []struct {
+		configured string
+		// written are the levels that reach the log, of debug, info, warn, error
+		written []bool
+	}{
+		{"debug", []bool{true, true, true, true}},
+		{"info", []bool{false, true, true, true}},
+		{"warn", []bool{false, false, true, true}},
+		{"error", []bool{false, false, false, true}},
+		// an unknown level falls back to info
+		{"verbose", []bool{false, true, true, true}},
+	}
+	loggers := []func(*bytes.Buffer, LogConfig){
+		func(buf *bytes.Buffer, c LogConfig) { debugLog(NewLogger(c, buf)).Log("msg", "m") },
+		func(buf *bytes.Buffer, c LogConfig) { infoLog(NewLogger(c, buf)).Log("msg", "m") },
+		func(buf *bytes.Buffer, c LogConfig) { warnLog(NewLogger(c, buf)).Log("msg", "m") },
+		func(buf *bytes.Buffer, c LogConfig) { errorLog(NewLogger(c, buf)).Log("msg", "m") },
+	}
+	for _, tt := range tests {
+		for i, log := range loggers {
+			var buf bytes.Buffer
+			log(&buf, LogConfig{Level: tt.configured, Format: "json"})
+			if written := buf.Len() > 0; written != tt.written[i] {
+				t.Errorf("level %s: %s record written %v, want %v", tt.configured, logLevels[i], written, tt.written[i])
+				continue
+			}
+			if !tt.written[i] {
+				continue
+			}
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			if record[levelKey] != logLevels[i] || record["ts"] == nil {
+				t.Errorf("level %s: record %v", tt.configured, record)
+			}
+		}
+		// records without a level are always written
+		var buf bytes.Buffer
+		NewLogger(LogConfig{Level: tt.configured, Format: "logfmt"}, &buf).Log("transport", "HTTP")
+		if !strings.Contains(buf.String(), "transport=HTTP") {
+			t.Errorf("level %s: record without a level dropped", tt.configured)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name, sent string
+		kept       bool
+	}{
+		{"none", "", false},
+		{"uuid", "8f14e45f-ceea-467f-a0e6-3f5e0b4c1d2a", true},
+		{"allowed punctuation", "svc.gateway:req_42", true},
+		{"longest", strings.Repeat("a", maxRequestID), true},
+		{"too long", strings.Repeat("a", maxRequestID+1), false},
+		{"space", "req 1", false},
+		{"log injection", "req1\nlevel=error msg=forged", false},
+		{"markup", "<script>", false},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		var upstream, service string
+		handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstream = r.Header.Get(requestIDHeader)
+			service = requestID(requestIDToContext(context.Background(), r))
+		}))
+		req := httptest.NewRequest("GET", "/validateapp/", nil)
+		if tt.sent != "" {
+			req.Header[requestIDHeader] = []string{tt.sent}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		id := rec.Header().Get(requestIDHeader)
+		if id != upstream || id != service {
+			t.Errorf("%s: response %q, request %q, context %q, want one ID", tt.name, id, upstream, service)
+		}
+		if tt.kept {
+			if id != tt.sent {
+				t.Errorf("%s: %q replaced by %q", tt.name, tt.sent, id)
+			}
+			continue
+		}
+		if id == tt.sent || len(id) != 16 || !validRequestID(id) || seen[id] {
+			t.Errorf("%s: %q replaced by %q, want a new random ID", tt.name, tt.sent, id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,113 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps sessions in process memory, for development and tests
+type memoryBackend struct {
+	mtx       sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		entries:   make(map[string]memoryEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memoryBackend) get(key string) ([]byte, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if entry.expired(time.Now()) {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	return entry.value, nil
+}
+
+func (m *memoryBackend) set(key string, value []byte, ttl time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.store(key, value, ttl)
+	return nil
+}
+
+func (m *memoryBackend) create(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if entry, ok := m.entries[key]; ok && !entry.expired(time.Now()) {
+		return false, nil
+	}
+	m.store(key, value, ttl)
+	return true, nil
+}
+
+func (m *memoryBackend) replace(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(time.Now()) || !bytes.Equal(entry.value, old) {
+		return false, nil
+	}
+	m.store(key, value, ttl)
+	return true, nil
+}
+
+// store writes the entry, the caller holds the lock
+func (m *memoryBackend) store(key string, value []byte, ttl time.Duration) {
+	now := time.Now()
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	m.entries[key] = entry
+
+	// expired entries are otherwise only dropped when read
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, e := range m.entries {
+			if e.expired(now) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+}
+
+func (m *memoryBackend) list(prefix string) (map[string][]byte, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	result := make(map[string][]byte)
+	for key, entry := range m.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			result[key] = entry.value
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryBackend) delete(key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// totpStep and totpDigits are the RFC 6238 defaults understood by
+	// authenticator apps
+	totpStep   = 30
+	totpDigits = 6
+	// totpSkew accepts codes of the neighbouring time steps for clock drift
+	totpSkew = 1
+	// recoveryCodeCount one-time recovery codes are issued at enrollment
+	recoveryCodeCount = 10
+)
+
+// MFAConfig configures the second login step
+type MFAConfig struct {
+	// PendingTimeout is the number of seconds a user has to enter the code
+	// after the password was accepted
+	PendingTimeout int `json:"pending_timeout"`
+}
+
+// totpEnrollment is the second factor of a user. RecoveryCodes are hashed.
+type totpEnrollment struct {
+	Secret        string
+	RecoveryCodes []string
+}
+
+// mfaProvider is implemented by authentication modules that know the second
+// factor of their users
+type mfaProvider interface {
+	enrollment(username string) *totpEnrollment
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of a time step, RFC 6238 with HMAC-SHA1
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code belongs to, or -1
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.Replace(secret, " ", "", -1)))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func mfaUserKey(kind, username string) string {
+	return "mfa/" + kind + "/" + base64.RawURLEncoding.EncodeToString([]byte(username))
+}
+
+// verifyMFA checks a TOTP or recovery code of the user. Wrong codes count as
+// failed logins, so the throttle also bounds guessing of the six digits.
+func (a *AuthManager) verifyMFA(username string, r MFARequest, clientIP string) (bool, error) {
+	if err := a.throttle.check(username, clientIP); err != nil {
+		return false, err
+	}
+	enrollment := a.enrollment(username)
+	ok := false
+	var err error
+	if enrollment != nil {
+		if r.RecoveryCode != "" {
+			ok, err = a.useRecoveryCode(username, enrollment, r.RecoveryCode)
+		} else {
+			ok, err = a.useTOTP(username, enrollment, r.Code)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if !ok {
+		return false, a.throttle.failed(username, clientIP)
+	}
+	return true, a.throttle.succeeded(username)
+}
+
+// useTOTP accepts each time step once per user, a code seen by someone else
+// can not be replayed. The last used step is only advanced by create or
+// replace, so of concurrent requests with the same code one is accepted.
+func (a *AuthManager) useTOTP(username string, enrollment *totpEnrollment, code string) (bool, error) {
+	step := matchTOTP(enrollment.Secret, code, time.Now())
+	if step < 0 {
+		return false, nil
+	}
+	key := mfaUserKey("steps", username)
+	value := []byte(strconv.FormatInt(step, 10))
+	ttl := 2 * (totpSkew + 1) * totpStep * time.Second
+	for attempt := 0; attempt < replaceAttempts; attempt++ {
+		data, err := a.backend.get(key)
+		if err != nil {
+			return false, err
+		}
+		var stored bool
+		if data == nil {
+			stored, err = a.backend.create(key, value, ttl)
+		} else if last, e := strconv.ParseInt(string(data), 10, 64); e == nil && step <= last {
+			return false, nil
+		} else {
+			stored, err = a.backend.replace(key, data, value, ttl)
+		}
+		if err != nil || stored {
+			return stored, err
+		}
+	}
+	// the steps of the user keep changing, the code is contested
+	return false, nil
+}
+
+// useRecoveryCode accepts each recovery code once. Used codes are recorded in
+// the store backend by the hash of their stored hash.
+func (a *AuthManager) useRecoveryCode(username string, enrollment *totpEnrollment, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	for _, hash := range enrollment.RecoveryCodes {
+		ok, err := verifyPassword(hash, code)
+		if err != nil || !ok {
+			continue
+		}
+		sum := sha256.Sum256([]byte(hash))
+		key := mfaUserKey("recovery", username) + "/" + hex.EncodeToString(sum[:8])
+		// the code is used by whoever records it first
+		created, err := a.backend.create(key, []byte(time.Now().Format(time.RFC3339)), 0)
+		if err != nil || !created {
+			return false, err
+		}
+		infoLog(a.logger).Log("msg", "recovery code used", "username", username)
+		return true, nil
+	}
+	return false, nil
+}
+
+// enrollment returns the second factor of the user from the first module
+// that knows one
+func (a *AuthManager) enrollment(username string) *totpEnrollment {
+	for _, chain := range a.chains() {
+		for _, m := range chain {
+			if provider, ok := m.module.(mfaProvider); ok {
+				if enrollment := provider.enrollment(username); enrollment != nil {
+					return enrollment
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// EnrollTOTP generates a TOTP secret and recovery codes for a user of the
+// local authorization file. It returns the otpauth URI for authenticator apps
+// and the recovery codes, which are only stored hashed.
+func EnrollTOTP(filepath, username, issuer string) (string, []string, error) {
+	jsondata, err := readLocalAuthFile(filepath)
+	if err != nil {
+		return "", nil, err
+	}
+	index := -1
+	for i := range jsondata {
+		if jsondata[i].Username == username {
+			index = i
+		}
+	}
+	if index < 0 {
+		return "", nil, fmt.Errorf("user %q not found in %s", username, filepath)
+	}
+
+	secret := totpEncoding.EncodeToString(securecookie.GenerateRandomKey(20))
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(totpEncoding.EncodeToString(securecookie.GenerateRandomKey(7)))[:10]
+		hash, err := HashPassword(code, HashBcrypt)
+		if err != nil {
+			return "", nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hash)
+	}
+	jsondata[index].TOTPSecret = secret
+	jsondata[index].RecoveryCodes = hashes
+
+	buf, err := json.MarshalIndent(jsondata, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath, append(buf, '\n'), 0600); err != nil {
+		return "", nil, err
+	}
+
+	label := url.PathEscape(issuer + ":" + username)
+	query := url.Values{"secret": {secret}, "issuer": {issuer}, "digits": {strconv.Itoa(totpDigits)}, "period": {strconv.Itoa(totpStep)}}
+	return "otpauth://totp/" + label + "?" + query.Encode(), codes, nil
+}
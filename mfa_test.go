@@ -0,0 +1,72 @@
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// concurrently runs use n times at once and returns the number of accepts
+func concurrently(t *testing.T, n int, use func() (bool, error)) int32 {
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := use()
+			if err != nil {
+				t.Errorf("use: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	return accepted
+}
+
+// TestMFAReplay checks that a TOTP code and a recovery code are accepted once
+// even when they are sent by concurrent requests, on every backend
+func TestMFAReplay(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	recovery, err := HashPassword("abcd2345", HashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment := &totpEnrollment{Secret: secret, RecoveryCodes: []string{recovery}}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now().Unix() / totpStep
+
+	for name, open := range testBackends() {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			a := &AuthManager{backend: open(t), logger: log.NewNopLogger()}
+
+			code := totpCode(key, now)
+			if accepted := concurrently(t, 8, func() (bool, error) { return a.useTOTP("alice", enrollment, code) }); accepted != 1 {
+				t.Fatalf("TOTP code accepted %d times, want once", accepted)
+			}
+			// codes of earlier steps are refused once a later one was used
+			if ok, err := a.useTOTP("alice", enrollment, totpCode(key, now-1)); err != nil || ok {
+				t.Fatalf("earlier TOTP code = %v, %v, want refused", ok, err)
+			}
+			if ok, err := a.useTOTP("alice", enrollment, totpCode(key, now+1)); err != nil || !ok {
+				t.Fatalf("later TOTP code = %v, %v, want accepted", ok, err)
+			}
+			// the steps are kept per user
+			if ok, err := a.useTOTP("bob", enrollment, code); err != nil || !ok {
+				t.Fatalf("TOTP code of another user = %v, %v, want accepted", ok, err)
+			}
+
+			if accepted := concurrently(t, 4, func() (bool, error) { return a.useRecoveryCode("alice", enrollment, "ABCD-2345") }); accepted != 1 {
+				t.Fatalf("recovery code accepted %d times, want once", accepted)
+			}
+		})
+	}
+}
@@ -26,19 +26,51 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
+// requestLogger logs at info level, or warn for failed requests, with the
+// request ID. Only the path of URLs is logged, queries may carry codes or tokens.
+func (mw loggingMiddleware) requestLogger(ctx context.Context, err error) log.Logger {
+	logger := log.NewContext(mw.logger).With(requestIDKey, requestID(ctx))
+	if err != nil {
+		return warnLog(logger)
+	}
+	return infoLog(logger)
+}
+
 func (mw loggingMiddleware) login(ctx context.Context, r LoginRequest) (resp LoginResponse, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("Host", r.httpreq.Host, "Url", r.httpreq.URL)
-		mw.logger.Log("method", "login", "took", time.Since(begin), "err", err)
+		mw.requestLogger(ctx, err).Log("method", "login", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	resp, err = mw.next.login(ctx, r)
 	return
 }
 
+func (mw loggingMiddleware) verifymfa(ctx context.Context, r MFARequest) (resp LoginResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "verifymfa", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.verifymfa(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) oidclogin(ctx context.Context, r oidcRequest) (resp redirectResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "oidclogin", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.oidclogin(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) oidccallback(ctx context.Context, r oidcRequest) (resp redirectResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "oidccallback", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.oidccallback(ctx, r)
+	return
+}
+
 func (mw loggingMiddleware) logout(ctx context.Context, r LogoutRequest) (resp LogoutResponse, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("Host", r.httpreq.Host, "Url", r.httpreq.URL)
-		mw.logger.Log("method", "Logout", "took", time.Since(begin), "err", err)
+		mw.requestLogger(ctx, err).Log("method", "Logout", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	resp, err = mw.next.logout(ctx, r)
 	return
@@ -46,8 +78,7 @@ func (mw loggingMiddleware) logout(ctx context.Context, r LogoutRequest) (resp L
 
 func (mw loggingMiddleware) validateapp(ctx context.Context, r validateAppRequest) (resp LoginResponse, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("Host", r.httpreq.Host, "Url", r.httpreq.URL)
-		mw.logger.Log("method", "validateapp", "took", time.Since(begin), "err", err)
+		mw.requestLogger(ctx, err).Log("method", "validateapp", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	resp, err = mw.next.validateapp(ctx, r)
 	return
@@ -55,9 +86,65 @@ func (mw loggingMiddleware) validateapp(ctx context.Context, r validateAppReques
 
 func (mw loggingMiddleware) apiprocess(ctx context.Context, r apiRequest) (resp interface{}, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("Host", r.httpreq.Host, "Url", r.httpreq.URL)
-		mw.logger.Log("method", "apiRequest", "took", time.Since(begin), "err", err)
+		mw.requestLogger(ctx, err).Log("method", "apiRequest", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	resp, err = mw.next.apiprocess(ctx, r)
 	return
 }
+
+func (mw loggingMiddleware) upstreamstatus(ctx context.Context, r adminRequest) (resp []upstreamStatus, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "upstreamstatus", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.upstreamstatus(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) authmodulestatus(ctx context.Context, r adminRequest) (resp []authModuleStatus, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "authmodulestatus", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.authmodulestatus(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) listsessions(ctx context.Context, r adminRequest) (resp []sessionInfo, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "listsessions", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.listsessions(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) revokesession(ctx context.Context, r adminRequest) (resp revokeResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "revokesession", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "id", r.id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.revokesession(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) revokeusersessions(ctx context.Context, r adminRequest) (resp revokeResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "revokeusersessions", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "username", r.username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.revokeusersessions(ctx, r)
+	return
+}
+
+func (mw loggingMiddleware) unlock(ctx context.Context, r adminRequest) (resp unlockResponse, err error) {
+	defer func(begin time.Time) {
+		mw.requestLogger(ctx, err).Log("method", "unlock", "Host", r.httpreq.Host, "Url", r.httpreq.URL.Path, "username", r.username, "ip", r.ip, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	resp, err = mw.next.unlock(ctx, r)
+	return
+}
+
+// stats is polled for the metrics and not logged
+func (mw loggingMiddleware) stats(ctx context.Context) (serviceStats, error) {
+	return mw.next.stats(ctx)
+}
+
+func (mw loggingMiddleware) Close() error {
+	return mw.next.Close()
+}
@@ -0,0 +1,420 @@
+package session
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// oidcClockSkew is tolerated between the identity provider and this service
+	oidcClockSkew = 2 * time.Minute
+	// oidcJWKSRefresh limits refetching the keys for an unknown key ID
+	oidcJWKSRefresh = time.Minute
+	// oidcLoginTimeout is the time the user has to sign in at the provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcConfig describes the OpenID Connect identity provider used by the oidc
+// module. Users sign in with the authorization code flow and PKCE.
+type oidcConfig struct {
+	Enabled bool `json:"enabled"`
+	// Issuer is the provider URL, its discovery document is read from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	// UsernameClaim names the session user, RoleClaim holds the groups or
+	// roles mapped by RoleMapping
+	UsernameClaim string              `json:"username_claim"`
+	RoleClaim     string              `json:"role_claim"`
+	RoleMapping   map[string][]string `json:"role_mapping"`
+	DefaultRoles  []string            `json:"default_roles"`
+	// PostLoginRedirect is where the browser is sent after a successful login
+	PostLoginRedirect string `json:"post_login_redirect"`
+	Timeout           int    `json:"timeout"`
+}
+
+// oidcProvider is the part of the discovery document the module uses
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcAuth struct {
+	config *oidcConfig
+	client *http.Client
+	logger log.Logger
+
+	mtx       sync.Mutex
+	provider  *oidcProvider
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+}
+
+// redirectProvider is implemented by modules that authenticate the user at an
+// external identity provider instead of checking a password
+type redirectProvider interface {
+	authURL(state, nonce, challenge string) (string, error)
+	exchange(code, verifier, nonce string) (LoginResponse, error)
+}
+
+// NewOIDCAuth function initializes the oidc module, a disabled module never
+// authenticates. The provider is discovered on first use.
+func NewOIDCAuth(config oidcConfig, logger log.Logger) *oidcAuth {
+	if !config.Enabled {
+		return &oidcAuth{logger: logger}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = "groups"
+	}
+	if config.PostLoginRedirect == "" {
+		config.PostLoginRedirect = "/"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10
+	}
+	return &oidcAuth{
+		config: &config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		logger: logger,
+	}
+}
+
+func (c *oidcConfig) validate() error {
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if c.ClientID == "" {
+		return errors.New("client_id is required")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid redirect_url %q", c.RedirectURL)
+	}
+	if len(c.Scopes) > 0 && contains(c.Scopes, "openid") < 0 {
+		return errors.New("scopes must include openid")
+	}
+	return nil
+}
+
+// authURL returns the provider URL the browser is redirected to
+func (o *oidcAuth) authURL(state, nonce, challenge string) (string, error) {
+	if o.config == nil {
+		return "", errors.New("oidc is not enabled")
+	}
+	provider, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {strings.Join(o.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// exchange redeems the authorization code and validates the ID token
+func (o *oidcAuth) exchange(code, verifier, nonce string) (LoginResponse, error) {
+	invalid := LoginResponse{Authenticated: false, Message: "Invalid OpenID Connect login"}
+	if o.config == nil {
+		return invalid, errors.New("oidc is not enabled")
+	}
+	provider, err := o.discover()
+	if err != nil {
+		return invalid, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"client_id":     {o.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return invalid, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return invalid, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return invalid, fmt.Errorf("token response: %v", err)
+	}
+	if token.Error != "" {
+		infoLog(o.logger).Log("msg", "oidc token request refused", "error", token.Error, "description", token.ErrorDescription)
+		return invalid, nil
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return invalid, fmt.Errorf("token response: status %d without id_token", resp.StatusCode)
+	}
+
+	claims, err := o.verify(token.IDToken, nonce, time.Now())
+	if err != nil {
+		warnLog(o.logger).Log("msg", "oidc id token rejected", "err", err)
+		return invalid, nil
+	}
+	username, _ := claims[o.config.UsernameClaim].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+	if username == "" {
+		return invalid, nil
+	}
+	return LoginResponse{Authenticated: true, Message: "success", Username: username,
+		Roles: o.roles(claimStrings(claims[o.config.RoleClaim])), module: "oidc"}, nil
+}
+
+// verify checks the signature and the standard claims of an ID token
+func (o *oidcAuth) verify(token, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("algorithm %q does not match the RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("algorithm %q does not match the EC key", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != o.provider.Issuer {
+		return nil, fmt.Errorf("issuer %q", iss)
+	}
+	audience := claimStrings(claims["aud"])
+	if contains(audience, o.config.ClientID) < 0 {
+		return nil, fmt.Errorf("audience %v", audience)
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != o.config.ClientID {
+		return nil, fmt.Errorf("authorized party %q", azp)
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("token issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// discover reads the provider configuration once
+func (o *oidcAuth) discover() (*oidcProvider, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	var provider oidcProvider
+	if err := o.getJSON(strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", provider.Issuer, o.config.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery: incomplete provider configuration")
+	}
+	o.provider = &provider
+	return o.provider, nil
+}
+
+// key returns the signing key with the ID, the key set is refetched when the
+// provider rotated its keys
+func (o *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetch) < oidcJWKSRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	o.keysFetch = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(o.provider.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if k.Crv != "P-256" || err1 != nil || err2 != nil || !key.Curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[k.Kid] = key
+		}
+	}
+	o.keys = keys
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// lookup finds a key by ID, a token without ID may use the only key
+func (o *oidcAuth) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+func (o *oidcAuth) getJSON(location string, v interface{}) error {
+	resp, err := o.client.Get(location)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", location, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// roles maps the values of the role claim to session roles
+func (o *oidcAuth) roles(groups []string) []string {
+	roles := append([]string(nil), o.config.DefaultRoles...)
+	for _, group := range groups {
+		for _, role := range o.config.RoleMapping[group] {
+			if contains(roles, role) < 0 {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings reads a claim that is a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
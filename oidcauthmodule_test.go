@@ -0,0 +1,319 @@
+package session
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeOIDCProvider is an identity provider with discovery, an authorization
+// endpoint that grants every request, a token endpoint checking PKCE and a
+// key set that can be rotated
+type fakeOIDCProvider struct {
+	*httptest.Server
+	t *testing.T
+
+	mtx sync.Mutex
+	// keys are published in the key set, the last one signs
+	keys  []fakeOIDCKey
+	codes map[string]fakeOIDCGrant
+	// claims changes the claims of the next ID tokens
+	claims func(claims map[string]interface{})
+	// signer, when set, signs instead of the current key
+	signer      *rsa.PrivateKey
+	keyFetches  int
+	nextCode    int
+	clientID    string
+	redirectURI string
+}
+
+type fakeOIDCKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+type fakeOIDCGrant struct {
+	challenge, nonce string
+}
+
+func newFakeOIDCProvider(t *testing.T, clientID, redirectURI string) *fakeOIDCProvider {
+	p := &fakeOIDCProvider{t: t, codes: make(map[string]fakeOIDCGrant), clientID: clientID, redirectURI: redirectURI}
+	p.rotate("key-1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{Issuer: p.URL, AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint: p.URL + "/token", JWKSURI: p.URL + "/jwks"})
+	})
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// rotate adds a signing key, the previous keys stay published
+func (p *fakeOIDCProvider) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.keys = append(p.keys, fakeOIDCKey{kid: kid, key: key})
+}
+
+func (p *fakeOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != p.clientID || query.Get("redirect_uri") != p.redirectURI ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	p.mtx.Lock()
+	p.nextCode++
+	code := fmt.Sprintf("code-%d", p.nextCode)
+	p.codes[code] = fakeOIDCGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.mtx.Unlock()
+	http.Redirect(w, r, p.redirectURI+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	refuse := func(description string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": description})
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	grant, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("client_id") != p.clientID ||
+		r.FormValue("redirect_uri") != p.redirectURI {
+		refuse("unknown code")
+		return
+	}
+	verified := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verified[:]) != grant.challenge {
+		refuse("code verifier does not match the challenge")
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                p.URL,
+		"sub":                "0001",
+		"aud":                p.clientID,
+		"azp":                p.clientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              grant.nonce,
+		"preferred_username": "alice",
+		"groups":             []string{"netadmins"},
+	}
+	if p.claims != nil {
+		p.claims(claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(claims), "token_type": "Bearer"})
+}
+
+func (p *fakeOIDCProvider) sign(claims map[string]interface{}) string {
+	current := p.keys[len(p.keys)-1]
+	key := current.key
+	if p.signer != nil {
+		key = p.signer
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": current.kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *fakeOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.keyFetches++
+	var keys []map[string]string
+	for _, k := range p.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": k.kid,
+			"n": base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (p *fakeOIDCProvider) fetches() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.keyFetches
+}
+
+// set changes the provider under its lock
+func (p *fakeOIDCProvider) set(change func()) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	change()
+}
+
+// oidcLogin runs the authorization code flow the way the login handlers do:
+// the browser follows authURL, made for the verifier "verifier" and the nonce
+// "nonce", and the service redeems the returned code with the verifier and
+// nonce it passes
+func oidcLogin(t *testing.T, o *oidcAuth, verifier, nonce string) LoginResponse {
+	t.Helper()
+	challenge := sha256.Sum256([]byte("verifier"))
+	location, err := o.authURL("state", "nonce", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := browser.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	redirect, err := resp.Location()
+	if err != nil {
+		t.Fatalf("authorization status %d: %v", resp.StatusCode, err)
+	}
+	if redirect.Query().Get("state") != "state" {
+		t.Fatalf("state %q was not returned", redirect.Query().Get("state"))
+	}
+	res, err := o.exchange(redirect.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func newTestOIDCAuth(t *testing.T) (*oidcAuth, *fakeOIDCProvider) {
+	redirectURI := "https://session.example.com/oidc/callback"
+	provider := newFakeOIDCProvider(t, "contiv", redirectURI)
+	o := NewOIDCAuth(oidcConfig{
+		Enabled:     true,
+		Issuer:      provider.URL,
+		ClientID:    "contiv",
+		RedirectURL: redirectURI,
+		RoleMapping: map[string][]string{"netadmins": {"admin"}},
+	}, log.NewNopLogger())
+	return o, provider
+}
+
+func TestOIDCLogin(t *testing.T) {
+	o, _ := newTestOIDCAuth(t)
+	res := oidcLogin(t, o, "verifier", "nonce")
+	if !res.Authenticated || res.Username != "alice" || len(res.Roles) != 1 || res.Roles[0] != "admin" {
+		t.Fatalf("login = %+v", res)
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	o, _ := newTestOIDCAuth(t)
+	if res := oidcLogin(t, o, "another verifier", "nonce"); res.Authenticated {
+		t.Fatal("a code was redeemed with the wrong verifier")
+	}
+}
+
+func TestOIDCTokenChecks(t *testing.T) {
+	o, provider := newTestOIDCAuth(t)
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		nonce  string
+		claims func(claims map[string]interface{})
+		signer *rsa.PrivateKey
+	}{
+		{name: "signature", signer: forger},
+		{name: "issuer", claims: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{name: "audience", claims: func(c map[string]interface{}) { c["aud"] = []string{"other-client"} }},
+		{name: "authorized party", claims: func(c map[string]interface{}) {
+			c["aud"] = []string{"contiv", "other-client"}
+			c["azp"] = "other-client"
+		}},
+		{name: "nonce", nonce: "replayed nonce"},
+		{name: "expired", claims: func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-oidcClockSkew - time.Minute).Unix()
+		}},
+		{name: "missing expiry", claims: func(c map[string]interface{}) { delete(c, "exp") }},
+		{name: "issued in the future", claims: func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(oidcClockSkew + time.Minute).Unix()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.set(func() { provider.claims, provider.signer = tt.claims, tt.signer })
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "nonce"
+			}
+			if res := oidcLogin(t, o, "verifier", nonce); res.Authenticated {
+				t.Fatalf("token with a bad %s was accepted: %+v", tt.name, res)
+			}
+		})
+	}
+
+	// the same provider still signs users in with valid tokens
+	provider.set(func() { provider.claims, provider.signer = nil, nil })
+	if res := oidcLogin(t, o, "verifier", "nonce"); !res.Authenticated {
+		t.Fatalf("valid token refused: %+v", res)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	o, provider := newTestOIDCAuth(t)
+	if res := oidcLogin(t, o, "verifier", "nonce"); !res.Authenticated {
+		t.Fatalf("login = %+v", res)
+	}
+	if fetches := provider.fetches(); fetches != 1 {
+		t.Fatalf("key set fetched %d times, want 1", fetches)
+	}
+
+	// tokens of a new key are refused until the key set may be refetched,
+	// so unknown key IDs cannot make the service hammer the provider
+	provider.rotate("key-2")
+	if res := oidcLogin(t, o, "verifier", "nonce"); res.Authenticated {
+		t.Fatal("token of an unknown key was accepted")
+	}
+	if fetches := provider.fetches(); fetches != 1 {
+		t.Fatalf("key set fetched %d times within %v", fetches, oidcJWKSRefresh)
+	}
+
+	o.mtx.Lock()
+	o.keysFetch = time.Now().Add(-oidcJWKSRefresh)
+	o.mtx.Unlock()
+	if res := oidcLogin(t, o, "verifier", "nonce"); !res.Authenticated {
+		t.Fatalf("token of the rotated key was refused: %+v", res)
+	}
+	if fetches := provider.fetches(); fetches != 2 {
+		t.Fatalf("key set fetched %d times, want 2", fetches)
+	}
+
+	// the key set is kept while the provider signs with a known key
+	if res := oidcLogin(t, o, "verifier", "nonce"); !res.Authenticated {
+		t.Fatalf("login = %+v", res)
+	}
+	if fetches := provider.fetches(); fetches != 2 {
+		t.Fatalf("key set refetched for a known key")
+	}
+}
@@ -0,0 +1,111 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+)
+
+// OrganizationConfig is an organization (tenant) users log in to by sending
+// its name as the organization of their credentials
+type OrganizationConfig struct {
+	Name string `json:"name"`
+	// Tenant is the Contiv tenant of the organization, Name when empty
+	Tenant string `json:"tenant"`
+	// Modules is the module chain of the organization, auth.modules when empty
+	Modules []authModuleConfig `json:"modules"`
+	// LDAP is the directory of the organization, the ldap section when not set
+	LDAP *ldapConfig `json:"ldap,omitempty"`
+	// LDAPGroups are the directory groups whose members belong to the
+	// organization, required when it shares the ldap section
+	LDAPGroups []string `json:"ldap_groups"`
+}
+
+// organization is a configured organization with its module chain
+type organization struct {
+	name    string
+	tenant  string
+	modules []*authModule
+}
+
+// newOrganizations builds the organizations, keyed by their lower case name
+func newOrganizations(config Config, logger log.Logger) map[string]*organization {
+	orgs := make(map[string]*organization)
+	for _, o := range config.Organizations {
+		modules := modulesOf(o, config)
+		ldap := config.LDAP
+		if o.LDAP != nil {
+			ldap = *o.LDAP
+		}
+		ldap.groups = o.LDAPGroups
+		orgs[strings.ToLower(o.Name)] = &organization{
+			name:    o.Name,
+			tenant:  o.tenant(),
+			modules: newModuleChain(modules, ldap, config.LocalAuthFile, logger),
+		}
+	}
+	return orgs
+}
+
+// modulesOf returns the module chain of the organization
+func modulesOf(o OrganizationConfig, c Config) []authModuleConfig {
+	if len(o.Modules) > 0 {
+		return o.Modules
+	}
+	return c.Auth.Modules
+}
+
+// decides reports whether the module is sufficient or required in the chain
+func decides(chain []authModuleConfig, name string) bool {
+	for _, m := range chain {
+		if m.Name == name && (m.Policy == policySufficient || m.Policy == policyRequired) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o OrganizationConfig) tenant() string {
+	if o.Tenant != "" {
+		return o.Tenant
+	}
+	return o.Name
+}
+
+func validateOrganizations(c Config) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, o := range c.Organizations {
+		prefix := fmt.Sprintf("organizations[%d]", i)
+		if o.Name == "" {
+			problems = append(problems, prefix+": name is required")
+			continue
+		}
+		prefix = fmt.Sprintf("organizations[%s]", o.Name)
+		if seen[strings.ToLower(o.Name)] {
+			problems = append(problems, prefix+": listed twice")
+		}
+		seen[strings.ToLower(o.Name)] = true
+
+		ldapEnabled := c.LDAP.Enabled
+		if o.LDAP != nil {
+			ldapEnabled = o.LDAP.Enabled
+			if o.LDAP.Enabled {
+				if err := o.LDAP.validate(); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.ldap: %v", prefix, err))
+				}
+			}
+		}
+		// the ldap section knows the users of every organization sharing it,
+		// its groups tell them apart
+		if o.LDAP == nil && len(o.LDAPGroups) == 0 && c.LDAP.Enabled && decides(modulesOf(o, c), "ldap") {
+			problems = append(problems, prefix+": ldap_groups is required when the organization shares the ldap section and ldap decides its logins")
+		}
+		// inherited modules are checked again against the organization's ldap
+		if len(o.Modules) > 0 || o.LDAP != nil {
+			problems = append(problems, validateModules(prefix+".modules", modulesOf(o, c), ldapEnabled)...)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testOrganizationConfig has the fake directory as ldap section, shared by
+// team-a and team-b and told apart by their groups
+func testOrganizationConfig(directory *fakeDirectory) Config {
+	config := DefaultConfig()
+	config.Lockout.Enabled = false
+	config.LDAP = directory.config()
+	config.Auth.Modules = []authModuleConfig{{Name: "ldap", Policy: policySufficient}}
+	config.Organizations = []OrganizationConfig{
+		{Name: "team-a", LDAPGroups: []string{"cn=netadmins,ou=groups,dc=example,dc=org"}},
+		{Name: "team-b", LDAPGroups: []string{"CN=NetOps,OU=Groups,DC=example,DC=org"}},
+	}
+	return config
+}
+
+func TestValidateOrganizationsLdapGroups(t *testing.T) {
+	config := DefaultConfig()
+	config.LDAP = ldapConfig{Enabled: true, Host: "ldap.example.org", BaseDN: "dc=example,dc=org"}
+	own := &ldapConfig{Enabled: true, Host: "ldap.team-a.example.org", BaseDN: "dc=team-a,dc=example,dc=org"}
+
+	tests := []struct {
+		name  string
+		org   OrganizationConfig
+		valid bool
+	}{
+		{"shared ldap without groups", OrganizationConfig{Name: "team-a"}, false},
+		{"shared ldap with groups", OrganizationConfig{Name: "team-a", LDAPGroups: []string{"cn=team-a,dc=example,dc=org"}}, true},
+		{"own ldap", OrganizationConfig{Name: "team-a", LDAP: own}, true},
+		{"ldap only adds roles", OrganizationConfig{Name: "team-a", Modules: []authModuleConfig{
+			{Name: "local", Policy: policySufficient}, {Name: "ldap", Policy: policyOptional}}}, true},
+	}
+	for _, tt := range tests {
+		config.Organizations = []OrganizationConfig{tt.org}
+		problems := validateOrganizations(config)
+		if valid := len(problems) == 0; valid != tt.valid {
+			t.Errorf("%s: problems %v", tt.name, problems)
+		}
+		if !tt.valid && len(problems) > 0 && !strings.Contains(problems[0], "ldap_groups") {
+			t.Errorf("%s: problem %q does not name ldap_groups", tt.name, problems[0])
+		}
+	}
+}
+
+func TestOrganizationLdapGroups(t *testing.T) {
+	directory := newFakeDirectory(t, fakeLDAPUsers)
+	a := NewAuthmanager(testOrganizationConfig(directory), newMemoryBackend(), log.NewNopLogger())
+
+	tests := []struct {
+		username, password, organization string
+		accepted                         bool
+	}{
+		{"alice", "alice-pw", "team-a", true},
+		{"alice", "alice-pw", "TEAM-A", true},
+		{"alice", "alice-pw", "team-b", false},
+		{"bob", "bob-pw", "team-b", true},
+		{"bob", "bob-pw", "team-a", false},
+		{"bob", "bob-pw", "team-c", false},
+	}
+	for _, tt := range tests {
+		res, err := a.authenticate(Credentials{Username: tt.username, Password: tt.password, Organization: tt.organization}, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("%s in %s: %v", tt.username, tt.organization, err)
+		}
+		if res.Authenticated != tt.accepted {
+			t.Errorf("%s in %s: authenticated = %v, want %v", tt.username, tt.organization, res.Authenticated, tt.accepted)
+		}
+		if tt.accepted && res.Tenant != strings.ToLower(tt.organization) {
+			t.Errorf("%s in %s: tenant %q", tt.username, tt.organization, res.Tenant)
+		}
+	}
+}
+
+func TestUnscopedLogin(t *testing.T) {
+	directory := newFakeDirectory(t, fakeLDAPUsers)
+	config := testOrganizationConfig(directory)
+	config.Auth.Modules = []authModuleConfig{{Name: "local", Policy: policySufficient}, {Name: "ldap", Policy: policySufficient}}
+	var users []fileFormat
+	for _, user := range []fileFormat{{Username: "solo"}, {Username: "anna", Organization: "team-a"}, {Username: "ben", Organizations: []string{"team-b"}}} {
+		hash, err := HashPassword(user.Username+"-pw", HashBcrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Password, user.Active = hash, true
+		users = append(users, user)
+	}
+	config.LocalAuthFile = writeTestJSON(t, filepath.Join(t.TempDir(), "localauthfile.json"), users)
+	a := NewAuthmanager(config, newMemoryBackend(), log.NewNopLogger())
+
+	tests := []struct {
+		username, password, organization string
+		accepted                         bool
+	}{
+		{"solo", "solo-pw", "", true},
+		{"anna", "anna-pw", "", false},
+		{"anna", "anna-pw", "team-a", true},
+		{"ben", "ben-pw", "", false},
+		{"ben", "ben-pw", "team-b", true},
+		// alice is in the ldap_groups of team-a, svc in none
+		{"alice", "alice-pw", "", false},
+		{"alice", "alice-pw", "team-a", true},
+		{"svc", "svc-secret", "", true},
+	}
+	for _, tt := range tests {
+		res, err := a.authenticate(Credentials{Username: tt.username, Password: tt.password, Organization: tt.organization}, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("%s in %q: %v", tt.username, tt.organization, err)
+		}
+		if res.Authenticated != tt.accepted {
+			t.Errorf("%s in %q: authenticated = %v, want %v", tt.username, tt.organization, res.Authenticated, tt.accepted)
+		}
+	}
+
+	config.Auth.RequireOrganization = true
+	a = NewAuthmanager(config, newMemoryBackend(), log.NewNopLogger())
+	res, err := a.authenticate(Credentials{Username: "solo", Password: "solo-pw"}, "192.0.2.1")
+	if apierr, ok := err.(*apiError); !ok || apierr.Code != "organization_required" || res.Authenticated {
+		t.Fatalf("login without an organization = %+v, %v", res, err)
+	}
+	if res, err := a.authenticate(Credentials{Username: "anna", Password: "anna-pw", Organization: "team-a"}, "192.0.2.1"); err != nil || !res.Authenticated {
+		t.Fatalf("login to team-a = %+v, %v", res, err)
+	}
+}
+
+func TestRequireOrganizationRefusesOIDC(t *testing.T) {
+	config := DefaultConfig()
+	config.Auth.RequireOrganization = true
+	config.OIDC = oidcConfig{Enabled: true, Issuer: "https://idp.example.org", ClientID: "contiv", RedirectURL: "https://contiv.example.org/login/oidc/callback"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "auth.require_organization") {
+		t.Fatalf("validate = %v", err)
+	}
+}
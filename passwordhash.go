@@ -0,0 +1,123 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// HashBcrypt selects bcrypt password hashes
+	HashBcrypt = "bcrypt"
+	// HashArgon2id selects argon2id password hashes in PHC string format
+	HashArgon2id = "argon2id"
+	// hashPlaintext is reported for legacy entries that are not hashed
+	hashPlaintext = "plaintext"
+	// hashUnknown is reported for empty values and for hash formats that are
+	// not supported, which never match a password
+	hashUnknown = "unknown"
+
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// ErrUnknownHashAlgorithm is returned for unsupported hash algorithms
+var ErrUnknownHashAlgorithm = errors.New("unknown password hash algorithm")
+
+// errNoPassword is returned for users without a stored password
+var errNoPassword = errors.New("no password is set")
+
+// HashPassword hashes the password with the given algorithm
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", ErrUnknownHashAlgorithm
+}
+
+// hashType detects the hash algorithm from the stored password string. Values
+// in the $id$ or {SCHEME} notation of other hashes are not taken as
+// plaintext, or the hash would become the password.
+func hashType(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return HashBcrypt
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return HashArgon2id
+	case stored == "", strings.HasPrefix(stored, "$"), strings.HasPrefix(stored, "{") && strings.Contains(stored, "}"):
+		return hashUnknown
+	}
+	return hashPlaintext
+}
+
+// verifyPassword compares a password against a stored hash or legacy plaintext value
+func verifyPassword(stored, password string) (bool, error) {
+	switch hashType(stored) {
+	case HashBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case HashArgon2id:
+		return verifyArgon2id(stored, password)
+	case hashUnknown:
+		if stored == "" {
+			return false, errNoPassword
+		}
+		return false, ErrUnknownHashAlgorithm
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+}
+
+func verifyArgon2id(stored, password string) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, computed) == 1, nil
+}
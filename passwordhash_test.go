@@ -0,0 +1,75 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id} {
+		hash, err := HashPassword("s3cret", algorithm)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if hashType(hash) != algorithm {
+			t.Errorf("%s: hash %q detected as %s", algorithm, hash, hashType(hash))
+		}
+		if ok, err := verifyPassword(hash, "s3cret"); !ok || err != nil {
+			t.Errorf("%s: right password = %v, %v", algorithm, ok, err)
+		}
+		if ok, err := verifyPassword(hash, "s3cret "); ok || err != nil {
+			t.Errorf("%s: wrong password = %v, %v", algorithm, ok, err)
+		}
+		// the hashes are salted
+		if again, _ := HashPassword("s3cret", algorithm); again == hash {
+			t.Errorf("%s: hashing twice gave the same hash", algorithm)
+		}
+	}
+	if _, err := HashPassword("s3cret", "md5"); err != ErrUnknownHashAlgorithm {
+		t.Errorf("md5: %v", err)
+	}
+}
+
+func TestHashType(t *testing.T) {
+	tests := []struct {
+		stored, algorithm string
+	}{
+		{"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", HashBcrypt},
+		{"$2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", HashBcrypt},
+		{"$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", HashBcrypt},
+		{"$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5", HashArgon2id},
+		{"$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5", hashUnknown},
+		{"$6$rounds=5000$salt$hash", hashUnknown},
+		{"{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", hashUnknown},
+		{"", hashUnknown},
+		{"admin1", hashPlaintext},
+		{"pa$$word", hashPlaintext},
+	}
+	for _, tt := range tests {
+		if algorithm := hashType(tt.stored); algorithm != tt.algorithm {
+			t.Errorf("%q detected as %s, want %s", tt.stored, algorithm, tt.algorithm)
+		}
+	}
+}
+
+func TestVerifyPasswordUnknownHash(t *testing.T) {
+	tests := []struct {
+		stored, password string
+	}{
+		// an unsupported hash is not its own password
+		{"$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5", "$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5"},
+		{"{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if ok, err := verifyPassword(tt.stored, tt.password); ok || err == nil {
+			t.Errorf("%q: verify = %v, %v, want an error", tt.stored, ok, err)
+		}
+	}
+	if ok, err := verifyPassword("admin1", "admin1"); !ok || err != nil {
+		t.Errorf("plaintext: verify = %v, %v", ok, err)
+	}
+	if _, err := verifyPassword("$argon2id$v=19$broken", "x"); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Errorf("malformed argon2id: %v", err)
+	}
+}
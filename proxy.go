@@ -0,0 +1,131 @@
+package session
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// hopHeaders are connection specific and never forwarded, as in net/http/httputil
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardedHeaders are copied from the client request to the upstream request
+var forwardedHeaders = []string{"Accept", "Content-Type"}
+
+// newUpstreamRequest prepares the request sent to the destination. The client
+// body is streamed as is and the call is cancelled when the client goes away.
+func newUpstreamRequest(destination string, config routedetail, in *http.Request, sessionCookie string) (*http.Request, error) {
+	target := strings.TrimSuffix(destination, "/") + config.Rewrite.apply(in.URL.Path)
+	if query := config.Forwarding.upstreamQuery(in.URL); query != "" {
+		target += "?" + query
+	}
+	var body io.Reader
+	if in.ContentLength != 0 && in.Body != nil {
+		body = in.Body
+	}
+	out, err := http.NewRequest(in.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	out = out.WithContext(in.Context())
+	out.ContentLength = in.ContentLength
+	if body == nil {
+		out.ContentLength = 0
+	}
+
+	config.Forwarding.copyHeaders(out.Header, in.Header, sessionCookie)
+	if clientIP, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if prior, ok := in.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	out.Header.Set("X-Forwarded-Host", in.Host)
+	return out, nil
+}
+
+// copyResponse writes the upstream status, headers and body to the client,
+// flushing as data arrives so large listings are not buffered
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	if c := resp.Header.Get("Connection"); c != "" {
+		for _, h := range strings.Split(c, ",") {
+			resp.Header.Del(strings.TrimSpace(h))
+		}
+	}
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	buf := make([]byte, 32*1024)
+	flusher, _ := w.(http.Flusher)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// forward sends one attempt of the request to a destination picked by the
+// route's balancer, through the destination's circuit breaker
+func forward(config routedetail, r apiRequest) (*http.Response, error) {
+	target := config.balancer.pick(r)
+	if target == nil {
+		return nil, config.balancer.unavailable(config.Api)
+	}
+	req, err := newUpstreamRequest(target.url, config, r.httpreq, r.sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&target.active, 1)
+	response, err := target.call(r.httpreq.Context(), proxyCall{transport: config.transport, req: req})
+	if e, ok := err.(gatewayError); ok {
+		response, err = e.resp, nil
+	}
+	if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+		atomic.AddInt64(&target.active, -1)
+		return nil, &apiError{status: http.StatusServiceUnavailable, Code: "circuit_open", Message: "destination " + target.url + " is unavailable, circuit breaker open", Route: config.Api,
+			RetryAfter: target.retryAfter(time.Now())}
+	}
+	resp, _ := response.(*http.Response)
+	config.balancer.report(target, resp, err)
+	if err != nil {
+		atomic.AddInt64(&target.active, -1)
+		return nil, &apiError{status: http.StatusBadGateway, Code: "bad_gateway", Message: "upstream request failed: " + err.Error(), Route: config.Api}
+	}
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, upstream: target}
+	return resp, nil
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisBackend stores sessions in Redis with native key expiry
+type redisBackend struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func newRedisBackend(address, password string, database int, prefix string) *redisBackend {
+	return &redisBackend{
+		pool: &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address,
+					redis.DialPassword(password),
+					redis.DialDatabase(database),
+					redis.DialConnectTimeout(5*time.Second),
+					redis.DialReadTimeout(5*time.Second),
+					redis.DialWriteTimeout(5*time.Second))
+			},
+		},
+		prefix: prefix + ":",
+	}
+}
+
+func (b *redisBackend) get(key string) ([]byte, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	value, err := redis.Bytes(conn.Do("GET", b.prefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (b *redisBackend) set(key string, value []byte, ttl time.Duration) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	var err error
+	if ttl > 0 {
+		_, err = conn.Do("SET", b.prefix+key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", b.prefix+key, value)
+	}
+	return err
+}
+
+func (b *redisBackend) create(key string, value []byte, ttl time.Duration) (bool, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	var err error
+	if ttl > 0 {
+		_, err = redis.String(conn.Do("SET", b.prefix+key, value, "PX", int64(ttl/time.Millisecond), "NX"))
+	} else {
+		_, err = redis.String(conn.Do("SET", b.prefix+key, value, "NX"))
+	}
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// replace watches the key while it compares its value, the transaction
+// setting the new value is not run when the key changes in between
+func (b *redisBackend) replace(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("WATCH", b.prefix+key); err != nil {
+		return false, err
+	}
+	current, err := redis.Bytes(conn.Do("GET", b.prefix+key))
+	if err == redis.ErrNil || err == nil && !bytes.Equal(current, old) {
+		_, err = conn.Do("UNWATCH")
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	conn.Send("MULTI")
+	if ttl > 0 {
+		conn.Send("SET", b.prefix+key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		conn.Send("SET", b.prefix+key, value)
+	}
+	// EXEC answers nil when the transaction was not run
+	reply, err := conn.Do("EXEC")
+	return reply != nil && err == nil, err
+}
+
+// list scans the keyspace, so it is meant for the rare administrative requests
+func (b *redisBackend) list(prefix string) (map[string][]byte, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	result := make(map[string][]byte)
+	pattern := redisGlobEscaper.Replace(b.prefix+prefix) + "*"
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			args := redis.Args{}.AddFlat(keys)
+			values, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return nil, err
+			}
+			for i, value := range values {
+				// keys that expired since the scan come back nil
+				if value != nil {
+					result[strings.TrimPrefix(keys[i], b.prefix)] = value
+				}
+			}
+		}
+		if cursor == 0 {
+			return result, nil
+		}
+	}
+}
+
+// redisGlobEscaper quotes the glob characters of a SCAN pattern
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (b *redisBackend) delete(key string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", b.prefix+key)
+	return err
+}
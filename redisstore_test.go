@@ -0,0 +1,285 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking the subset of the Redis
+// protocol the redis backend uses
+type fakeRedis struct {
+	listener net.Listener
+
+	mtx     sync.Mutex
+	entries map[string]fakeRedisEntry
+	// versions count the changes of each key, for WATCH
+	versions map[string]int
+}
+
+// fakeRedisConn is the transaction state of a connection
+type fakeRedisConn struct {
+	watched map[string]int
+	multi   bool
+	queued  [][]string
+}
+
+type fakeRedisEntry struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedis(t testing.TB) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, entries: make(map[string]fakeRedisEntry), versions: make(map[string]int)}
+	go r.serve()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	state := &fakeRedisConn{}
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mtx.Lock()
+		reply := r.transact(state, args)
+		r.mtx.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func respBulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func respArray(items []string) string {
+	reply := "*" + strconv.Itoa(len(items)) + "\r\n"
+	for _, item := range items {
+		reply += item
+	}
+	return reply
+}
+
+const respNil = "$-1\r\n"
+
+// transact runs a command of the connection, queueing it inside MULTI. The
+// caller holds the lock.
+func (r *fakeRedis) transact(state *fakeRedisConn, args []string) string {
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "WATCH":
+		if state.watched == nil {
+			state.watched = make(map[string]int)
+		}
+		for _, key := range args[1:] {
+			r.lookup(key)
+			state.watched[key] = r.versions[key]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		state.watched = nil
+		return "+OK\r\n"
+	case "MULTI":
+		state.multi = true
+		return "+OK\r\n"
+	case "DISCARD":
+		state.multi, state.queued, state.watched = false, nil, nil
+		return "+OK\r\n"
+	case "EXEC":
+		queued, watched := state.queued, state.watched
+		state.multi, state.queued, state.watched = false, nil, nil
+		for key, version := range watched {
+			if r.lookup(key); r.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+		var replies []string
+		for _, args := range queued {
+			replies = append(replies, r.do(strings.ToUpper(args[0]), args[1:]))
+		}
+		return respArray(replies)
+	}
+	if state.multi {
+		state.queued = append(state.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return r.do(command, args[1:])
+}
+
+// lookup returns the live entry of the key, the caller holds the lock
+func (r *fakeRedis) lookup(key string) (fakeRedisEntry, bool) {
+	entry, ok := r.entries[key]
+	if ok && !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(r.entries, key)
+		r.versions[key]++
+		return entry, false
+	}
+	return entry, ok
+}
+
+func (r *fakeRedis) do(command string, args []string) string {
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		entry, ok := r.lookup(args[0])
+		if !ok {
+			return respNil
+		}
+		return respBulk(entry.value)
+	case "SET":
+		return r.set(args)
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			if _, ok := r.lookup(key); ok {
+				delete(r.entries, key)
+				r.versions[key]++
+				deleted++
+			}
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	case "MGET":
+		var items []string
+		for _, key := range args {
+			if entry, ok := r.lookup(key); ok {
+				items = append(items, respBulk(entry.value))
+			} else {
+				items = append(items, respNil)
+			}
+		}
+		return respArray(items)
+	case "SCAN":
+		// every match is returned at once with cursor 0
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range r.entries {
+			if _, ok := r.lookup(key); ok && globMatch(pattern, key) {
+				keys = append(keys, respBulk(key))
+			}
+		}
+		return respArray([]string{respBulk("0"), respArray(keys)})
+	}
+	return "-ERR unknown command '" + command + "'\r\n"
+}
+
+func (r *fakeRedis) set(args []string) string {
+	key, value := args[0], args[1]
+	var expires time.Time
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "PX":
+			ms, _ := strconv.Atoi(args[i+1])
+			expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			i++
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		}
+	}
+	_, exists := r.lookup(key)
+	if nx && exists || xx && !exists {
+		return respNil
+	}
+	r.entries[key] = fakeRedisEntry{value: value, expires: expires}
+	r.versions[key]++
+	return "+OK\r\n"
+}
+
+// globMatch matches a SCAN pattern with *, ? and backslash escapes
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
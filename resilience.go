@@ -0,0 +1,153 @@
+package session
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/sony/gobreaker"
+	"golang.org/x/net/context"
+)
+
+// timeoutconfig bounds upstream calls, in seconds. Read is the time allowed
+// for the response headers; the streamed body is not limited.
+type timeoutconfig struct {
+	Connect int `json:"connect"`
+	Read    int `json:"read"`
+}
+
+// retryconfig retries failed calls of idempotent requests without a body
+type retryconfig struct {
+	Attempts  int `json:"attempts"`
+	BackoffMs int `json:"backoff_ms"`
+}
+
+// breakerconfig opens the circuit of a destination after Failures consecutive
+// failures and lets a trial request through after Open seconds
+type breakerconfig struct {
+	Failures uint32 `json:"failures"`
+	Open     int    `json:"open"`
+}
+
+// withDefaults fills in the settings left out of the configuration
+func (c breakerconfig) withDefaults() breakerconfig {
+	if c.Failures == 0 {
+		c.Failures = 5
+	}
+	if c.Open <= 0 {
+		c.Open = 30
+	}
+	return c
+}
+
+// idempotentMethods may be sent again after a failure
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+
+// newRouteTransport returns the transport of a route, with its timeouts
+func newRouteTransport(config timeoutconfig) http.RoundTripper {
+	connect := time.Duration(config.Connect) * time.Second
+	if connect <= 0 {
+		connect = 5 * time.Second
+	}
+	read := time.Duration(config.Read) * time.Second
+	if read <= 0 {
+		read = 30 * time.Second
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  (&net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}).Dial,
+		ResponseHeaderTimeout: read,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// proxyCall is the request of a destination's circuit breaker endpoint
+type proxyCall struct {
+	transport http.RoundTripper
+	req       *http.Request
+}
+
+// gatewayError makes the breaker count a gateway status as a failure while
+// the response itself is still returned to the client
+type gatewayError struct {
+	resp *http.Response
+}
+
+func (e gatewayError) Error() string {
+	return "upstream returned " + e.resp.Status
+}
+
+// newBreakerEndpoint wraps the upstream round trip in go-kit's gobreaker
+// middleware. opened is told until when the circuit stays open each time it
+// opens.
+func newBreakerEndpoint(name string, config breakerconfig, opened func(until time.Time)) (endpoint.Endpoint, *gobreaker.CircuitBreaker) {
+	config = config.withDefaults()
+	failures := config.Failures
+	open := time.Duration(config.Open) * time.Second
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    name,
+		Timeout: open,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= failures
+		},
+		OnStateChange: func(_ string, _, to gobreaker.State) {
+			if to == gobreaker.StateOpen {
+				opened(time.Now().Add(open))
+			}
+		},
+	})
+	roundtrip := func(_ context.Context, request interface{}) (interface{}, error) {
+		call := request.(proxyCall)
+		resp, err := call.transport.RoundTrip(call.req)
+		if err != nil {
+			return nil, err
+		}
+		if isGatewayStatus(resp.StatusCode) {
+			return resp, gatewayError{resp}
+		}
+		return resp, nil
+	}
+	return circuitbreaker.Gobreaker(cb)(roundtrip), cb
+}
+
+func isGatewayStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// retryable reports whether a failed attempt may be sent again
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		e, ok := err.(*apiError)
+		return ok && (e.Code == "bad_gateway" || e.Code == "circuit_open")
+	}
+	return isGatewayStatus(resp.StatusCode)
+}
+
+// attempts returns how many times the request may be sent on the route
+func (c retryconfig) attempts(r *http.Request) int {
+	if c.Attempts <= 1 || contains(idempotentMethods, r.Method) < 0 || r.ContentLength != 0 {
+		return 1
+	}
+	return c.Attempts
+}
+
+// wait sleeps for an exponential backoff with jitter before the given retry.
+// It returns false when the client went away in the meantime.
+func (c retryconfig) wait(ctx context.Context, retry int) bool {
+	backoff := time.Duration(c.BackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	backoff <<= uint(retry - 1)
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// rewriterule maps the client path to the destination path. The prefix is
+// stripped first, then the regular expression is applied and the new prefix
+// is added last.
+type rewriterule struct {
+	StripPrefix string `json:"strip_prefix"`
+	AddPrefix   string `json:"add_prefix"`
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	regex       *regexp.Regexp
+}
+
+func (rw *rewriterule) compile() error {
+	if rw.StripPrefix != "" && !strings.HasPrefix(rw.StripPrefix, "/") {
+		return fmt.Errorf("strip_prefix %q must start with /", rw.StripPrefix)
+	}
+	if rw.AddPrefix != "" && !strings.HasPrefix(rw.AddPrefix, "/") {
+		return fmt.Errorf("add_prefix %q must start with /", rw.AddPrefix)
+	}
+	if rw.Regex == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(rw.Regex)
+	if err != nil {
+		return fmt.Errorf("bad rewrite regex: %v", err)
+	}
+	rw.regex = regex
+	return nil
+}
+
+// apply returns the escaped destination path for the client path
+func (rw rewriterule) apply(p string) string {
+	if strip := strings.TrimSuffix(rw.StripPrefix, "/"); strip != "" && strings.HasPrefix(p, strip) {
+		if len(p) == len(strip) || p[len(strip)] == '/' {
+			p = p[len(strip):]
+		}
+	}
+	if rw.regex != nil {
+		p = rw.regex.ReplaceAllString(p, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		p = strings.TrimSuffix(rw.AddPrefix, "/") + p
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
@@ -0,0 +1,246 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// route match kinds, in increasing order of precedence when two routes match
+// the same number of literal characters
+var matchKinds = []string{"prefix", "glob", "template", "exact"}
+
+// routematcher is the compiled form of a route's api pattern
+type routematcher struct {
+	kind     string
+	pattern  string
+	segments []segment
+	// literal is the number of literal characters in the pattern, the route
+	// with the most literal characters wins
+	literal int
+	rank    int
+}
+
+// segment is one path segment of a pattern. rest matches any remaining segments.
+type segment struct {
+	literal string
+	wild    bool
+	rest    bool
+}
+
+func compileRoute(kind, pattern string) (*routematcher, error) {
+	if kind == "" {
+		kind = "prefix"
+	}
+	rank := -1
+	for i, k := range matchKinds {
+		if k == kind {
+			rank = i
+		}
+	}
+	if rank < 0 {
+		return nil, fmt.Errorf("unknown match kind %q", kind)
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("pattern must start with /")
+	}
+
+	m := &routematcher{kind: kind, pattern: pattern, rank: rank}
+	parts := strings.Split(pattern[1:], "/")
+	for i, part := range parts {
+		last := i == len(parts)-1
+		var seg segment
+		switch kind {
+		case "exact":
+			seg.literal = part
+		case "prefix":
+			if last && part == "" {
+				seg.rest = true
+			} else {
+				seg.literal = part
+			}
+		case "glob":
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("bad glob segment %q", part)
+			}
+			seg.literal = part
+			seg.wild = strings.ContainsAny(part, "*?[\\")
+		case "template":
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				name := part[1 : len(part)-1]
+				if strings.HasSuffix(name, "...") {
+					if !last {
+						return nil, fmt.Errorf("%s must be the last segment", part)
+					}
+					name = strings.TrimSuffix(name, "...")
+					seg.rest = true
+				} else {
+					seg.wild = true
+				}
+				if name == "" {
+					return nil, fmt.Errorf("template segment %q has no name", part)
+				}
+			} else if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("bad template segment %q", part)
+			} else {
+				seg.literal = part
+			}
+		}
+		m.segments = append(m.segments, seg)
+		if !seg.wild && !seg.rest {
+			m.literal += len(seg.literal) + 1
+		}
+	}
+	// a prefix without trailing slash also covers the sub paths
+	if kind == "prefix" && !m.segments[len(m.segments)-1].rest {
+		m.segments = append(m.segments, segment{rest: true})
+	}
+	return m, nil
+}
+
+// match reports whether the request path matches the pattern
+func (m *routematcher) match(p string) bool {
+	switch m.kind {
+	case "exact":
+		return p == m.pattern
+	case "prefix":
+		if !strings.HasPrefix(p, m.pattern) {
+			return false
+		}
+		return strings.HasSuffix(m.pattern, "/") || len(p) == len(m.pattern) || p[len(m.pattern)] == '/'
+	case "glob":
+		ok, _ := path.Match(m.pattern, p)
+		return ok
+	}
+
+	parts := strings.Split(p[1:], "/")
+	for i, seg := range m.segments {
+		if seg.rest {
+			return true
+		}
+		if i >= len(parts) {
+			return false
+		}
+		if seg.wild {
+			if parts[i] == "" {
+				return false
+			}
+		} else if parts[i] != seg.literal {
+			return false
+		}
+	}
+	return len(parts) == len(m.segments)
+}
+
+// outranks reports whether m takes precedence over o when both match
+func (m *routematcher) outranks(o *routematcher) bool {
+	if m.literal != o.literal {
+		return m.literal > o.literal
+	}
+	return m.rank > o.rank
+}
+
+// overlaps reports whether some path could match both patterns
+func (m *routematcher) overlaps(o *routematcher) bool {
+	return segmentsOverlap(m.segments, o.segments)
+}
+
+func segmentsOverlap(a, b []segment) bool {
+	if (len(a) > 0 && a[0].rest) || (len(b) > 0 && b[0].rest) {
+		return true
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	if !a[0].overlaps(b[0]) {
+		return false
+	}
+	return segmentsOverlap(a[1:], b[1:])
+}
+
+func (s segment) overlaps(o segment) bool {
+	switch {
+	case !s.wild && !o.wild:
+		return s.literal == o.literal
+	case s.wild && o.wild:
+		// compare the literal text in front of the first glob character
+		sp, op := globPrefix(s.literal), globPrefix(o.literal)
+		return strings.HasPrefix(sp, op) || strings.HasPrefix(op, sp)
+	case s.wild:
+		ok, _ := path.Match(s.literal, o.literal)
+		return ok || s.literal == ""
+	}
+	ok, _ := path.Match(o.literal, s.literal)
+	return ok || o.literal == ""
+}
+
+func globPrefix(s string) string {
+	if i := strings.IndexAny(s, "*?[\\{"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// compileRoutes compiles every route, registers its destinations and orders
+// the routes by precedence. Invalid patterns and overlapping routes that precedence cannot tell apart are
+// reported together.
+func compileRoutes(routes []routedetail, upstreams *upstreamRegistry) ([]routedetail, error) {
+	var problems []string
+	for i := range routes {
+		m, err := compileRoute(routes[i].Match, routes[i].Api)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("route %q: %v", routes[i].Api, err))
+			continue
+		}
+		routes[i].matcher = m
+		if err := routes[i].Rewrite.compile(); err != nil {
+			problems = append(problems, fmt.Sprintf("route %q: %v", routes[i].Api, err))
+		}
+		if routes[i].balancer, err = newBalancer(routes[i], upstreams); err != nil {
+			problems = append(problems, fmt.Sprintf("route %q: %v", routes[i].Api, err))
+		}
+		routes[i].transport = newRouteTransport(routes[i].Timeouts)
+		if err := routes[i].validateTenantScope(); err != nil {
+			problems = append(problems, fmt.Sprintf("route %q: %v", routes[i].Api, err))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("invalid api configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	for i := range routes {
+		for j := i + 1; j < len(routes); j++ {
+			a, b := routes[i], routes[j]
+			if a.matcher.outranks(b.matcher) || b.matcher.outranks(a.matcher) {
+				continue
+			}
+			if !a.matcher.overlaps(b.matcher) {
+				continue
+			}
+			if common := commonMethods(a.Methods, b.Methods); len(common) > 0 {
+				problems = append(problems, fmt.Sprintf("%s route %q and %s route %q are ambiguous for %s",
+					a.matcher.kind, a.Api, b.matcher.kind, b.Api, strings.Join(common, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("invalid api configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].matcher.outranks(routes[j].matcher)
+	})
+	return routes, nil
+}
+
+func commonMethods(a, b []string) []string {
+	var common []string
+	for _, method := range a {
+		if contains(b, method) >= 0 {
+			common = append(common, method)
+		}
+	}
+	return common
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testAPIConfig(t *testing.T, routes []routedetail) *apiConfig {
+	for i := range routes {
+		if routes[i].Destination == "" {
+			routes[i].Destination = "http://127.0.0.1:9999"
+		}
+	}
+	routes, err := compileRoutes(routes, newUpstreamRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{routelist: routes, upstreams: newUpstreamRegistry()}
+}
+
+func TestValidateapi(t *testing.T) {
+	config := testAPIConfig(t, []routedetail{
+		{Api: "/api/v1/", Methods: []string{"GET", "POST", "DELETE"}},
+		{Api: "/api/v1/inspect/", Methods: []string{"GET"}},
+		{Api: "/api/v1/globals/", Match: "exact", Methods: []string{"GET"}},
+		{Api: "/api/v1/globals/", Match: "exact", Methods: []string{"PUT"}, Destination: "http://127.0.0.1:9998"},
+	})
+
+	tests := []struct {
+		method, path string
+		route        string
+		status       int
+		allow        []string
+	}{
+		{"GET", "/api/v1/networks/", "/api/v1/", 0, nil},
+		{"DELETE", "/api/v1/networks/t:n/", "/api/v1/", 0, nil},
+		{"GET", "/api/v1/inspect/networks/t:n/", "/api/v1/inspect/", 0, nil},
+		{"DELETE", "/api/v1/inspect/networks/t:n/", "/api/v1/inspect/", 405, []string{"GET"}},
+		{"PUT", "/api/v1/globals/", "/api/v1/globals/", 0, nil},
+		{"POST", "/api/v1/globals/", "/api/v1/globals/", 405, []string{"GET", "PUT"}},
+		{"GET", "/other/", "", 404, nil},
+	}
+	for _, tt := range tests {
+		route, err := validateapi(config, apiRequest{httpreq: httptest.NewRequest(tt.method, tt.path, nil)})
+		if route.Api != tt.route {
+			t.Errorf("%s %s: route %q, want %q", tt.method, tt.path, route.Api, tt.route)
+		}
+		switch {
+		case tt.status == 0 && err != nil:
+			t.Errorf("%s %s: %v", tt.method, tt.path, err)
+		case tt.status == 404 && err != ErrNotFound:
+			t.Errorf("%s %s: error %v, want not found", tt.method, tt.path, err)
+		case tt.status == 405:
+			apierr, ok := err.(*apiError)
+			if !ok || apierr.status != 405 || !reflect.DeepEqual(apierr.Allow, tt.allow) {
+				t.Errorf("%s %s: error %#v, want 405 allowing %v", tt.method, tt.path, err, tt.allow)
+			}
+		}
+	}
+}
+
+func TestGetApiConfigMissingFile(t *testing.T) {
+	if _, err := GetApiConfig(filepath.Join(t.TempDir(), "apiconfig.json"), nil); err == nil {
+		t.Fatal("a missing api config file was accepted")
+	}
+}
+
+func TestShippedAPIConfig(t *testing.T) {
+	config, err := GetApiConfig("apiconfig.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, upstream string
+	}{
+		{"/storage/volumes/vol1", "/volumes/vol1"},
+		{"/cluster/globals", "/globals"},
+		{"/api/v1/networks/default:net1/", "/api/v1/networks/default:net1/"},
+	}
+	for _, tt := range tests {
+		route, err := validateapi(config, apiRequest{httpreq: httptest.NewRequest("GET", tt.path, nil)})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if upstream := route.Rewrite.apply(tt.path); upstream != tt.upstream {
+			t.Errorf("%s is forwarded as %s, want %s", tt.path, upstream, tt.upstream)
+		}
+	}
+}
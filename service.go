@@ -1,28 +1,58 @@
 package session
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
-	"sync"
 	"time"
-	"errors"
-	"strings"
 
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"golang.org/x/net/context"
-
-	"io/ioutil"
-	"encoding/json"
-	"bytes"
-	"github.com/shampur/etcdstore"
 )
 
 //Service Interface of session manager
 type Service interface {
 	login(ctx context.Context, req LoginRequest) (LoginResponse, error)
+	verifymfa(ctx context.Context, req MFARequest) (LoginResponse, error)
+	oidclogin(ctx context.Context, req oidcRequest) (redirectResponse, error)
+	oidccallback(ctx context.Context, req oidcRequest) (redirectResponse, error)
 	logout(ctx context.Context, req LogoutRequest) (LogoutResponse, error)
 	validateapp(ctx context.Context, req validateAppRequest) (LoginResponse, error)
 	apiprocess(ctx context.Context, req apiRequest)  (interface{}, error)
+	upstreamstatus(ctx context.Context, req adminRequest) ([]upstreamStatus, error)
+	authmodulestatus(ctx context.Context, req adminRequest) ([]authModuleStatus, error)
+	listsessions(ctx context.Context, req adminRequest) ([]sessionInfo, error)
+	revokesession(ctx context.Context, req adminRequest) (revokeResponse, error)
+	revokeusersessions(ctx context.Context, req adminRequest) (revokeResponse, error)
+	unlock(ctx context.Context, req adminRequest) (unlockResponse, error)
+	stats(ctx context.Context) (serviceStats, error)
+	// Close stops the background work of the service
+	Close() error
+}
+
+//adminRequest is an administrative request, only allowed for admin sessions
+type adminRequest struct {
+	httpreq *http.Request
+	// id, username and ip select what session and lockout admin requests act on
+	id       string
+	username string
+	ip       string
+}
+
+// unlockResponse reports whether a lockout or failure counter was cleared
+type unlockResponse struct {
+	Unlocked bool `json:"unlocked"`
+}
+
+// revokeResponse reports how many sessions were revoked
+type revokeResponse struct {
+	Revoked int `json:"revoked"`
 }
 
 //validate app request
@@ -33,7 +63,10 @@ type validateAppRequest struct {
 
 type apiRequest struct {
 	httpreq *http.Request
-	data interface{}
+	// username is set once the session is validated
+	username string
+	// sessionCookie names the session cookie, which is never sent upstream
+	sessionCookie string
 }
 
 //LogoutRequest
@@ -57,8 +90,47 @@ type LoginResponse struct {
 	Authenticated bool              `json:"authenticated"`
 	Message       string            `json:"message"`
 	Username      string		`json:"username"`
+	Roles         []string          `json:"roles"`
+	// ExpiresAt is when the session ends unless renewed, ExpiresIn the seconds left
+	ExpiresAt     string            `json:"expires_at,omitempty"`
+	ExpiresIn     int               `json:"expires_in,omitempty"`
+	// MFARequired is set when the password was accepted and the login waits
+	// for the second factor
+	MFARequired   bool              `json:"mfa_required,omitempty"`
+	// CSRFToken must be sent back on unsafe proxied requests
+	CSRFToken     string            `json:"csrf_token,omitempty"`
 	Session       *sessions.Session `json:"session"`
 	Httpreq       *http.Request     `json:"httpreq"`
+	// Organization the user logged in to and its Contiv tenant
+	Organization  string            `json:"organization,omitempty"`
+	Tenant        string            `json:"tenant,omitempty"`
+	// renewed is set when the request was recorded as activity
+	renewed       bool
+	// module names the authentication modules that accepted the user
+	module        string
+}
+
+// MFARequest carries the TOTP code or a recovery code of the second login step
+type MFARequest struct {
+	httpreq      *http.Request
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// oidcRequest is a step of the OpenID Connect login in the browser, the
+// callback carries the provider's code and state or error
+type oidcRequest struct {
+	httpreq *http.Request
+	Code    string
+	State   string
+	Error   string
+}
+
+// redirectResponse sends the browser to Location after saving the session
+type redirectResponse struct {
+	Location string
+	Session  *sessions.Session
+	Httpreq  *http.Request
 }
 
 //Credentials object of the user
@@ -68,57 +140,126 @@ type Credentials struct {
 	Organization string `json:"organization"`
 }
 
+// authValues are the session values describing the logged in user. They are
+// dropped when a new session ID is issued at login, other values carry over.
+var authValues = []string{"Username", "Roles", "CreatedAt", "LastActivity", "ClientIP", "UserAgent", "CSRFToken",
+	"AuthModule", "Organization", "Tenant",
+	"MFAPending", "MFARoles", "MFAModule", "MFAOrganization", "MFATenant", "MFAExpires", "OIDCState", "OIDCNonce", "OIDCVerifier", "OIDCExpires"}
+
 type sessionService struct {
-	mtx         	sync.RWMutex
-	store       	*etcdstore.EtcdStore
+	store       	SessionStore
 	authmanager 	*AuthManager
 	apiconfig	*apiConfig
+	config		Config
+	logger		log.Logger
+	auditlog	*auditLog
+	// csrfExempt matches the paths that do not require the CSRF token
+	csrfExempt	[]*routematcher
 }
 
 type apiresponse struct {
 	sessresponse	LoginResponse
-	result 		interface{}
+	result 		*http.Response
+	// route is the api of the matched route, empty when none matched
+	route		string
+}
+
+// serviceStats are polled for the metrics gauges
+type serviceStats struct {
+	// sessions counts the active sessions by organization
+	sessions map[string]int
+	modules  []authModuleStatus
 }
 
 
 //NewSessionService contains the session store
-func NewSessionService() Service {
-	return &sessionService{
-		store:       	etcdstore.NewEtcdStore([]string{"http://127.0.0.1:2379"}, "contivSession", []byte("something-very-secret")),
-		authmanager: 	NewAuthmanager(),
-		apiconfig: 	GetApiConfig(),
+func NewSessionService(config Config, logger log.Logger) (Service, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	secret := []byte(config.Session.Secret)
+	if len(secret) == 0 {
+		warnLog(logger).Log("msg", "no session secret configured, sessions will not survive a restart")
+		secret = securecookie.GenerateRandomKey(32)
 	}
+	backend, err := newBackend(config.Store)
+	if err != nil {
+		return nil, err
+	}
+	apiconfig, err := GetApiConfig(config.APIConfigFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	auditlog, err := newAuditLog(config.Audit.File)
+	if err != nil {
+		return nil, err
+	}
+	var exempt []*routematcher
+	for _, path := range config.CSRF.ExemptPaths {
+		m, err := compileRoute("prefix", path)
+		if err != nil {
+			return nil, err
+		}
+		exempt = append(exempt, m)
+	}
+	store := newKVStore(backend, secret)
+	store.Options.Secure = config.Session.CookieSecure
+	store.legacy = legacyEtcdStore(config.Store)
+	return &sessionService{
+		store:       	store,
+		authmanager: 	NewAuthmanager(config, backend, logger),
+		apiconfig: 	apiconfig,
+		config:		config,
+		logger:		logger,
+		auditlog:	auditlog,
+		csrfExempt:	exempt,
+	}, nil
 }
 
 func (s *sessionService) login(ctx context.Context, r LoginRequest) (LoginResponse, error) {
-	fmt.Println("Login service called")
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	logger := s.requestLogger(ctx)
 	var res LoginResponse
-	session, err := s.store.Get(r.httpreq, "contiv-session")
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
 
 	if err != nil {
-		fmt.Println("error while retrieving session info")
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
 		return LoginResponse{}, err
 	}
 
-	if !session.IsNew {
-		res, err = validate(session)
-		if err != nil {
+	// the credentials are always checked, a session presented with them is
+	// never promoted to the authenticated one
+	res, err = s.authmanager.authenticate(r.cred, clientIP(r.httpreq))
+	if err != nil {
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Username: r.cred.Username, Organization: r.cred.Organization, Reason: auditReason(err)})
+		return LoginResponse{}, err
+	}
+	switch {
+	case res.Authenticated && res.MFARequired:
+		// the password is right, the session only waits for the second factor
+		if err := s.store.regenerate(session); err != nil {
 			return LoginResponse{}, err
 		}
-		if res.Authenticated != true {
-			res, err = s.authmanager.authenticate(r.cred)
+		for _, key := range authValues {
+			delete(session.Values, key)
 		}
-	} else {
-		res, err = s.authmanager.authenticate(r.cred)
-	}
-	if res.Authenticated {
-		session.Values["Username"] = r.cred.Username
-		session.Values["LastLoginTime"] = time.Now().Format(time.RFC3339)
-		res.Username = r.cred.Username
-		fmt.Println("Authenticated")
-	} else {
+		session.Values["MFAPending"] = r.cred.Username
+		session.Values["MFARoles"] = res.Roles
+		session.Values["MFAModule"] = res.module
+		session.Values["MFAOrganization"] = res.Organization
+		session.Values["MFATenant"] = res.Tenant
+		session.Values["MFAExpires"] = time.Now().Add(time.Duration(s.config.MFA.PendingTimeout) * time.Second).Format(time.RFC3339)
+		session.Options.MaxAge = s.config.MFA.PendingTimeout
+		res = LoginResponse{Authenticated: false, MFARequired: true, Message: "mfa_required", Username: r.cred.Username}
+		infoLog(logger).Log("msg", "password accepted, waiting for the second factor", "username", r.cred.Username)
+	case res.Authenticated:
+		if err := s.establish(session, r.cred.Username, res.Roles, r.httpreq, &res); err != nil {
+			return LoginResponse{}, err
+		}
+		infoLog(logger).Log("msg", "authenticated", "username", r.cred.Username, "module", res.module, "organization", res.Organization)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLogin, Username: r.cred.Username, Organization: res.Organization, Module: res.module})
+	default:
+		infoLog(logger).Log("msg", "login refused", "username", r.cred.Username, "organization", r.cred.Organization)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Username: r.cred.Username, Organization: r.cred.Organization, Reason: res.Message})
 		session.Options.MaxAge = -1
 	}
 	res.Session = session
@@ -126,17 +267,169 @@ func (s *sessionService) login(ctx context.Context, r LoginRequest) (LoginRespon
 	return res, err
 }
 
+// verifymfa completes a login that is waiting for the second factor
+func (s *sessionService) verifymfa(ctx context.Context, r MFARequest) (LoginResponse, error) {
+	logger := s.requestLogger(ctx)
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
+	if err != nil {
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
+		return LoginResponse{}, err
+	}
+	username, _ := session.Values["MFAPending"].(string)
+	expires, _ := time.Parse(time.RFC3339, fmt.Sprint(session.Values["MFAExpires"]))
+	if session.IsNew || username == "" || !time.Now().Before(expires) {
+		session.Options.MaxAge = -1
+		return LoginResponse{Authenticated: false, Message: "No pending login", Session: session, Httpreq: r.httpreq}, nil
+	}
+
+	ok, err := s.authmanager.verifyMFA(username, r, clientIP(r.httpreq))
+	if err != nil {
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Username: username, Module: "totp", Reason: auditReason(err)})
+		return LoginResponse{}, err
+	}
+	res := LoginResponse{Authenticated: false, MFARequired: true, Message: "Invalid code", Username: username}
+	if ok {
+		roles, _ := session.Values["MFARoles"].([]string)
+		module, _ := session.Values["MFAModule"].(string)
+		res = LoginResponse{Authenticated: true, Message: "success", module: module + "+totp"}
+		res.Organization, _ = session.Values["MFAOrganization"].(string)
+		res.Tenant, _ = session.Values["MFATenant"].(string)
+		if err := s.establish(session, username, roles, r.httpreq, &res); err != nil {
+			return LoginResponse{}, err
+		}
+		infoLog(logger).Log("msg", "authenticated with second factor", "username", username, "module", res.module)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLogin, Username: username, Organization: res.Organization, Module: res.module})
+	} else {
+		infoLog(logger).Log("msg", "second factor refused", "username", username)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Username: username, Module: "totp", Reason: "invalid code"})
+		// keep the pending session until it expires
+		session.Options.MaxAge = int(math.Ceil(time.Until(expires).Seconds()))
+	}
+	res.Session = session
+	res.Httpreq = r.httpreq
+	return res, nil
+}
+
+// establish turns the session into an authenticated session of the user under
+// a new session ID. Values of the previous session other than authValues carry over.
+func (s *sessionService) establish(session *sessions.Session, username string, roles []string, r *http.Request, res *LoginResponse) error {
+	if err := s.store.regenerate(session); err != nil {
+		return err
+	}
+	for _, key := range authValues {
+		delete(session.Values, key)
+	}
+	now := time.Now()
+	session.Values["Username"] = username
+	session.Values["Roles"] = roles
+	session.Values["CreatedAt"] = now.Format(time.RFC3339)
+	session.Values["LastActivity"] = now.Format(time.RFC3339)
+	session.Values["ClientIP"] = clientIP(r)
+	session.Values["UserAgent"] = r.UserAgent()
+	session.Values["AuthModule"] = res.module
+	session.Values["Organization"] = res.Organization
+	session.Values["Tenant"] = res.Tenant
+	res.Username = username
+	res.Roles = roles
+	res.CSRFToken, _ = csrfToken(session)
+	expires, _ := s.expiry(now.Format(time.RFC3339), now.Format(time.RFC3339), now)
+	res.setExpiry(session, expires, now)
+	return nil
+}
+
+// oidclogin starts the OpenID Connect login. The state, nonce and PKCE
+// verifier are kept in the session until the provider redirects back.
+func (s *sessionService) oidclogin(ctx context.Context, r oidcRequest) (redirectResponse, error) {
+	provider := s.authmanager.redirectProvider()
+	if provider == nil {
+		return redirectResponse{}, ErrNotFound
+	}
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
+	if err != nil {
+		errorLog(s.requestLogger(ctx)).Log("msg", "session could not be loaded", "err", err)
+		return redirectResponse{}, err
+	}
+	state := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	nonce := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	verifier := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	challenge := sha256.Sum256([]byte(verifier))
+	location, err := provider.authURL(state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return redirectResponse{}, err
+	}
+	session.Values["OIDCState"] = state
+	session.Values["OIDCNonce"] = nonce
+	session.Values["OIDCVerifier"] = verifier
+	session.Values["OIDCExpires"] = time.Now().Add(oidcLoginTimeout).Format(time.RFC3339)
+	if session.IsNew {
+		session.Options.MaxAge = int(oidcLoginTimeout / time.Second)
+	}
+	return redirectResponse{Location: location, Session: session, Httpreq: r.httpreq}, nil
+}
+
+// oidccallback completes the OpenID Connect login and establishes the same
+// session as a password login
+func (s *sessionService) oidccallback(ctx context.Context, r oidcRequest) (redirectResponse, error) {
+	provider := s.authmanager.redirectProvider()
+	if provider == nil {
+		return redirectResponse{}, ErrNotFound
+	}
+	logger := s.requestLogger(ctx)
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
+	if err != nil {
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
+		return redirectResponse{}, err
+	}
+	state, _ := session.Values["OIDCState"].(string)
+	nonce, _ := session.Values["OIDCNonce"].(string)
+	verifier, _ := session.Values["OIDCVerifier"].(string)
+	expires, _ := time.Parse(time.RFC3339, fmt.Sprint(session.Values["OIDCExpires"]))
+	if state == "" || !time.Now().Before(expires) || subtle.ConstantTimeCompare([]byte(state), []byte(r.State)) != 1 {
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Module: "oidc", Reason: "oidc_state_invalid"})
+		return redirectResponse{}, &apiError{status: http.StatusBadRequest, Code: "oidc_state_invalid",
+			Message: "login expired or not started here, please sign in again"}
+	}
+	if r.Error != "" {
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Module: "oidc", Reason: r.Error})
+		return redirectResponse{}, &apiError{status: http.StatusUnauthorized, Code: "oidc_login_failed", Message: r.Error}
+	}
+
+	res, err := provider.exchange(r.Code, verifier, nonce)
+	if err != nil {
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Module: "oidc", Reason: auditReason(err)})
+		return redirectResponse{}, err
+	}
+	if !res.Authenticated {
+		infoLog(logger).Log("msg", "OpenID Connect login refused", "reason", res.Message)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLoginFailed, Module: "oidc", Reason: res.Message})
+		return redirectResponse{}, &apiError{status: http.StatusUnauthorized, Code: "oidc_login_failed", Message: res.Message}
+	}
+	if err := s.establish(session, res.Username, res.Roles, r.httpreq, &res); err != nil {
+		return redirectResponse{}, err
+	}
+	infoLog(logger).Log("msg", "authenticated with OpenID Connect", "username", res.Username)
+	s.audit(ctx, r.httpreq, AuditRecord{Event: auditLogin, Username: res.Username, Module: res.module})
+	location := s.config.OIDC.PostLoginRedirect
+	if location == "" {
+		location = "/"
+	}
+	return redirectResponse{Location: location, Session: session, Httpreq: r.httpreq}, nil
+}
+
 func (s *sessionService) logout(ctx context.Context, r LogoutRequest) (LogoutResponse, error) {
-	fmt.Println("Logout service called")
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	logger := s.requestLogger(ctx)
 	var res LogoutResponse
-	session, err := s.store.Get(r.httpreq, "contiv-session")
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
 
 	if err != nil {
-		fmt.Println("error while retrieving session info")
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
 		return LogoutResponse{}, err
 	}
+	if username, _ := session.Values["Username"].(string); username != "" {
+		infoLog(logger).Log("msg", "logged out", "username", username)
+		organization, _ := session.Values["Organization"].(string)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditLogout, Username: username, Organization: organization})
+	}
 
 	session.Options.MaxAge = -1
 	res.Session = session
@@ -146,26 +439,36 @@ func (s *sessionService) logout(ctx context.Context, r LogoutRequest) (LogoutRes
 }
 
 func (s *sessionService) validateapp(ctx context.Context, r validateAppRequest) (LoginResponse, error) {
-	fmt.Println("validate app request service called")
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	logger := s.requestLogger(ctx)
 	var res LoginResponse
-	session, err := s.store.Get(r.httpreq, "contiv-session")
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
 	if err != nil {
-		fmt.Println("error while retrieving session info")
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
 		return LoginResponse{}, err
 	}
 	if (session.IsNew) {
-		fmt.Println("session is new")
+		debugLog(logger).Log("msg", "no session")
 		res.Authenticated = false
 		res.Message = "Invalid Session validateapp"
 		session.Options.MaxAge = -1
+	} else if username, _ := session.Values["MFAPending"].(string); username != "" {
+		// a login waiting for the second factor is reported, not ended
+		res = LoginResponse{Authenticated: false, MFARequired: true, Message: "mfa_required", Username: username}
+		expires, _ := time.Parse(time.RFC3339, fmt.Sprint(session.Values["MFAExpires"]))
+		session.Options.MaxAge = int(math.Ceil(time.Until(expires).Seconds()))
 	} else {
-		fmt.Println("session is present")
-		res, err = validate(session)
+		// checking the session is not activity, so the UI can poll the
+		// remaining lifetime without extending it
+		res, err = s.validate(ctx, r.httpreq, session, false)
 		if res.Authenticated {
 			res.Username = session.Values["Username"].(string)
-			session.Values["LastLoginTime"] = time.Now().Format(time.RFC3339)
+			res.Roles = sessionRoles(session)
+			res.Organization, _ = session.Values["Organization"].(string)
+			res.Tenant, _ = session.Values["Tenant"].(string)
+			// sessions from before CSRF protection get their token here
+			res.CSRFToken, _ = csrfToken(session)
+		} else {
+			debugLog(logger).Log("msg", "session ended")
 		}
 	}
 
@@ -176,244 +479,385 @@ func (s *sessionService) validateapp(ctx context.Context, r validateAppRequest)
 }
 
 func (s *sessionService) apiprocess(ctx context.Context, r apiRequest) (interface{}, error) {
-	fmt.Println("apiget request handler")
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-
+	logger := s.requestLogger(ctx)
 	var apiresult apiresponse
-	session, err := s.store.Get(r.httpreq, "contiv-session")
+	r.sessionCookie = s.config.Session.Name
+	config, routeErr := validateapi(s.apiconfig, r)
+	apiresult.route = config.Api
+	session, err := s.store.Get(r.httpreq, s.config.Session.Name)
 	if err != nil {
-		fmt.Println("error while retrieving session")
+		errorLog(logger).Log("msg", "session could not be loaded", "err", err)
 		return apiresult, err
 	}
 
 	if session.IsNew {
-		fmt.Println("api-get session is new")
+		debugLog(logger).Log("msg", "no session", "method", r.httpreq.Method, "path", r.httpreq.URL.Path)
 		apiresult.sessresponse.Authenticated = false
 
 	} else {
-		apiresult.sessresponse, err = validate(session)
+		apiresult.sessresponse, err = s.validate(ctx, r.httpreq, session, true)
 		if apiresult.sessresponse.Authenticated {
-			fmt.Println("api process session is valid")
-			apiresult.result, err = apiexecute(s.apiconfig, r)
+			if err = s.checkCSRF(session, r.httpreq); err != nil {
+				return apiresult, err
+			}
+			if routeErr != nil {
+				return apiresult, routeErr
+			}
+			r.username, _ = session.Values["Username"].(string)
+			if contains(safeMethods, r.httpreq.Method) < 0 {
+				// state-changing calls are audited, whether refused or proxied
+				defer func() { s.auditCall(ctx, r, session, config, apiresult.result, err) }()
+			}
+			if err = authorize(config, r.httpreq.Method, sessionRoles(session)); err != nil {
+				return apiresult, err
+			}
+			tenant, _ := session.Values["Tenant"].(string)
+			var filter bool
+			if filter, err = checkTenant(config, r.httpreq, tenant); err != nil {
+				return apiresult, err
+			}
+			apiresult.result, err = apiexecute(config, r)
+			if err == nil && filter {
+				if err = filterTenant(config, apiresult.result, tenant); err != nil {
+					apiresult.result = nil
+				}
+			}
+			if apiresult.result != nil {
+				debugLog(logger).Log("msg", "proxied", "method", r.httpreq.Method, "route", config.Api, "path", r.httpreq.URL.Path,
+					"username", r.username, "status", apiresult.result.StatusCode)
+			}
+		} else {
+			debugLog(logger).Log("msg", "session ended", "method", r.httpreq.Method, "path", r.httpreq.URL.Path)
 		}
 
 	}
-	fmt.Println("The session max age = ", session.Options.MaxAge)
 	apiresult.sessresponse.Httpreq = r.httpreq
 	apiresult.sessresponse.Session = session
 	return apiresult, err
 }
 
-func apiexecute(apiconfig *apiConfig, r apiRequest) (interface{}, error) {
-
-	var result interface{}
+// apiexecute proxies the request to the route's destinations. Idempotent
+// requests are retried with backoff when the route allows it.
+func apiexecute(config routedetail, r apiRequest) (*http.Response, error) {
+	if err := config.Forwarding.checkContentType(config.Api, r.httpreq); err != nil {
+		return nil, err
+	}
+	var resp *http.Response
 	var err error
-
-	config, ok := validateapi(apiconfig, r)
-
-	if ok {
-		switch r.httpreq.Method {
-
-		case "GET": 	fmt.Println("The remote get call =", config.Destination + r.httpreq.URL.Path)
-				result, err = httpGet(config.Destination + r.httpreq.URL.Path)
-				return result, err
-		case "POST":	fmt.Println("The remote post call=", config.Destination + r.httpreq.URL.Path)
-				fmt.Println("r.data before post call=", r.data)
-				result, err = httpPost(config.Destination + r.httpreq.URL.Path, r.data)
-				return result, err
-		case "PUT":	fmt.Println("The remote Put call=", config.Destination + r.httpreq.URL.Path)
-				result, err = httpPut(config.Destination + r.httpreq.URL.Path, r.data)
-				return result, err
-		case "DELETE":	fmt.Println("The remote delete call =", config.Destination + r.httpreq.URL.Path)
-				err = httpDelete(config.Destination + r.httpreq.URL.Path)
-				return result, err
-
+	attempts := config.Retry.attempts(r.httpreq)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if !config.Retry.wait(r.httpreq.Context(), attempt) {
+				break
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+		}
+		resp, err = forward(config, r)
+		if !retryable(resp, err) {
+			break
 		}
 	}
-	return result, ErrNotFound
+	return resp, err
 }
 
-func validateapi(apiconfig *apiConfig, r apiRequest) (routedetail, bool) {
-	for _, element := range (apiconfig.routelist) {
-		if(strings.Contains(r.httpreq.URL.Path, element.Api)){
-			if(contains(element.Methods, r.httpreq.Method) >= 0){
-				return element, true
-			}
-		}
+func (s *sessionService) upstreamstatus(ctx context.Context, r adminRequest) ([]upstreamStatus, error) {
+	if _, err := s.requireAdmin(ctx, r.httpreq); err != nil {
+		return nil, err
 	}
-	return routedetail{}, false
+	return s.apiconfig.upstreams.status(), nil
 }
 
-func contains(list interface{}, item interface{}) int {
-	for index, element := range list.([]string) {
-		if element == item {
-			return index
-		}
+func (s *sessionService) authmodulestatus(ctx context.Context, r adminRequest) ([]authModuleStatus, error) {
+	if _, err := s.requireAdmin(ctx, r.httpreq); err != nil {
+		return nil, err
 	}
-	return -1
+	return s.authmanager.status(), nil
 }
 
-func httpGet(url string) (interface{}, error){
-
-	r, err := http.Get(url)
+func (s *sessionService) listsessions(ctx context.Context, r adminRequest) ([]sessionInfo, error) {
+	if _, err := s.requireAdmin(ctx, r.httpreq); err != nil {
+		return nil, err
+	}
+	list, err := s.store.list(r.username)
 	if err != nil {
 		return nil, err
 	}
-
-	defer r.Body.Close()
-
-	switch {
-	case r.StatusCode == int(404):
-		return nil, errors.New("Page not found!")
-	case r.StatusCode == int(403):
-		return nil, errors.New("Access denied!")
-	case r.StatusCode == int(500):
-		response, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
+	// the store may keep ended sessions until its next sweep
+	active := []sessionInfo{}
+	now := time.Now()
+	for _, info := range list {
+		if expires, ok := s.expiry(info.CreatedAt, info.LastActivity, now); ok && now.Before(expires) {
+			active = append(active, info)
 		}
-		return nil, errors.New(string(response))
-	case r.StatusCode != int(200):
-		return nil, errors.New(r.Status)
 	}
+	return active, nil
+}
 
-	response, err := ioutil.ReadAll(r.Body)
-
+func (s *sessionService) revokesession(ctx context.Context, r adminRequest) (revokeResponse, error) {
+	admin, err := s.requireAdmin(ctx, r.httpreq)
 	if err != nil {
-		return nil, err
+		return revokeResponse{}, err
 	}
-
-	return response, nil
-	//return r, nil
-}
-
-func httpPut(url string, jdata interface{}) (interface{}, error) {
-	buf, err := json.Marshal(jdata)
+	found, err := s.store.revoke(r.id)
 	if err != nil {
-		return nil, err
+		return revokeResponse{}, err
 	}
-	body := bytes.NewBuffer(buf)
-	req, err := http.NewRequest("PUT", url, body)
-
-	r, err := http.DefaultClient.Do(req)
-
-	defer r.Body.Close()
-
-	switch {
-	case r.StatusCode == int(404):
-		return nil, errors.New("Page not found!")
-	case r.StatusCode == int(403):
-		return nil, errors.New("Access denied!")
-	case r.StatusCode == int(500):
-		response, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(string(response))
-
-	case r.StatusCode != int(200):
-		return nil, errors.New(r.Status)
+	if !found {
+		return revokeResponse{}, ErrNotFound
 	}
+	infoLog(s.requestLogger(ctx)).Log("msg", "revoked session", "id", r.id)
+	s.audit(ctx, r.httpreq, AuditRecord{Event: auditSessionRevoked, Username: admin, Subject: r.id})
+	return revokeResponse{Revoked: 1}, nil
+}
 
-	response, err := ioutil.ReadAll(r.Body)
-
+func (s *sessionService) revokeusersessions(ctx context.Context, r adminRequest) (revokeResponse, error) {
+	admin, err := s.requireAdmin(ctx, r.httpreq)
 	if err != nil {
-		return nil, err
+		return revokeResponse{}, err
 	}
-	return response, nil
+	count, err := s.store.revokeUser(r.username)
+	if err != nil {
+		return revokeResponse{}, err
+	}
+	infoLog(s.requestLogger(ctx)).Log("msg", "revoked sessions of user", "username", r.username, "count", count)
+	s.audit(ctx, r.httpreq, AuditRecord{Event: auditUserRevoked, Username: admin, Subject: r.username})
+	return revokeResponse{Revoked: count}, nil
 }
 
-
-func httpPost(url string, jdata interface{}) (interface{}, error) {
-	buf, err := json.Marshal(jdata)
+func (s *sessionService) unlock(ctx context.Context, r adminRequest) (unlockResponse, error) {
+	admin, err := s.requireAdmin(ctx, r.httpreq)
 	if err != nil {
-		return nil, err
+		return unlockResponse{}, err
 	}
-
-	body := bytes.NewBuffer(buf)
-	r, err := http.Post(url, "application/json", body)
+	key := lockoutUserKey(r.username)
+	if r.ip != "" {
+		key = lockoutIPKey(r.ip)
+	}
+	unlocked, err := s.authmanager.throttle.unlock(key)
 	if err != nil {
-		fmt.Println("the error is =", err.Error())
-		return nil, err
+		return unlockResponse{}, err
 	}
-	defer r.Body.Close()
-
-	switch {
-	case r.StatusCode == int(404):
-		return nil, errors.New("Page not found!")
-	case r.StatusCode == int(403):
-		return nil, errors.New("Access denied!")
-	case r.StatusCode == int(500):
-		response, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
+	infoLog(s.requestLogger(ctx)).Log("msg", "unlocked", "username", r.username, "ip", r.ip, "unlocked", unlocked)
+	if unlocked {
+		subject := r.username
+		if r.ip != "" {
+			subject = r.ip
 		}
-		return nil, errors.New(string(response))
-
-	case r.StatusCode != int(200):
-		return nil, errors.New(r.Status)
+		s.audit(ctx, r.httpreq, AuditRecord{Event: auditUnlock, Username: admin, Subject: subject})
 	}
+	return unlockResponse{Unlocked: unlocked}, nil
+}
 
+// Close stops the upstream health checks and closes the audit log
+func (s *sessionService) Close() error {
+	s.apiconfig.upstreams.close()
+	return s.auditlog.close()
+}
 
-	response, err := ioutil.ReadAll(r.Body)
-
+// stats counts the active sessions and reads the auth module errors
+func (s *sessionService) stats(ctx context.Context) (serviceStats, error) {
+	list, err := s.store.list("")
 	if err != nil {
-		return nil, err
+		return serviceStats{}, err
 	}
-	return response, nil
+	// report organizations without sessions as 0 rather than leaving them out
+	sessions := map[string]int{"": 0}
+	for _, o := range s.config.Organizations {
+		sessions[o.Name] = 0
+	}
+	now := time.Now()
+	for _, info := range list {
+		if expires, ok := s.expiry(info.CreatedAt, info.LastActivity, now); ok && now.Before(expires) {
+			sessions[info.Organization]++
+		}
+	}
+	return serviceStats{sessions: sessions, modules: s.authmanager.status()}, nil
 }
 
-func httpDelete(url string) error {
+// requestLogger returns the service logger with the request ID of ctx
+func (s *sessionService) requestLogger(ctx context.Context) log.Logger {
+	return log.NewContext(s.logger).With(requestIDKey, requestID(ctx))
+}
+
+// audit records an event of the request. The request goes on when the audit
+// log can not be written.
+func (s *sessionService) audit(ctx context.Context, r *http.Request, record AuditRecord) {
+	record.ClientIP = clientIP(r)
+	record.RequestID = requestID(ctx)
+	if err := s.auditlog.record(record); err != nil {
+		errorLog(s.requestLogger(ctx)).Log("msg", "audit record could not be written", "event", record.Event, "err", err)
+	}
+}
 
-	req, err := http.NewRequest("DELETE", url, nil)
+// auditCall records a state-changing proxied call with the upstream status,
+// or the status it was refused with
+func (s *sessionService) auditCall(ctx context.Context, r apiRequest, session *sessions.Session, route routedetail, resp *http.Response, err error) {
+	record := AuditRecord{Event: auditAPICall, Username: r.username, Method: r.httpreq.Method, Route: route.Api, Path: r.httpreq.URL.Path}
+	record.Organization, _ = session.Values["Organization"].(string)
+	if resp != nil {
+		record.Status = resp.StatusCode
+	} else if err != nil {
+		record.Status = http.StatusBadGateway
+		if apierr, ok := err.(*apiError); ok {
+			record.Status = apierr.status
+		}
+		record.Reason = auditReason(err)
+	}
+	s.audit(ctx, r.httpreq, record)
+}
 
-	r, err := http.DefaultClient.Do(req)
+// clientIP returns the address of the client connection
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return err
+		return r.RemoteAddr
 	}
-	defer r.Body.Close()
+	return host
+}
 
-	switch {
-	case r.StatusCode == int(404):
-		return errors.New("Page not found!")
-	case r.StatusCode == int(403):
-		return errors.New("Access denied!")
-	case r.StatusCode == int(500):
-		response, err := ioutil.ReadAll(r.Body)
+// requireAdmin checks that the request carries a valid session with the admin
+// role, and the CSRF token when its method is unsafe, and returns the admin's
+// username
+func (s *sessionService) requireAdmin(ctx context.Context, r *http.Request) (string, error) {
+	session, err := s.store.Get(r, s.config.Session.Name)
+	if err != nil {
+		return "", err
+	}
+	if !session.IsNew {
+		res, err := s.validate(ctx, r, session, false)
 		if err != nil {
-			return err
+			return "", err
 		}
+		if res.Authenticated {
+			if err := s.checkCSRF(session, r); err != nil {
+				return "", err
+			}
+			if contains(sessionRoles(session), s.config.AdminRole) < 0 {
+				return "", &apiError{status: http.StatusForbidden, Code: "forbidden", Message: "admin role required", Roles: []string{s.config.AdminRole}}
+			}
+			// the admin API spans all organizations, tenant admins only
+			// administer their tenant through the proxied APIs
+			if tenant, _ := session.Values["Tenant"].(string); tenant != "" {
+				return "", &apiError{status: http.StatusForbidden, Code: "tenant_forbidden", Message: "not allowed outside tenant " + tenant}
+			}
+			username, _ := session.Values["Username"].(string)
+			return username, nil
+		}
+	}
+	return "", &apiError{status: http.StatusUnauthorized, Code: "unauthenticated", Message: "Invalid Session"}
+}
 
-		return errors.New(string(response))
-
-	case r.StatusCode != int(200):
-		return errors.New(r.Status)
+// validateapi returns the route for the request. Routes are kept in order of
+// precedence, so the first route matching the path is the most specific one
+// and only routes of the same precedence are told apart by their methods. A
+// method those routes do not allow is refused with 405 rather than proxied by
+// a less specific route. The route is returned with the error for the metrics.
+func validateapi(apiconfig *apiConfig, r apiRequest) (routedetail, error) {
+	var best *routedetail
+	var allowed []string
+	for i := range (apiconfig.routelist) {
+		element := &apiconfig.routelist[i]
+		if !element.matcher.match(r.httpreq.URL.Path) {
+			continue
+		}
+		if best == nil {
+			best = element
+		} else if best.matcher.outranks(element.matcher) {
+			break
+		}
+		if(contains(element.Methods, r.httpreq.Method) >= 0){
+			return *element, nil
+		}
+		allowed = append(allowed, element.Methods...)
 	}
+	if best == nil {
+		return routedetail{}, ErrNotFound
+	}
+	return *best, &apiError{
+		status:  http.StatusMethodNotAllowed,
+		Code:    "method_not_allowed",
+		Message: r.httpreq.Method + " is not allowed for " + best.Api,
+		Route:   best.Api,
+		Method:  r.httpreq.Method,
+		Allow:   allowed,
+	}
+}
 
-	return nil
+func contains(list interface{}, item interface{}) int {
+	for index, element := range list.([]string) {
+		if element == item {
+			return index
+		}
+	}
+	return -1
 }
 
+// validate checks the idle timeout and the maximum lifetime of the session.
+// With renew the request counts as activity, which is recorded once the renew
+// interval has passed. The remaining lifetime becomes the MaxAge of the cookie
+// and the stored session.
+func (s *sessionService) validate(ctx context.Context, r *http.Request, session *sessions.Session, renew bool) (LoginResponse, error) {
+	createdAt, _ := session.Values["CreatedAt"].(string)
+	lastActivity, _ := session.Values["LastActivity"].(string)
+	now := time.Now()
+	expires, ok := s.expiry(createdAt, lastActivity, now)
+	if !ok || !now.Before(expires) {
+		if username, _ := session.Values["Username"].(string); ok && username != "" {
+			organization, _ := session.Values["Organization"].(string)
+			s.audit(ctx, r, AuditRecord{Event: auditSessionExpired, Username: username, Organization: organization})
+		}
+		session.Options.MaxAge = -1
+		return LoginResponse{Authenticated: false, Message: "Invalid Session"}, nil
+	}
 
-func validate(session *sessions.Session) (LoginResponse, error) {
-	fmt.Println("validate session called")
-	lastLoginTime := session.Values["LastLoginTime"].(string)
+	var res LoginResponse
+	last, _ := time.Parse(time.RFC3339, lastActivity)
+	if renew && now.Sub(last) >= time.Duration(s.config.Session.RenewInterval)*time.Second {
+		session.Values["LastActivity"] = now.Format(time.RFC3339)
+		expires, _ = s.expiry(createdAt, now.Format(time.RFC3339), now)
+		res.renewed = true
+	}
+	res.Authenticated = true
+	res.Message = "Success"
+	res.setExpiry(session, expires, now)
+	return res, nil
+}
 
-	parsedTime, err := time.Parse(time.RFC3339, lastLoginTime)
+// expiry returns when a session ends: after the idle timeout since the last
+// activity or the maximum lifetime since login, whichever comes first. It
+// reports false for sessions without valid times or with times in the future,
+// which validate ends right away.
+func (s *sessionService) expiry(createdAt, lastActivity string, now time.Time) (time.Time, bool) {
+	created, err := time.Parse(time.RFC3339, createdAt)
 	if err != nil {
-		fmt.Println("Error while parsing time")
-		return LoginResponse{}, err
+		return time.Time{}, false
 	}
-	duration := time.Since(parsedTime)
-	fmt.Println("Duration eloped = ", duration.Minutes())
-	minutesPassed := duration.Minutes()
-	if minutesPassed < 0 || minutesPassed > SessionTimeOut {
-		fmt.Println("Session Invalid")
-		session.Options.MaxAge = -1
-		return LoginResponse{Authenticated: false, Message: "Invalid Session"}, nil
+	last, err := time.Parse(time.RFC3339, lastActivity)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// times in the future come from a clock that went backwards
+	if created.After(now) || last.After(now) {
+		return time.Time{}, false
+	}
+	expires := last.Add(time.Duration(s.config.Session.IdleTimeout * float64(time.Minute)))
+	if s.config.Session.MaxLifetime > 0 {
+		if absolute := created.Add(time.Duration(s.config.Session.MaxLifetime * float64(time.Minute))); absolute.Before(expires) {
+			expires = absolute
+		}
 	}
-	fmt.Println("Session Valid")
-	return LoginResponse{Authenticated: true, Message: "Success"}, nil
+	return expires, true
+}
+
+// setExpiry reports the remaining lifetime and lets the cookie and the stored
+// session expire with it
+func (res *LoginResponse) setExpiry(session *sessions.Session, expires, now time.Time) {
+	remaining := int(math.Ceil(expires.Sub(now).Seconds()))
+	res.ExpiresAt = expires.UTC().Format(time.RFC3339)
+	res.ExpiresIn = remaining
+	session.Options.MaxAge = remaining
 }
 
 // Au
@@ -0,0 +1,33 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	s := &sessionService{config: DefaultConfig()}
+	s.config.Session.IdleTimeout = 30
+	s.config.Session.MaxLifetime = 60
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name                    string
+		createdAt, lastActivity string
+		ok                      bool
+		expires                 time.Time
+	}{
+		{"idle timeout", at(-40 * time.Minute), at(-10 * time.Minute), true, now.Add(20 * time.Minute)},
+		{"max lifetime", at(-50 * time.Minute), at(-time.Minute), true, now.Add(10 * time.Minute)},
+		{"no times", "", "", false, time.Time{}},
+		{"invalid last activity", at(-time.Minute), "yesterday", false, time.Time{}},
+		{"time in the future", at(-time.Minute), at(time.Hour), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		expires, ok := s.expiry(tt.createdAt, tt.lastActivity, now)
+		if ok != tt.ok || !expires.Equal(tt.expires) {
+			t.Errorf("%s: expiry = %v, %v, want %v, %v", tt.name, expires, ok, tt.expires, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// SessionStore is implemented by all session store backends. Sessions of a
+// logged in user are indexed per user so that they can be listed and revoked.
+type SessionStore interface {
+	sessions.Store
+	// list returns the indexed sessions, only those of username when it is set
+	list(username string) ([]sessionInfo, error)
+	// revoke deletes the session with the given listed ID
+	revoke(id string) (bool, error)
+	// revokeUser deletes every session of the user and returns their number
+	revokeUser(username string) (int, error)
+	// regenerate destroys the stored session, the next Save issues a new ID
+	regenerate(session *sessions.Session) error
+}
+
+// sessionInfo describes a session in the per-user index. ID identifies the
+// session without disclosing the session ID carried by the cookie.
+type sessionInfo struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	CreatedAt    string `json:"created_at"`
+	LastActivity string `json:"last_activity"`
+	ClientIP     string `json:"client_ip"`
+	UserAgent    string `json:"user_agent"`
+	// AuthModule names the modules that authenticated the user
+	AuthModule   string `json:"auth_module,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// indexEntry is the value of an index key
+type indexEntry struct {
+	SessionID string      `json:"session_id"`
+	Info      sessionInfo `json:"info"`
+}
+
+// StoreConfig selects and configures the session store backend
+type StoreConfig struct {
+	// Type is one of "etcd", "memory", "bolt" or "redis"
+	Type      string   `json:"type"`
+	Prefix    string   `json:"prefix"`
+	Endpoints []string `json:"endpoints"`
+	Path      string   `json:"path"`
+	Address   string   `json:"address"`
+	Password  string   `json:"password"`
+	Database  int      `json:"database"`
+	// LegacySecret is the secret of the etcd store of earlier versions. When
+	// it is set, their sessions are taken over on first use.
+	LegacySecret string `json:"legacy_secret"`
+}
+
+// NewSessionStore builds the session store backend selected by the configuration
+func NewSessionStore(config StoreConfig, keyPairs ...[]byte) (SessionStore, error) {
+	backend, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	store := newKVStore(backend, keyPairs...)
+	store.legacy = legacyEtcdStore(config)
+	return store, nil
+}
+
+// newBackend opens the backend selected by the configuration. Besides the
+// sessions it keeps other state that must be shared by all replicas.
+func newBackend(config StoreConfig) (kvBackend, error) {
+	if config.Prefix == "" {
+		config.Prefix = "contivSession"
+	}
+	if config.Path == "" {
+		config.Path = "sessions.db"
+	}
+	switch config.Type {
+	case "etcd", "":
+		return newEtcdBackend(config.Endpoints, config.Prefix)
+	case "memory":
+		return newMemoryBackend(), nil
+	case "bolt":
+		return newBoltBackend(config.Path, config.Prefix)
+	case "redis":
+		return newRedisBackend(config.Address, config.Password, config.Database, config.Prefix), nil
+	}
+	return nil, fmt.Errorf("unknown session store type %q", config.Type)
+}
+
+// kvBackend is the storage primitive shared by every session store backend.
+// get returns a nil value without error when the key does not exist. create
+// only writes a key that does not exist and replace only a key whose value is
+// still old, atomically, and both report whether they did. list returns the
+// keys starting with a prefix that ends in a slash, with their values.
+type kvBackend interface {
+	get(key string) ([]byte, error)
+	set(key string, value []byte, ttl time.Duration) error
+	create(key string, value []byte, ttl time.Duration) (bool, error)
+	replace(key string, old, value []byte, ttl time.Duration) (bool, error)
+	list(prefix string) (map[string][]byte, error)
+	delete(key string) error
+}
+
+// storedValues is the key of the session value holding the encoded values the
+// session was loaded or last saved with, the old value of its next replace
+type storedValues struct{}
+
+// replaceAttempts bounds the writes of a session that keeps being changed by
+// concurrent requests, they back off a random time of up to a millisecond per
+// failed attempt
+const replaceAttempts = 10
+
+var errSessionContention = errors.New("session keeps changing, concurrent requests could not be merged")
+
+// kvStore stores gorilla sessions in a kvBackend, keeping only the signed
+// session ID in the cookie
+type kvStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend kvBackend
+	// legacy is the store of earlier versions whose sessions are taken over
+	legacy sessions.Store
+}
+
+func newKVStore(backend kvBackend, keyPairs ...[]byte) *kvStore {
+	return &kvStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		// Lax rather than Strict, the identity provider redirects back to
+		// the OpenID Connect callback from another site
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		backend: backend,
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *kvStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+func (s *kvStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	c, errCookie := r.Cookie(name)
+	if errCookie != nil {
+		return session, nil
+	}
+	// a cookie that does not decode, e.g. after a secret change, starts a new session
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		session.ID = ""
+		return session, s.adopt(r, session)
+	}
+	found, err := s.load(session)
+	if err != nil {
+		return session, err
+	}
+	if !found {
+		session.ID = ""
+		return session, s.adopt(r, session)
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// adopt takes over the session of the legacy store the request carries. It
+// is saved under a new ID and deleted from the legacy store.
+func (s *kvStore) adopt(r *http.Request, session *sessions.Session) error {
+	if s.legacy == nil {
+		return nil
+	}
+	legacy, err := s.legacy.New(r, session.Name())
+	// a cookie the legacy store can not decode is not one of its sessions
+	if err != nil || legacy.IsNew || len(legacy.Values) == 0 {
+		return nil
+	}
+	for key, value := range legacy.Values {
+		session.Values[key] = value
+	}
+	// legacy sessions only recorded their last activity as LastLoginTime, the
+	// lifetime of a taken over session counts from there
+	if _, ok := session.Values["CreatedAt"]; !ok {
+		if last, ok := session.Values["LastLoginTime"].(string); ok {
+			session.Values["CreatedAt"] = last
+			session.Values["LastActivity"] = last
+		}
+	}
+	session.ID = newSessionID()
+	if err := s.save(session); err != nil {
+		return err
+	}
+	session.IsNew = false
+	legacy.Options.MaxAge = -1
+	return s.legacy.Save(r, discardResponse{}, legacy)
+}
+
+// Save adds a single session to the response. A MaxAge below or equal to zero
+// removes the session from the backend and expires the cookie. A session that
+// was loaded from the backend is written back with compare-and-swap, see
+// replace, so a concurrent logout is never undone by a request that read it
+// before.
+func (s *kvStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if !session.IsNew && session.Options.MaxAge > 0 {
+		saved, err := s.replace(session)
+		if err != nil {
+			return err
+		}
+		if !saved {
+			session.Options.MaxAge = -1
+		}
+	}
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(session.ID); err != nil {
+				return err
+			}
+			if err := s.unindex(session); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.IsNew {
+		if session.ID == "" {
+			session.ID = newSessionID()
+		}
+		if err := s.save(session); err != nil {
+			return err
+		}
+	}
+	if err := s.index(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *kvStore) load(session *sessions.Session) (bool, error) {
+	data, err := s.backend.get(session.ID)
+	if err != nil || data == nil {
+		return false, err
+	}
+	values, err := decodeValues(data)
+	if err != nil {
+		return false, err
+	}
+	values[storedValues{}] = data
+	session.Values = values
+	return true, nil
+}
+
+func (s *kvStore) save(session *sessions.Session) error {
+	data, err := encodeValues(session)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.set(session.ID, data, time.Duration(session.Options.MaxAge)*time.Second); err != nil {
+		return err
+	}
+	session.Values[storedValues{}] = data
+	return nil
+}
+
+// replace writes a loaded session back only if nobody changed it since it
+// was loaded. Otherwise the values this request changed are applied to the
+// current ones and the write is tried again, so a request never brings back
+// values another request changed or removed in the meantime. It reports false
+// when the session is gone.
+func (s *kvStore) replace(session *sessions.Session) (bool, error) {
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	stored, _ := session.Values[storedValues{}].([]byte)
+	for attempt := 0; attempt < replaceAttempts; attempt++ {
+		data, err := encodeValues(session)
+		if err != nil {
+			return false, err
+		}
+		replaced, err := s.backend.replace(session.ID, stored, data, ttl)
+		if err != nil {
+			return false, err
+		}
+		if replaced {
+			session.Values[storedValues{}] = data
+			return true, nil
+		}
+		current, err := s.backend.get(session.ID)
+		if err != nil || current == nil {
+			return false, err
+		}
+		changed, err := rebase(session, stored, current)
+		if err != nil || !changed {
+			// the concurrent write already stored and renewed the same values
+			return err == nil, err
+		}
+		stored = current
+		time.Sleep(time.Duration(mathrand.Int63n(int64(attempt+1) * int64(time.Millisecond))))
+	}
+	return false, errSessionContention
+}
+
+// rebase applies the changes the request made to the values it loaded as
+// stored onto the current values of the session. It reports whether that
+// changed the current values. A renewal that is not later than the current
+// LastActivity is stale and dropped, the concurrent write renewed the session.
+func rebase(session *sessions.Session, stored, current []byte) (bool, error) {
+	base, err := decodeValues(stored)
+	if err != nil {
+		return false, err
+	}
+	values, err := decodeValues(current)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for key, value := range session.Values {
+		if old, ok := base[key]; key != (storedValues{}) && (!ok || !reflect.DeepEqual(old, value)) {
+			if now, ok := values[key]; key == "LastActivity" && !renewsLater(value, now) {
+				continue
+			} else if !ok || !reflect.DeepEqual(now, value) {
+				values[key] = value
+				changed = true
+			}
+		}
+	}
+	for key := range base {
+		if _, ok := session.Values[key]; !ok {
+			if _, ok := values[key]; ok {
+				delete(values, key)
+				changed = true
+			}
+		}
+	}
+	values[storedValues{}] = current
+	session.Values = values
+	return changed, nil
+}
+
+// renewsLater reports whether the LastActivity value is later than current
+func renewsLater(value, current interface{}) bool {
+	last, _ := value.(string)
+	renewed, err := time.Parse(time.RFC3339, last)
+	if err != nil {
+		return false
+	}
+	last, _ = current.(string)
+	previous, err := time.Parse(time.RFC3339, last)
+	return err != nil || renewed.After(previous)
+}
+
+// encodeValues encodes the session values other than storedValues
+func encodeValues(session *sessions.Session) ([]byte, error) {
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for key, value := range session.Values {
+		if key != (storedValues{}) {
+			values[key] = value
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValues(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if len(data) == 0 {
+		return values, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// indexKey is the key of the session in the index of its user. Usernames are
+// encoded so that they can not add key separators.
+func indexKey(username, id string) string {
+	return indexPrefix(username) + id
+}
+
+func indexPrefix(username string) string {
+	if username == "" {
+		return "users/"
+	}
+	return "users/" + base64.RawURLEncoding.EncodeToString([]byte(username)) + "/"
+}
+
+// listedID derives the ID shown by the admin API from the session ID
+func listedID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:12])
+}
+
+func sessionUsername(session *sessions.Session) string {
+	username, _ := session.Values["Username"].(string)
+	return username
+}
+
+// index records a logged in session in the index of its user, with the same
+// lifetime as the session
+func (s *kvStore) index(session *sessions.Session) error {
+	username := sessionUsername(session)
+	if username == "" {
+		return nil
+	}
+	entry := indexEntry{SessionID: session.ID, Info: sessionInfo{ID: listedID(session.ID), Username: username}}
+	entry.Info.CreatedAt, _ = session.Values["CreatedAt"].(string)
+	entry.Info.LastActivity, _ = session.Values["LastActivity"].(string)
+	entry.Info.ClientIP, _ = session.Values["ClientIP"].(string)
+	entry.Info.UserAgent, _ = session.Values["UserAgent"].(string)
+	entry.Info.AuthModule, _ = session.Values["AuthModule"].(string)
+	entry.Info.Organization, _ = session.Values["Organization"].(string)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.backend.set(indexKey(username, entry.Info.ID), data, time.Duration(session.Options.MaxAge)*time.Second)
+}
+
+func (s *kvStore) unindex(session *sessions.Session) error {
+	username := sessionUsername(session)
+	if username == "" {
+		return nil
+	}
+	return s.backend.delete(indexKey(username, listedID(session.ID)))
+}
+
+// entries returns the index entries under the prefix. Entries whose session
+// is gone, e.g. revoked while a request saved it, are dropped on the way.
+func (s *kvStore) entries(prefix string) (map[string]indexEntry, error) {
+	values, err := s.backend.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]indexEntry)
+	for key, value := range values {
+		var entry indexEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return nil, err
+		}
+		data, err := s.backend.get(entry.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			if err := s.backend.delete(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result[key] = entry
+	}
+	return result, nil
+}
+
+func (s *kvStore) list(username string) ([]sessionInfo, error) {
+	entries, err := s.entries(indexPrefix(username))
+	if err != nil {
+		return nil, err
+	}
+	result := []sessionInfo{}
+	for _, entry := range entries {
+		result = append(result, entry.Info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Username != result[j].Username {
+			return result[i].Username < result[j].Username
+		}
+		return result[i].CreatedAt < result[j].CreatedAt
+	})
+	return result, nil
+}
+
+func (s *kvStore) revoke(id string) (bool, error) {
+	entries, err := s.entries(indexPrefix(""))
+	if err != nil {
+		return false, err
+	}
+	for key, entry := range entries {
+		if entry.Info.ID == id {
+			return true, s.delete(key, entry)
+		}
+	}
+	return false, nil
+}
+
+func (s *kvStore) revokeUser(username string) (int, error) {
+	entries, err := s.entries(indexPrefix(username))
+	if err != nil {
+		return 0, err
+	}
+	for key, entry := range entries {
+		if err := s.delete(key, entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// regenerate is called at login, so that a session ID known to anyone before
+// the login, e.g. from a planted cookie, never becomes authenticated
+func (s *kvStore) regenerate(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.backend.delete(session.ID); err != nil {
+			return err
+		}
+		if err := s.unindex(session); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	session.IsNew = true
+	delete(session.Values, storedValues{})
+	return nil
+}
+
+// delete removes the session before its index entry, a request saving the
+// session in between finds it gone
+func (s *kvStore) delete(key string, entry indexEntry) error {
+	if err := s.backend.delete(entry.SessionID); err != nil {
+		return err
+	}
+	return s.backend.delete(key)
+}
+
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
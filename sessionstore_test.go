@@ -0,0 +1,476 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// testBackends opens each session store backend, the redis and etcd ones
+// against in-process fakes
+func testBackends() map[string]func(t testing.TB) kvBackend {
+	return map[string]func(t testing.TB) kvBackend{
+		"memory": func(t testing.TB) kvBackend {
+			return newMemoryBackend()
+		},
+		"bolt": func(t testing.TB) kvBackend {
+			backend, err := newBoltBackend(filepath.Join(t.TempDir(), "sessions.db"), "contivSession")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { backend.db.Close() })
+			return backend
+		},
+		"redis": func(t testing.TB) kvBackend {
+			return newRedisBackend(newFakeRedis(t).addr(), "", 0, "contivSession")
+		},
+		"etcd": func(t testing.TB) kvBackend {
+			backend, err := newEtcdBackend([]string{newFakeEtcd(t).server.URL}, "contivSession")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return backend
+		},
+	}
+}
+
+// TestBackendConformance runs the same checks against every backend
+func TestBackendConformance(t *testing.T) {
+	for name, open := range testBackends() {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			t.Run("get", func(t *testing.T) { testBackendGet(t, open(t)) })
+			t.Run("create", func(t *testing.T) { testBackendCreate(t, open(t)) })
+			t.Run("replace", func(t *testing.T) { testBackendReplace(t, open(t)) })
+			t.Run("list", func(t *testing.T) { testBackendList(t, open(t)) })
+			t.Run("expiry", func(t *testing.T) { testBackendExpiry(t, open(t)) })
+			t.Run("store", func(t *testing.T) { testSessionStore(t, open(t)) })
+			t.Run("concurrent save", func(t *testing.T) { testSessionStoreConcurrentSave(t, open(t)) })
+		})
+	}
+}
+
+func mustGet(t *testing.T, b kvBackend, key string) []byte {
+	t.Helper()
+	value, err := b.get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	return value
+}
+
+func mustSet(t *testing.T, b kvBackend, key, value string, ttl time.Duration) {
+	t.Helper()
+	if err := b.set(key, []byte(value), ttl); err != nil {
+		t.Fatalf("set %s: %v", key, err)
+	}
+}
+
+func testBackendGet(t *testing.T, b kvBackend) {
+	if value := mustGet(t, b, "missing"); value != nil {
+		t.Fatalf("get of a missing key = %q, want nil", value)
+	}
+	mustSet(t, b, "key", "one", 0)
+	mustSet(t, b, "key", "two", time.Minute)
+	if value := mustGet(t, b, "key"); string(value) != "two" {
+		t.Fatalf("get = %q, want two", value)
+	}
+	// binary values survive every encoding on the way
+	binary := string([]byte{0, 0xff, '\n', '"', 0x80})
+	mustSet(t, b, "binary", binary, 0)
+	if value := mustGet(t, b, "binary"); string(value) != binary {
+		t.Fatalf("get = %q, want %q", value, binary)
+	}
+	if err := b.delete("key"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if value := mustGet(t, b, "key"); value != nil {
+		t.Fatalf("get after delete = %q, want nil", value)
+	}
+	if err := b.delete("key"); err != nil {
+		t.Fatalf("delete of a missing key: %v", err)
+	}
+}
+
+func testBackendCreate(t *testing.T, b kvBackend) {
+	if ok, err := b.create("key", []byte("one"), time.Minute); err != nil || !ok {
+		t.Fatalf("create = %v, %v, want true", ok, err)
+	}
+	if ok, err := b.create("key", []byte("two"), time.Minute); err != nil || ok {
+		t.Fatalf("create of an existing key = %v, %v, want false", ok, err)
+	}
+	if value := mustGet(t, b, "key"); string(value) != "one" {
+		t.Fatalf("get = %q, want one", value)
+	}
+
+	// of concurrent creators exactly one wins
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := b.create("contested", []byte(strconv.Itoa(i)), time.Minute)
+			if err != nil {
+				t.Errorf("create: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&created, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("%d concurrent creates succeeded, want 1", created)
+	}
+}
+
+func testBackendReplace(t *testing.T, b kvBackend) {
+	if ok, err := b.replace("key", []byte("one"), []byte("two"), time.Minute); err != nil || ok {
+		t.Fatalf("replace of a missing key = %v, %v, want false", ok, err)
+	}
+	if value := mustGet(t, b, "key"); value != nil {
+		t.Fatalf("replace created the key: %q", value)
+	}
+	mustSet(t, b, "key", "one", time.Minute)
+	if ok, err := b.replace("key", []byte("stale"), []byte("two"), time.Minute); err != nil || ok {
+		t.Fatalf("replace of a changed key = %v, %v, want false", ok, err)
+	}
+	if value := mustGet(t, b, "key"); string(value) != "one" {
+		t.Fatalf("get after a failed replace = %q, want one", value)
+	}
+	if ok, err := b.replace("key", []byte("one"), []byte("two"), time.Minute); err != nil || !ok {
+		t.Fatalf("replace = %v, %v, want true", ok, err)
+	}
+	if value := mustGet(t, b, "key"); string(value) != "two" {
+		t.Fatalf("get = %q, want two", value)
+	}
+}
+
+func testBackendList(t *testing.T, b kvBackend) {
+	mustSet(t, b, "users/YWxpY2U/1", "a1", time.Minute)
+	mustSet(t, b, "users/YWxpY2U/2", "a2", 0)
+	mustSet(t, b, "users/Ym9i/1", "b1", time.Minute)
+	mustSet(t, b, "users0", "outside", 0)
+	mustSet(t, b, "SESSIONID", "session", 0)
+
+	list, err := b.list("users/YWxpY2U/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"users/YWxpY2U/1": []byte("a1"), "users/YWxpY2U/2": []byte("a2")}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatalf("list = %q, want %q", list, want)
+	}
+	if list, err = b.list("users/"); err != nil || len(list) != 3 {
+		t.Fatalf("list of every user = %q, %v", list, err)
+	}
+	if list, err = b.list("nobody/"); err != nil || len(list) != 0 {
+		t.Fatalf("list of an empty prefix = %q, %v", list, err)
+	}
+}
+
+func testBackendExpiry(t *testing.T, b kvBackend) {
+	mustSet(t, b, "short", "value", time.Second)
+	mustSet(t, b, "users/short", "value", time.Second)
+	mustSet(t, b, "long", "value", time.Minute)
+	time.Sleep(1500 * time.Millisecond)
+	if value := mustGet(t, b, "short"); value != nil {
+		t.Fatalf("get of an expired key = %q", value)
+	}
+	if list, err := b.list("users/"); err != nil || len(list) != 0 {
+		t.Fatalf("list returned expired keys: %q, %v", list, err)
+	}
+	if ok, err := b.replace("short", []byte("value"), []byte("again"), time.Minute); err != nil || ok {
+		t.Fatalf("replace of an expired key = %v, %v, want false", ok, err)
+	}
+	if ok, err := b.create("users/short", []byte("again"), time.Minute); err != nil || !ok {
+		t.Fatalf("create of an expired key = %v, %v, want true", ok, err)
+	}
+	if value := mustGet(t, b, "long"); string(value) != "value" {
+		t.Fatalf("get = %q, want value", value)
+	}
+}
+
+// testSessionStore checks the session store on top of the backend: saving and
+// loading a session, the per-user index, revocation and regeneration
+func testSessionStore(t *testing.T, b kvBackend) {
+	store := newKVStore(b, []byte("0123456789abcdef0123456789abcdef"))
+	cookie := saveTestSession(t, store, nil, func(s *sessions.Session) {
+		s.Values["Username"] = "alice"
+		s.Values["Roles"] = []string{"admin"}
+		s.Values["CreatedAt"] = time.Now().Format(time.RFC3339)
+	})
+
+	session := loadTestSession(t, store, cookie)
+	if session.IsNew || session.Values["Username"] != "alice" || !reflect.DeepEqual(session.Values["Roles"], []string{"admin"}) {
+		t.Fatalf("loaded session = %v, new %v", session.Values, session.IsNew)
+	}
+	list, err := store.list("alice")
+	if err != nil || len(list) != 1 || list[0].Username != "alice" {
+		t.Fatalf("list = %+v, %v", list, err)
+	}
+	if list[0].ID == session.ID {
+		t.Fatal("the listed ID discloses the session ID")
+	}
+
+	// a second session of the user, then revoke the first by its listed ID
+	other := saveTestSession(t, store, nil, func(s *sessions.Session) { s.Values["Username"] = "alice" })
+	if found, err := store.revoke(list[0].ID); err != nil || !found {
+		t.Fatalf("revoke = %v, %v", found, err)
+	}
+	if session := loadTestSession(t, store, cookie); !session.IsNew {
+		t.Fatal("revoked session is still loaded")
+	}
+	if count, err := store.revokeUser("alice"); err != nil || count != 1 {
+		t.Fatalf("revokeUser = %d, %v, want 1", count, err)
+	}
+	if session := loadTestSession(t, store, other); !session.IsNew {
+		t.Fatal("session of a revoked user is still loaded")
+	}
+
+	// regenerate destroys the stored session, the next save gets a new ID
+	cookie = saveTestSession(t, store, nil, func(s *sessions.Session) { s.Values["Username"] = "bob" })
+	session = loadTestSession(t, store, cookie)
+	oldID := session.ID
+	renewed := saveTestSession(t, store, cookie, func(s *sessions.Session) {
+		if err := store.regenerate(s); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if session := loadTestSession(t, store, cookie); !session.IsNew {
+		t.Fatal("session is still loaded by its old ID")
+	}
+	if session := loadTestSession(t, store, renewed); session.IsNew || session.ID == oldID || session.Values["Username"] != "bob" {
+		t.Fatalf("regenerated session = %v, new %v", session.Values, session.IsNew)
+	}
+
+	// a MaxAge of -1 deletes the session and expires the cookie
+	expired := saveTestSession(t, store, renewed, func(s *sessions.Session) { s.Options.MaxAge = -1 })
+	if expired.MaxAge >= 0 {
+		t.Fatalf("cookie MaxAge = %d, want the cookie expired", expired.MaxAge)
+	}
+	if session := loadTestSession(t, store, renewed); !session.IsNew {
+		t.Fatal("deleted session is still loaded")
+	}
+	if list, err := store.list("bob"); err != nil || len(list) != 0 {
+		t.Fatalf("list after delete = %+v, %v", list, err)
+	}
+}
+
+// testSessionStoreConcurrentSave saves sessions that changed since they were
+// loaded by another request
+func testSessionStoreConcurrentSave(t *testing.T, b kvBackend) {
+	store := newKVStore(b, []byte("0123456789abcdef0123456789abcdef"))
+	cookie := saveTestSession(t, store, nil, func(s *sessions.Session) {
+		s.Values["Username"] = "alice"
+		s.Values["LastActivity"] = "2024-01-01T10:00:00Z"
+		s.Values["MFAPending"] = "alice"
+	})
+
+	// both requests load the session, the changes of the first are kept
+	// when the second saves
+	first, second := loadTestSession(t, store, cookie), loadTestSession(t, store, cookie)
+	first.Values["CSRFToken"] = "token"
+	delete(first.Values, "MFAPending")
+	storeTestSession(t, store, first)
+	second.Values["LastActivity"] = "2024-01-01T10:05:00Z"
+	storeTestSession(t, store, second)
+	want := map[interface{}]interface{}{"Username": "alice", "LastActivity": "2024-01-01T10:05:00Z", "CSRFToken": "token"}
+	if session := loadTestSession(t, store, cookie); !reflect.DeepEqual(stripStored(session.Values), want) {
+		t.Fatalf("merged session = %v, want %v", stripStored(session.Values), want)
+	}
+
+	// a renewal older than the stored one is dropped
+	first, second = loadTestSession(t, store, cookie), loadTestSession(t, store, cookie)
+	first.Values["LastActivity"] = "2024-01-01T10:07:00Z"
+	storeTestSession(t, store, first)
+	second.Values["LastActivity"] = "2024-01-01T10:06:00Z"
+	storeTestSession(t, store, second)
+	if session := loadTestSession(t, store, cookie); session.Values["LastActivity"] != "2024-01-01T10:07:00Z" {
+		t.Fatalf("LastActivity = %v, the stale renewal was saved", session.Values["LastActivity"])
+	}
+
+	// a request that loaded the session before a logout does not bring it back
+	stale := loadTestSession(t, store, cookie)
+	saveTestSession(t, store, cookie, func(s *sessions.Session) { s.Options.MaxAge = -1 })
+	stale.Values["LastActivity"] = "2024-01-01T10:10:00Z"
+	if expired := storeTestSession(t, store, stale); expired.MaxAge >= 0 {
+		t.Fatal("the session of a stale request was saved after the logout")
+	}
+	if session := loadTestSession(t, store, cookie); !session.IsNew {
+		t.Fatal("the session of a stale request was recreated")
+	}
+}
+
+func stripStored(values map[interface{}]interface{}) map[interface{}]interface{} {
+	result := make(map[interface{}]interface{})
+	for key, value := range values {
+		if key != (storedValues{}) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// storeTestSession saves a loaded session and returns the cookie set by the store
+func storeTestSession(t *testing.T, store *kvStore, session *sessions.Session) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+// saveTestSession loads the session of the cookie, nil for a new one, changes
+// and saves it, and returns the cookie set by the store
+func saveTestSession(t *testing.T, store *kvStore, cookie *http.Cookie, change func(*sessions.Session)) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	session, err := store.Get(r, "contiv-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(session)
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("save set %d cookies", len(cookies))
+	}
+	return cookies[0]
+}
+
+func loadTestSession(t *testing.T, store *kvStore, cookie *http.Cookie) *sessions.Session {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err := store.New(r, "contiv-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestSessionStoreRejectsForgedCookie(t *testing.T) {
+	store := newKVStore(newMemoryBackend(), []byte("0123456789abcdef0123456789abcdef"))
+	cookie := saveTestSession(t, store, nil, func(s *sessions.Session) { s.Values["Username"] = "alice" })
+	other := newKVStore(store.backend, []byte("another secret of thirty-two bytes"))
+	if session := loadTestSession(t, other, cookie); !session.IsNew || session.ID != "" {
+		t.Fatal("a cookie signed with another secret was accepted")
+	}
+}
+
+// fakeLegacyStore stands in for the etcd store of earlier versions
+type fakeLegacyStore struct {
+	values  map[interface{}]interface{}
+	deleted bool
+}
+
+func (f *fakeLegacyStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return f.New(r, name)
+}
+
+func (f *fakeLegacyStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(f, name)
+	session.Options = &sessions.Options{Path: "/", MaxAge: 86400}
+	session.IsNew = true
+	if c, err := r.Cookie(name); err == nil && c.Value == "legacy" && !f.deleted {
+		session.Values = f.values
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+func (f *fakeLegacyStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	f.deleted = session.Options.MaxAge < 0
+	return nil
+}
+
+func TestSessionStoreAdoptsLegacySession(t *testing.T) {
+	store := newKVStore(newMemoryBackend(), []byte("0123456789abcdef0123456789abcdef"))
+	legacy := &fakeLegacyStore{values: map[interface{}]interface{}{"Username": "alice", "LastLoginTime": "2024-01-01T00:00:00Z"}}
+	store.legacy = legacy
+
+	cookie := &http.Cookie{Name: "contiv-session", Value: "legacy"}
+	session := loadTestSession(t, store, cookie)
+	if session.IsNew || session.Values["Username"] != "alice" {
+		t.Fatalf("legacy session was not adopted: %v", session.Values)
+	}
+	// the session times count from the legacy last activity
+	if session.Values["CreatedAt"] != "2024-01-01T00:00:00Z" || session.Values["LastActivity"] != "2024-01-01T00:00:00Z" {
+		t.Fatalf("adopted session times = %v, %v", session.Values["CreatedAt"], session.Values["LastActivity"])
+	}
+	if !legacy.deleted {
+		t.Fatal("adopted session was not deleted from the legacy store")
+	}
+	if session := loadTestSession(t, store, cookie); !session.IsNew {
+		t.Fatal("legacy session was adopted twice")
+	}
+}
+
+// BenchmarkSessionSave measures the requests renewing their session, each
+// with a session of its own and all with the same session. Renewals run into
+// each other in the shared case, as concurrent requests of a browser do.
+func BenchmarkSessionSave(b *testing.B) {
+	for name, open := range testBackends() {
+		for _, shared := range []bool{false, true} {
+			open, shared := open, shared
+			mode := "distinct"
+			if shared {
+				mode = "shared"
+			}
+			b.Run(name+"/"+mode, func(b *testing.B) {
+				store := newKVStore(open(b), []byte("0123456789abcdef0123456789abcdef"))
+				cookie := benchmarkSession(b, store)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					cookie := cookie
+					if !shared {
+						cookie = benchmarkSession(b, store)
+					}
+					for pb.Next() {
+						r := httptest.NewRequest("GET", "/", nil)
+						r.AddCookie(cookie)
+						session, err := store.New(r, "contiv-session")
+						if err != nil || session.IsNew {
+							b.Fatalf("load = %v, new %v", err, session.IsNew)
+						}
+						session.Values["LastActivity"] = time.Now().Format(time.RFC3339)
+						if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func benchmarkSession(b *testing.B, store *kvStore) *http.Cookie {
+	session := sessions.NewSession(store, "contiv-session")
+	session.Options = &sessions.Options{Path: "/", MaxAge: 3600}
+	session.IsNew = true
+	session.Values["Username"] = "alice"
+	session.Values["Roles"] = []string{"admin"}
+	w := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		b.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
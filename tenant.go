@@ -0,0 +1,181 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tenantScopeKey routes address netmaster objects keyed "<tenant>:<name>"
+	tenantScopeKey = "key"
+	// tenantScopeTenant routes address objects keyed by the tenant name
+	tenantScopeTenant = "tenant"
+	// tenantScopeGlobal routes hold objects of no tenant, tenant sessions
+	// may only read them
+	tenantScopeGlobal = "global"
+
+	defaultTenantField = "tenantName"
+	// maxTenantBody bounds the bodies read to check or filter the tenant
+	maxTenantBody = 32 << 20
+)
+
+var tenantScopes = []string{"", tenantScopeKey, tenantScopeTenant, tenantScopeGlobal}
+
+func (r routedetail) tenantField() string {
+	if r.TenantField != "" {
+		return r.TenantField
+	}
+	return defaultTenantField
+}
+
+func (r routedetail) validateTenantScope() error {
+	if contains(tenantScopes, r.TenantScope) < 0 {
+		return fmt.Errorf("unknown tenant_scope %q", r.TenantScope)
+	}
+	if (r.TenantScope == tenantScopeKey || r.TenantScope == tenantScopeTenant) && r.Match != "" && r.Match != "prefix" {
+		return fmt.Errorf("tenant_scope %q requires a prefix route", r.TenantScope)
+	}
+	return nil
+}
+
+// checkTenant refuses requests of a tenant session for objects outside its
+// tenant. It reports whether the response is a list that must be filtered.
+// Sessions without a tenant are not restricted.
+func checkTenant(route routedetail, r *http.Request, tenant string) (bool, error) {
+	if tenant == "" {
+		return false, nil
+	}
+	safe := contains(safeMethods, r.Method) >= 0
+	switch route.TenantScope {
+	case tenantScopeGlobal:
+		if safe {
+			return false, nil
+		}
+		return false, tenantForbidden(route, r, tenant)
+	case tenantScopeKey, tenantScopeTenant:
+	default:
+		// routes without a scope are not shared between tenants
+		return false, tenantForbidden(route, r, tenant)
+	}
+
+	key := objectKey(route.Api, r.URL.Path)
+	if key != "" {
+		owner := key
+		if route.TenantScope == tenantScopeKey {
+			i := strings.Index(key, ":")
+			if i < 0 {
+				return false, tenantForbidden(route, r, tenant)
+			}
+			owner = key[:i]
+		}
+		if owner != tenant {
+			return false, tenantForbidden(route, r, tenant)
+		}
+	}
+	if safe {
+		return key == "" && r.Method == "GET", nil
+	}
+
+	if r.Body == nil || r.ContentLength == 0 {
+		// a write to the collection itself names no tenant
+		if key == "" {
+			return false, tenantForbidden(route, r, tenant)
+		}
+		return false, nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxTenantBody))
+	r.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return false, tenantForbidden(route, r, tenant)
+	}
+	// the body must not move the object to another tenant
+	owner, found := lookupField(object, route.tenantField())
+	if (found || key == "") && owner != tenant {
+		return false, tenantForbidden(route, r, tenant)
+	}
+	return false, nil
+}
+
+// filterTenant keeps the objects of the tenant in a list response
+func filterTenant(route routedetail, resp *http.Response, tenant string) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	failed := &apiError{status: http.StatusBadGateway, Code: "tenant_filter_failed", Route: route.Api,
+		Message: "the response of " + route.Api + " can not be filtered by tenant"}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return failed
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxTenantBody))
+	if err != nil {
+		return failed
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		return failed
+	}
+	kept := []json.RawMessage{}
+	for _, item := range list {
+		var object map[string]interface{}
+		if json.Unmarshal(item, &object) != nil {
+			continue
+		}
+		if owner, _ := lookupField(object, route.tenantField()); owner == tenant {
+			kept = append(kept, item)
+		}
+	}
+	if body, err = json.Marshal(kept); err != nil {
+		return failed
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// objectKey returns the first path segment below the route, the object key
+// of netmaster URLs like /api/v1/networks/<tenant>:<network>/
+func objectKey(api, path string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, api), "/")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// lookupField reads a string field, nested fields are separated by dots
+// like Config.tenantName of netmaster inspect objects
+func lookupField(object map[string]interface{}, field string) (string, bool) {
+	parts := strings.Split(field, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := object[part].(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		object = nested
+	}
+	value, ok := object[parts[len(parts)-1]].(string)
+	return value, ok
+}
+
+func tenantForbidden(route routedetail, r *http.Request, tenant string) error {
+	return &apiError{
+		status:  http.StatusForbidden,
+		Code:    "tenant_forbidden",
+		Message: "not allowed outside tenant " + tenant,
+		Route:   route.Api,
+		Method:  r.Method,
+	}
+}
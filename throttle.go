@@ -0,0 +1,163 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LockoutConfig throttles failed logins per username and per client IP. Every
+// failure of a username doubles the delay before its next attempt, starting
+// at Backoff seconds up to MaxBackoff, and MaxFailures failures lock it for
+// Duration minutes. A client IP, possibly shared by many users behind NAT,
+// is only locked after IPMaxFailures failures.
+type LockoutConfig struct {
+	Enabled       bool    `json:"enabled"`
+	MaxFailures   int     `json:"max_failures"`
+	IPMaxFailures int     `json:"ip_max_failures"`
+	Duration      float64 `json:"duration"`
+	Backoff       float64 `json:"backoff"`
+	MaxBackoff    float64 `json:"max_backoff"`
+	// Window is the number of minutes after the last failure that reset the counters
+	Window float64 `json:"window"`
+}
+
+// failureCounter is the state of a username or client IP, stored in the
+// session store backend so that every replica sees the same counters
+type failureCounter struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// NextAttempt is the end of the backoff, or of the lockout when Locked
+	NextAttempt time.Time `json:"next_attempt"`
+	Locked      bool      `json:"locked"`
+}
+
+// loginThrottle keeps the failure counters. Concurrent failures on different
+// replicas may lose an increment, which only delays the lockout by an attempt.
+type loginThrottle struct {
+	config  LockoutConfig
+	backend kvBackend
+}
+
+func newLoginThrottle(config LockoutConfig, backend kvBackend) *loginThrottle {
+	if !config.Enabled {
+		return nil
+	}
+	return &loginThrottle{config: config, backend: backend}
+}
+
+func lockoutUserKey(username string) string {
+	// usernames are case insensitive for most directories
+	return "lockout/users/" + base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(username)))
+}
+
+func lockoutIPKey(ip string) string {
+	return "lockout/ips/" + base64.RawURLEncoding.EncodeToString([]byte(ip))
+}
+
+// check refuses the attempt while the username or the client IP is backing
+// off or locked, before any credentials are verified
+func (t *loginThrottle) check(username, ip string) error {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, key := range []string{lockoutUserKey(username), lockoutIPKey(ip)} {
+		c, err := t.load(key)
+		if err != nil {
+			return err
+		}
+		if now.Before(c.NextAttempt) {
+			message := "Too many failed logins, try again later"
+			if c.Locked {
+				message = "Account temporarily locked after too many failed logins"
+			}
+			return &apiError{
+				status:     http.StatusTooManyRequests,
+				Code:       "too_many_attempts",
+				Message:    message,
+				RetryAfter: int(math.Ceil(c.NextAttempt.Sub(now).Seconds())),
+			}
+		}
+	}
+	return nil
+}
+
+// failed counts a failed login for the username and the client IP
+func (t *loginThrottle) failed(username, ip string) error {
+	if t == nil {
+		return nil
+	}
+	if err := t.count(lockoutUserKey(username), t.config.MaxFailures, true); err != nil {
+		return err
+	}
+	return t.count(lockoutIPKey(ip), t.config.IPMaxFailures, false)
+}
+
+// succeeded clears the counter of the username. The client IP keeps its
+// failures, one valid account must not reset a password spraying client.
+func (t *loginThrottle) succeeded(username string) error {
+	if t == nil {
+		return nil
+	}
+	return t.backend.delete(lockoutUserKey(username))
+}
+
+// unlock clears a counter and reports whether there was one
+func (t *loginThrottle) unlock(key string) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+	data, err := t.backend.get(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, t.backend.delete(key)
+}
+
+func (t *loginThrottle) count(key string, maxFailures int, backoff bool) error {
+	c, err := t.load(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if c.Locked && !now.Before(c.NextAttempt) {
+		// the lockout is over, start counting again
+		c = failureCounter{}
+	}
+	c.Failures++
+	c.LastFailure = now
+	if c.Failures >= maxFailures {
+		c.Locked = true
+		c.NextAttempt = now.Add(minutes(t.config.Duration))
+	} else if backoff {
+		delay := t.config.Backoff * math.Pow(2, float64(c.Failures-1))
+		c.NextAttempt = now.Add(time.Duration(math.Min(delay, t.config.MaxBackoff) * float64(time.Second)))
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	ttl := minutes(t.config.Window)
+	if c.NextAttempt.After(now) {
+		ttl += c.NextAttempt.Sub(now)
+	}
+	return t.backend.set(key, data, ttl)
+}
+
+func (t *loginThrottle) load(key string) (failureCounter, error) {
+	var c failureCounter
+	data, err := t.backend.get(key)
+	if err != nil || data == nil {
+		return c, err
+	}
+	return c, json.Unmarshal(data, &c)
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testThrottle(config LockoutConfig) *loginThrottle {
+	config.Enabled = true
+	return newLoginThrottle(config, newMemoryBackend())
+}
+
+// retryAfter returns the Retry-After of a refused attempt, or 0 when the
+// attempt is let through
+func retryAfter(t *testing.T, throttle *loginThrottle, username, ip string) (int, string) {
+	t.Helper()
+	err := throttle.check(username, ip)
+	if err == nil {
+		return 0, ""
+	}
+	apierr, ok := err.(*apiError)
+	if !ok || apierr.status != http.StatusTooManyRequests || apierr.Code != "too_many_attempts" {
+		t.Fatalf("check(%s, %s) = %#v, want too_many_attempts", username, ip, err)
+	}
+	return apierr.RetryAfter, apierr.Message
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle := testThrottle(LockoutConfig{MaxFailures: 6, IPMaxFailures: 100, Duration: 10, Backoff: 2, MaxBackoff: 10, Window: 15})
+	if wait, _ := retryAfter(t, throttle, "alice", "192.0.2.1"); wait != 0 {
+		t.Fatalf("first attempt refused for %ds", wait)
+	}
+	// the delay doubles per failure up to MaxBackoff
+	for i, want := range []int{2, 4, 8, 10, 10} {
+		if err := throttle.failed("alice", "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		if wait, message := retryAfter(t, throttle, "alice", "192.0.2.1"); wait != want || message != "Too many failed logins, try again later" {
+			t.Errorf("failure %d: Retry-After %d %q, want %d", i+1, wait, message, want)
+		}
+	}
+	// the username backs off from any client IP, other users do not
+	if wait, _ := retryAfter(t, throttle, "ALICE", "198.51.100.1"); wait == 0 {
+		t.Error("the username was let through from another IP")
+	}
+	if wait, _ := retryAfter(t, throttle, "bob", "198.51.100.1"); wait != 0 {
+		t.Errorf("another user waits %ds", wait)
+	}
+
+	// a success clears the username but not the client IP
+	throttle.succeeded("alice")
+	if wait, _ := retryAfter(t, throttle, "alice", "192.0.2.1"); wait != 0 {
+		t.Errorf("waits %ds after a successful login", wait)
+	}
+	if c, _ := throttle.load(lockoutIPKey("192.0.2.1")); c.Failures != 5 {
+		t.Errorf("client IP counter %+v after a successful login, want 5 failures", c)
+	}
+}
+
+func TestLoginThrottleUserLockout(t *testing.T) {
+	throttle := testThrottle(LockoutConfig{MaxFailures: 3, IPMaxFailures: 100, Duration: 10, Window: 15})
+	for i := 0; i < 3; i++ {
+		throttle.failed("alice", "192.0.2.1")
+	}
+	wait, message := retryAfter(t, throttle, "alice", "192.0.2.1")
+	if wait < 599 || wait > 600 || message != "Account temporarily locked after too many failed logins" {
+		t.Fatalf("locked user: Retry-After %d %q", wait, message)
+	}
+
+	// counting starts again once the lockout is over
+	c, _ := throttle.load(lockoutUserKey("alice"))
+	c.NextAttempt = time.Now().Add(-time.Second)
+	data, _ := json.Marshal(c)
+	throttle.backend.set(lockoutUserKey("alice"), data, time.Minute)
+	if wait, _ := retryAfter(t, throttle, "alice", "192.0.2.1"); wait != 0 {
+		t.Fatalf("waits %ds after the lockout", wait)
+	}
+	throttle.failed("alice", "192.0.2.1")
+	if c, _ := throttle.load(lockoutUserKey("alice")); c.Failures != 1 || c.Locked {
+		t.Errorf("counter after the lockout %+v, want 1 failure", c)
+	}
+}
+
+func TestLoginThrottleIPLockout(t *testing.T) {
+	throttle := testThrottle(LockoutConfig{MaxFailures: 100, IPMaxFailures: 3, Duration: 10, Window: 15})
+	// password spraying: one failure each for many users
+	for _, username := range []string{"alice", "bob", "carol"} {
+		throttle.failed(username, "192.0.2.1")
+	}
+	if wait, _ := retryAfter(t, throttle, "dave", "192.0.2.1"); wait < 599 {
+		t.Fatalf("new user from the locked IP: Retry-After %d", wait)
+	}
+	if wait, _ := retryAfter(t, throttle, "dave", "198.51.100.1"); wait != 0 {
+		t.Fatalf("new user from another IP waits %ds", wait)
+	}
+
+	if unlocked, err := throttle.unlock(lockoutIPKey("192.0.2.1")); !unlocked || err != nil {
+		t.Fatalf("unlock = %v, %v", unlocked, err)
+	}
+	if wait, _ := retryAfter(t, throttle, "dave", "192.0.2.1"); wait != 0 {
+		t.Fatalf("waits %ds after the unlock", wait)
+	}
+	if unlocked, err := throttle.unlock(lockoutIPKey("192.0.2.1")); unlocked || err != nil {
+		t.Fatalf("second unlock = %v, %v", unlocked, err)
+	}
+}
+
+func TestLoginThrottleWindow(t *testing.T) {
+	// failures further apart than the window are not added up
+	throttle := testThrottle(LockoutConfig{MaxFailures: 2, IPMaxFailures: 100, Duration: 10, Window: 0.1 / 60})
+	throttle.failed("alice", "192.0.2.1")
+	time.Sleep(150 * time.Millisecond)
+	throttle.failed("alice", "192.0.2.1")
+	if c, _ := throttle.load(lockoutUserKey("alice")); c.Failures != 1 || c.Locked {
+		t.Fatalf("counter %+v, want the first failure forgotten", c)
+	}
+	throttle.failed("alice", "192.0.2.1")
+	if wait, _ := retryAfter(t, throttle, "alice", "192.0.2.1"); wait == 0 {
+		t.Fatal("not locked after two failures within the window")
+	}
+}
+
+func TestHTTPLockout(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Lockout.MaxFailures = 2
+		c.Lockout.IPMaxFailures = 4
+	})
+	admin, operator := ts.client(t), ts.client(t)
+	csrf := http.Header{"X-Csrf-Token": {ts.login(t, admin, "admin", "admin-pw").CSRFToken}}
+	attempt := func(username, password string) (*http.Response, loginBody) {
+		var result loginBody
+		credentials, _ := json.Marshal(Credentials{Username: username, Password: password})
+		return ts.do(t, operator, "POST", "/loginvalidate/", string(credentials), nil, &result), result
+	}
+	unlock := func(path string) bool {
+		var result unlockResponse
+		if resp := ts.do(t, admin, "DELETE", path, "", csrf, &result); resp.StatusCode != http.StatusOK {
+			t.Fatalf("DELETE %s = %d", path, resp.StatusCode)
+		}
+		return result.Unlocked
+	}
+
+	attempt("operator", "wrong")
+	attempt("operator", "wrong")
+	var apierr apiError
+	resp := ts.do(t, operator, "POST", "/loginvalidate/", `{"username": "operator", "password": "operator-pw"}`, nil, &apierr)
+	if wait, _ := strconv.Atoi(resp.Header.Get("Retry-After")); resp.StatusCode != http.StatusTooManyRequests || apierr.Code != "too_many_attempts" || wait < 1 {
+		t.Fatalf("locked login = %d %+v, Retry-After %q", resp.StatusCode, apierr, resp.Header.Get("Retry-After"))
+	}
+
+	if !unlock("/admin/lockouts/users/operator") {
+		t.Fatal("the locked user was not unlocked")
+	}
+	if unlock("/admin/lockouts/users/operator") {
+		t.Fatal("unlocking twice reported a lockout")
+	}
+	if resp, result := attempt("operator", "operator-pw"); resp.StatusCode != http.StatusOK || !result.Authenticated {
+		t.Fatalf("login after the unlock = %d %+v", resp.StatusCode, result)
+	}
+
+	// the client IP keeps its two failures
+	attempt("nobody1", "x")
+	attempt("nobody2", "x")
+	if resp, _ := attempt("operator", "operator-pw"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("login from the locked IP = %d", resp.StatusCode)
+	}
+	if !unlock("/admin/lockouts/ips/127.0.0.1") {
+		t.Fatal("the locked IP was not unlocked")
+	}
+	if resp, result := attempt("operator", "operator-pw"); resp.StatusCode != http.StatusOK || !result.Authenticated {
+		t.Fatalf("login after the IP unlock = %d %+v", resp.StatusCode, result)
+	}
+}
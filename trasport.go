@@ -2,8 +2,9 @@ package session
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
@@ -19,6 +20,7 @@ func MakeHTTPHandler(ctx context.Context, s Service, logger log.Logger) http.Han
 	r := mux.NewRouter()
 	e := MakeServerEndpoints(s)
 	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(requestIDToContext),
 		httptransport.ServerErrorLogger(logger),
 		httptransport.ServerErrorEncoder(encodeError),
 	}
@@ -40,6 +42,27 @@ func MakeHTTPHandler(ctx context.Context, s Service, logger log.Logger) http.Han
 		encodeLoginResponse,
 		options...,
 	))
+	r.Methods("POST").Path("/loginvalidate/mfa/").Handler(httptransport.NewServer(
+		ctx,
+		e.mfaEndpoint,
+		decodeMFAReq,
+		encodeLoginResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/login/oidc/").Handler(httptransport.NewServer(
+		ctx,
+		e.oidcLoginEndpoint,
+		decodeOIDCReq,
+		encodeRedirectResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/login/oidc/callback").Handler(httptransport.NewServer(
+		ctx,
+		e.oidcCallbackEndpoint,
+		decodeOIDCReq,
+		encodeRedirectResponse,
+		options...,
+	))
 	r.Methods("DELETE").Path("/logoutuser/").Handler(httptransport.NewServer(
 		ctx,
 		e.logoutEndpoint,
@@ -54,14 +77,63 @@ func MakeHTTPHandler(ctx context.Context, s Service, logger log.Logger) http.Han
 		encodeLoginResponse,
 		options...,
 	))
+	r.Methods("GET").Path("/admin/upstreams/").Handler(httptransport.NewServer(
+		ctx,
+		e.upstreamsEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/authmodules/").Handler(httptransport.NewServer(
+		ctx,
+		e.authModulesEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/sessions/").Handler(httptransport.NewServer(
+		ctx,
+		e.listSessionsEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/sessions/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.revokeSessionEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/users/{username}/sessions/").Handler(httptransport.NewServer(
+		ctx,
+		e.revokeUserSessionsEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/lockouts/users/{username}").Handler(httptransport.NewServer(
+		ctx,
+		e.unlockEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/lockouts/ips/{ip}").Handler(httptransport.NewServer(
+		ctx,
+		e.unlockEndpoint,
+		decodeAdminReq,
+		encodeResponse,
+		options...,
+	))
 	r.PathPrefix("/").Handler(httptransport.NewServer(
 		ctx,
 		e.apiEndpoint,
 		decodeApiRequest,
-		encodeApiResponse,
+		encodeApiResponse(logger),
 		options...,
 	))
-	return r
+	return withRequestID(r)
 }
 
 func decodeLoginReq(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -73,6 +145,20 @@ func decodeLoginReq(_ context.Context, r *http.Request) (request interface{}, er
 	return req, nil
 }
 
+func decodeMFAReq(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req MFARequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	req.httpreq = r
+	return req, nil
+}
+
+func decodeOIDCReq(_ context.Context, r *http.Request) (request interface{}, err error) {
+	query := r.URL.Query()
+	return oidcRequest{httpreq: r, Code: query.Get("code"), State: query.Get("state"), Error: query.Get("error")}, nil
+}
+
 func decodeLogoutReq(_ context.Context, r *http.Request) (request interface{}, err error) {
 	var req LogoutRequest
 	req.httpreq = r
@@ -85,19 +171,22 @@ func decodeValidateReq(_ context.Context, r *http.Request) (request interface{},
 	return req, nil
 }
 
-func decodeApiRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
-	var req apiRequest
+func decodeAdminReq(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req adminRequest
 	req.httpreq = r
-
-	if (r.Method == "POST" || r.Method == "PUT") {
-		if e:= json.NewDecoder(r.Body).Decode(&req.data); e != nil {
-			if(e != io.EOF) {
-				return nil, e
-			}
-
-		}
+	vars := mux.Vars(r)
+	req.id = vars["id"]
+	req.username = vars["username"]
+	req.ip = vars["ip"]
+	if req.username == "" {
+		req.username = r.URL.Query().Get("username")
 	}
+	return req, nil
+}
 
+func decodeApiRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req apiRequest
+	req.httpreq = r
 	return req, nil
 }
 
@@ -118,6 +207,13 @@ func encodeLoginResponse(ctx context.Context, w http.ResponseWriter, response in
 		Authenticated 	bool   	`json:"authenticated"`
 		Message       	string 	`json:"message"`
 		Username	string	`json:"username"`
+		Roles		[]string	`json:"roles"`
+		ExpiresAt	string	`json:"expires_at,omitempty"`
+		ExpiresIn	int	`json:"expires_in,omitempty"`
+		CSRFToken	string	`json:"csrf_token,omitempty"`
+		MFARequired	bool	`json:"mfa_required,omitempty"`
+		Organization	string	`json:"organization,omitempty"`
+		Tenant		string	`json:"tenant,omitempty"`
 	}
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		// Not a Go kit transport error, but a business-logic error.
@@ -130,47 +226,85 @@ func encodeLoginResponse(ctx context.Context, w http.ResponseWriter, response in
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(resp{Authenticated: response.(LoginResponse).Authenticated,
-		Message: response.(LoginResponse).Message, Username: response.(LoginResponse).Username})
+		Message: response.(LoginResponse).Message, Username: response.(LoginResponse).Username,
+		Roles: response.(LoginResponse).Roles, ExpiresAt: response.(LoginResponse).ExpiresAt,
+		ExpiresIn: response.(LoginResponse).ExpiresIn, CSRFToken: response.(LoginResponse).CSRFToken,
+		MFARequired: response.(LoginResponse).MFARequired,
+		Organization: response.(LoginResponse).Organization, Tenant: response.(LoginResponse).Tenant})
 	return nil
 }
 
-func encodeLogoutResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+// encodeRedirectResponse saves the session and redirects the browser
+func encodeRedirectResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(redirectResponse)
+	if err := res.Session.Save(res.Httpreq, w); err != nil {
+		return err
+	}
+	http.Redirect(w, res.Httpreq, res.Location, http.StatusFound)
+	return nil
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
 		return nil
 	}
-	response.(LogoutResponse).Session.Save(response.(LogoutResponse).Httpreq, w)
-	return nil
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
 }
 
-func encodeApiResponse(ctx context.Context, w http.ResponseWriter, apiresp interface{}) error {
-	var jdata interface{}
-	var response = apiresp.(apiresponse).result
+func encodeLogoutResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
 		return nil
 	}
-	if(apiresp.(apiresponse).sessresponse.Authenticated) {
-		if ((response != nil) && (len(response.([]byte)) > 0)) {
-			err := json.Unmarshal(response.([]byte), &jdata)
-			if err != nil {
-				fmt.Println("error in encoding response")
-				encodeError(ctx, err, w)
-				return nil
+	response.(LogoutResponse).Session.Save(response.(LogoutResponse).Httpreq, w)
+	return nil
+}
+
+func encodeApiResponse(logger log.Logger) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, apiresp interface{}) error {
+		var response = apiresp.(apiresponse).result
+		if(apiresp.(apiresponse).sessresponse.Authenticated) {
+			// recorded activity is saved before the upstream status line is written
+			if apiresp.(apiresponse).sessresponse.renewed {
+				apiresp.(apiresponse).sessresponse.Session.Save(apiresp.(apiresponse).sessresponse.Httpreq, w)
 			}
-			json.NewEncoder(w).Encode(jdata)
+			if response != nil {
+				// the status line is already sent, so errors can only be logged
+				if err := copyResponse(w, response); err != nil {
+					errorLog(logger).Log(requestIDKey, requestID(ctx), "msg", "upstream response could not be streamed", "err", err)
+				}
+			}
+		} else {
+			apiresp.(apiresponse).sessresponse.Session.Options.MaxAge = -1
+			apiresp.(apiresponse).sessresponse.Session.Save(apiresp.(apiresponse).sessresponse.Httpreq, w)
 		}
-	} else {
-		apiresp.(apiresponse).sessresponse.Session.Options.MaxAge = -1
-		apiresp.(apiresponse).sessresponse.Session.Save(apiresp.(apiresponse).sessresponse.Httpreq, w)
+		return nil
 	}
-	return nil
 }
 
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
+	if e, ok := err.(httptransport.Error); ok && e.Domain == httptransport.DomainDo {
+		if apierr, ok := e.Err.(*apiError); ok {
+			err = apierr
+		}
+	}
+	if apierr, ok := err.(*apiError); ok {
+		if apierr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(apierr.RetryAfter))
+		}
+		if len(apierr.Allow) > 0 {
+			w.Header().Set("Allow", strings.Join(apierr.Allow, ", "))
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(apierr.status)
+		json.NewEncoder(w).Encode(apierr)
+		return
+	}
 	w.WriteHeader(codeFrom(err))
 	io.WriteString(w, err.Error())
 }
@@ -187,6 +321,9 @@ func codeFrom(err error) int {
 			case httptransport.DomainDecode:
 				return http.StatusBadRequest
 			case httptransport.DomainDo:
+				if e.Err == ErrNotFound {
+					return http.StatusNotFound
+				}
 				return http.StatusServiceUnavailable
 			default:
 				return http.StatusInternalServerError
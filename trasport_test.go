@@ -0,0 +1,503 @@
+package session
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+// testServer serves MakeHTTPHandler over a memory store, with a local admin
+// and operator and one route to an upstream
+type testServer struct {
+	*httptest.Server
+	upstream *httptest.Server
+	service  *sessionService
+	// upstreamCalls counts the requests that reached the upstream
+	upstreamCalls int64
+}
+
+// newTestServer starts the server, options change the configuration
+func newTestServer(t *testing.T, options ...func(*Config)) *testServer {
+	ts := &testServer{}
+	ts.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&ts.upstreamCalls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"method": r.Method, "path": r.URL.Path, "body": string(body)})
+	}))
+	t.Cleanup(ts.upstream.Close)
+
+	dir := t.TempDir()
+	var users []fileFormat
+	for _, user := range []struct{ name, role string }{{"admin", "admin"}, {"operator", "operator"}} {
+		hash, err := HashPassword(user.name+"-pw", HashBcrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, fileFormat{Username: user.name, Password: hash, Active: true, Roles: []string{user.role}})
+	}
+	routes := []map[string]interface{}{{
+		"api":           "/api/v1/networks/",
+		"methods":       []string{"GET", "POST"},
+		"destination":   ts.upstream.URL,
+		"authorization": true,
+		"roles":         map[string][]string{"GET": {"admin", "operator"}, "*": {"admin"}},
+	}, {
+		// POST is listed by neither the roles nor "*", so nobody may use it
+		"api":           "/api/v1/tenants/",
+		"methods":       []string{"GET", "POST", "DELETE"},
+		"destination":   ts.upstream.URL,
+		"authorization": true,
+		"roles":         map[string][]string{"GET": {"operator"}, "DELETE": {"admin"}},
+	}, {
+		"api":         "/api/v1/globals/",
+		"methods":     []string{"GET"},
+		"destination": ts.upstream.URL,
+	}}
+
+	config := DefaultConfig()
+	config.Session.Secret = "0123456789abcdef0123456789abcdef"
+	config.Store = StoreConfig{Type: "memory"}
+	config.Audit.File = ""
+	// failed logins of the tests are not slowed down
+	config.Lockout.Backoff = 0
+	config.Auth.Modules = []authModuleConfig{{Name: "local", Policy: policySufficient}}
+	config.LocalAuthFile = writeTestJSON(t, filepath.Join(dir, "localauthfile.json"), users)
+	config.APIConfigFile = writeTestJSON(t, filepath.Join(dir, "apiconfig.json"), routes)
+	for _, option := range options {
+		option(&config)
+	}
+	service, err := NewSessionService(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { service.Close() })
+	ts.service = service.(*sessionService)
+	ts.Server = httptest.NewServer(MakeHTTPHandler(context.Background(), service, log.NewNopLogger()))
+	t.Cleanup(ts.Server.Close)
+	return ts
+}
+
+func writeTestJSON(t *testing.T, name string, value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// client returns a client with its own cookie jar
+func (ts *testServer) client(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// loginBody is the body of the login, mfa and validateapp responses
+type loginBody struct {
+	Authenticated bool     `json:"authenticated"`
+	Message       string   `json:"message"`
+	Username      string   `json:"username"`
+	Roles         []string `json:"roles"`
+	ExpiresIn     int      `json:"expires_in"`
+	CSRFToken     string   `json:"csrf_token"`
+}
+
+// do sends the request and decodes a JSON response body into result
+func (ts *testServer) do(t *testing.T, client *http.Client, method, path, body string, header http.Header, result interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, data)
+		}
+	}
+	return resp
+}
+
+func (ts *testServer) login(t *testing.T, client *http.Client, username, password string) loginBody {
+	t.Helper()
+	var result loginBody
+	credentials, _ := json.Marshal(Credentials{Username: username, Password: password})
+	if resp := ts.do(t, client, "POST", "/loginvalidate/", string(credentials), nil, &result); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login status = %d", resp.StatusCode)
+	}
+	return result
+}
+
+func (ts *testServer) validate(t *testing.T, client *http.Client) loginBody {
+	t.Helper()
+	var result loginBody
+	if resp := ts.do(t, client, "GET", "/validateapp/", "", nil, &result); resp.StatusCode != http.StatusOK {
+		t.Fatalf("validateapp status = %d", resp.StatusCode)
+	}
+	return result
+}
+
+func TestHTTPLogin(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.client(t)
+
+	if result := ts.login(t, client, "admin", "wrong"); result.Authenticated {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if result := ts.login(t, client, "nobody", "admin-pw"); result.Authenticated {
+		t.Fatal("login of an unknown user succeeded")
+	}
+	result := ts.login(t, client, "admin", "admin-pw")
+	if !result.Authenticated || result.Username != "admin" || len(result.Roles) != 1 || result.Roles[0] != "admin" {
+		t.Fatalf("login = %+v", result)
+	}
+	if result.CSRFToken == "" || result.ExpiresIn <= 0 {
+		t.Fatalf("login returned no CSRF token or expiry: %+v", result)
+	}
+	cookies := client.Jar.Cookies(mustParseURL(t, ts.URL))
+	if len(cookies) != 1 || cookies[0].Name != "contiv-session" {
+		t.Fatalf("cookies after login = %v", cookies)
+	}
+
+	// a second login issues a new session ID
+	ts.login(t, client, "admin", "admin-pw")
+	if renewed := client.Jar.Cookies(mustParseURL(t, ts.URL)); renewed[0].Value == cookies[0].Value {
+		t.Fatal("the session ID was kept across logins")
+	}
+}
+
+func TestHTTPSessionCookie(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		ts := newTestServer(t, func(c *Config) { c.Session.CookieSecure = secure })
+		credentials, _ := json.Marshal(Credentials{Username: "admin", Password: "admin-pw"})
+		resp := ts.do(t, &http.Client{}, "POST", "/loginvalidate/", string(credentials), nil, nil)
+		cookie := resp.Header.Get("Set-Cookie")
+		if !strings.HasPrefix(cookie, "contiv-session=") || !strings.Contains(cookie, "; HttpOnly") || !strings.Contains(cookie, "; SameSite=Lax") {
+			t.Errorf("Set-Cookie %q, want an HttpOnly SameSite=Lax session cookie", cookie)
+		}
+		if strings.Contains(cookie, "; Secure") != secure {
+			t.Errorf("Set-Cookie %q with session.cookie_secure %v", cookie, secure)
+		}
+	}
+}
+
+func TestHTTPValidateApp(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.client(t)
+
+	if result := ts.validate(t, client); result.Authenticated {
+		t.Fatal("validateapp without a session succeeded")
+	}
+	login := ts.login(t, client, "operator", "operator-pw")
+	result := ts.validate(t, client)
+	if !result.Authenticated || result.Username != "operator" || result.CSRFToken != login.CSRFToken {
+		t.Fatalf("validateapp = %+v", result)
+	}
+
+	// a forged cookie is not a session
+	forged := &http.Client{}
+	req, _ := http.NewRequest("GET", ts.URL+"/validateapp/", nil)
+	req.AddCookie(&http.Cookie{Name: "contiv-session", Value: "forged"})
+	resp, err := forged.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forgedResult loginBody
+	json.NewDecoder(resp.Body).Decode(&forgedResult)
+	resp.Body.Close()
+	if forgedResult.Authenticated {
+		t.Fatal("validateapp accepted a forged cookie")
+	}
+}
+
+func TestHTTPLogout(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.client(t)
+	ts.login(t, client, "admin", "admin-pw")
+	cookies := client.Jar.Cookies(mustParseURL(t, ts.URL))
+
+	if resp := ts.do(t, client, "DELETE", "/logoutuser/", "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("logout status = %d", resp.StatusCode)
+	}
+	if remaining := client.Jar.Cookies(mustParseURL(t, ts.URL)); len(remaining) != 0 {
+		t.Fatalf("cookies after logout = %v", remaining)
+	}
+	if result := ts.validate(t, client); result.Authenticated {
+		t.Fatal("session still valid after logout")
+	}
+
+	// the old cookie does not bring the session back
+	replay := ts.client(t)
+	replay.Jar.SetCookies(mustParseURL(t, ts.URL), cookies)
+	if result := ts.validate(t, replay); result.Authenticated {
+		t.Fatal("the cookie of a logged out session was accepted")
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	ts := newTestServer(t)
+	admin, operator := ts.client(t), ts.client(t)
+
+	// without a session nothing is proxied
+	ts.do(t, admin, "GET", "/api/v1/networks/", "", nil, nil)
+	if calls := atomic.LoadInt64(&ts.upstreamCalls); calls != 0 {
+		t.Fatalf("an unauthenticated request reached the upstream")
+	}
+
+	login := ts.login(t, admin, "admin", "admin-pw")
+	var upstream map[string]string
+	resp := ts.do(t, admin, "GET", "/api/v1/networks/net1/", "", nil, &upstream)
+	if resp.StatusCode != http.StatusCreated || upstream["method"] != "GET" || upstream["path"] != "/api/v1/networks/net1/" {
+		t.Fatalf("proxied GET = %d %v", resp.StatusCode, upstream)
+	}
+
+	// writes need the CSRF token
+	var apierr apiError
+	if resp := ts.do(t, admin, "POST", "/api/v1/networks/", `{"name": "net2"}`, nil, &apierr); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("POST without CSRF token = %d %+v", resp.StatusCode, apierr)
+	}
+	csrf := http.Header{"X-Csrf-Token": {login.CSRFToken}}
+	upstream = nil
+	resp = ts.do(t, admin, "POST", "/api/v1/networks/", `{"name": "net2"}`, csrf, &upstream)
+	if resp.StatusCode != http.StatusCreated || upstream["body"] != `{"name": "net2"}` {
+		t.Fatalf("proxied POST = %d %v", resp.StatusCode, upstream)
+	}
+
+	// methods the route does not list and unknown paths
+	resp = ts.do(t, admin, "DELETE", "/api/v1/networks/net2/", "", csrf, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Fatalf("DELETE = %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if resp := ts.do(t, admin, "GET", "/api/v2/", "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of an unknown path = %d", resp.StatusCode)
+	}
+
+	// roles are checked per method
+	operatorLogin := ts.login(t, operator, "operator", "operator-pw")
+	if resp := ts.do(t, operator, "GET", "/api/v1/networks/", "", nil, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("operator GET = %d", resp.StatusCode)
+	}
+	calls := atomic.LoadInt64(&ts.upstreamCalls)
+	apierr = apiError{}
+	resp = ts.do(t, operator, "POST", "/api/v1/networks/", `{"name": "net3"}`, http.Header{"X-Csrf-Token": {operatorLogin.CSRFToken}}, &apierr)
+	if resp.StatusCode != http.StatusForbidden || apierr.Code != "forbidden" {
+		t.Fatalf("operator POST = %d %+v", resp.StatusCode, apierr)
+	}
+	if atomic.LoadInt64(&ts.upstreamCalls) != calls {
+		t.Fatal("a forbidden request reached the upstream")
+	}
+}
+
+func TestHTTPAuthorization(t *testing.T) {
+	ts := newTestServer(t)
+	clients := map[string]*http.Client{"admin": ts.client(t), "operator": ts.client(t)}
+	csrf := make(map[string]http.Header)
+	for user, client := range clients {
+		csrf[user] = http.Header{"X-Csrf-Token": {ts.login(t, client, user, user+"-pw").CSRFToken}}
+	}
+
+	tests := []struct {
+		user, method, path string
+		allowed            bool
+		roles              []string
+	}{
+		// roles of the method replace those of "*"
+		{"admin", "GET", "/api/v1/tenants/", false, []string{"operator"}},
+		{"operator", "GET", "/api/v1/tenants/", true, nil},
+		{"admin", "DELETE", "/api/v1/tenants/t1/", true, nil},
+		{"operator", "DELETE", "/api/v1/tenants/t1/", false, []string{"admin"}},
+		{"admin", "POST", "/api/v1/tenants/", false, nil},
+		// "*" applies to the methods without roles of their own
+		{"operator", "POST", "/api/v1/networks/", false, []string{"admin"}},
+		{"admin", "POST", "/api/v1/networks/", true, nil},
+		// routes without authorization are open to every session
+		{"operator", "GET", "/api/v1/globals/", true, nil},
+	}
+	for _, tt := range tests {
+		var apierr apiError
+		resp := ts.do(t, clients[tt.user], tt.method, tt.path, "", csrf[tt.user], &apierr)
+		if tt.allowed {
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("%s %s %s = %d %+v, want it proxied", tt.user, tt.method, tt.path, resp.StatusCode, apierr)
+			}
+			continue
+		}
+		want := apiError{Code: "forbidden", Route: "/api/v1/tenants/", Method: tt.method, Roles: tt.roles}
+		if strings.HasPrefix(tt.path, "/api/v1/networks/") {
+			want.Route = "/api/v1/networks/"
+		}
+		apierr.Message = ""
+		if resp.StatusCode != http.StatusForbidden || !reflect.DeepEqual(apierr, want) {
+			t.Errorf("%s %s %s = %d %+v, want 403 %+v", tt.user, tt.method, tt.path, resp.StatusCode, apierr, want)
+		}
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// indexKeys returns the keys of the per-user session index
+func (ts *testServer) indexKeys(t *testing.T) []string {
+	values, err := ts.service.store.(*kvStore).backend.list(indexPrefix(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestHTTPAdminSessions(t *testing.T) {
+	ts := newTestServer(t)
+	admin, operator1, operator2 := ts.client(t), ts.client(t), ts.client(t)
+	csrf := http.Header{"X-Csrf-Token": {ts.login(t, admin, "admin", "admin-pw").CSRFToken}}
+	operatorCSRF := http.Header{"X-Csrf-Token": {ts.login(t, operator1, "operator", "operator-pw").CSRFToken}}
+	ts.login(t, operator2, "operator", "operator-pw")
+
+	var apierr apiError
+	if resp := ts.do(t, operator1, "GET", "/admin/sessions/", "", nil, &apierr); resp.StatusCode != http.StatusForbidden || apierr.Code != "forbidden" {
+		t.Fatalf("operator listing sessions = %d %+v", resp.StatusCode, apierr)
+	}
+	if resp := ts.do(t, operator1, "DELETE", "/admin/users/admin/sessions/", "", operatorCSRF, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("operator revoking sessions = %d", resp.StatusCode)
+	}
+
+	var list []sessionInfo
+	if resp := ts.do(t, admin, "GET", "/admin/sessions/", "", nil, &list); resp.StatusCode != http.StatusOK || len(list) != 3 {
+		t.Fatalf("list = %d %+v", resp.StatusCode, list)
+	}
+	for _, info := range list {
+		if info.ID == "" || info.CreatedAt == "" || info.ClientIP != "127.0.0.1" || info.UserAgent == "" || info.AuthModule != "local" {
+			t.Errorf("session %+v", info)
+		}
+	}
+	// the listed IDs are not the session IDs of the cookies
+	for _, cookie := range admin.Jar.Cookies(mustParseURL(t, ts.URL)) {
+		for _, info := range list {
+			if strings.Contains(cookie.Value, info.ID) {
+				t.Errorf("cookie %s carries the listed ID %s", cookie.Name, info.ID)
+			}
+		}
+	}
+
+	var operatorSessions []sessionInfo
+	ts.do(t, admin, "GET", "/admin/sessions/?username=operator", "", nil, &operatorSessions)
+	if len(operatorSessions) != 2 || operatorSessions[0].Username != "operator" || operatorSessions[1].Username != "operator" {
+		t.Fatalf("sessions of operator = %+v", operatorSessions)
+	}
+
+	// revoking one session ends it and leaves the other
+	var revoked revokeResponse
+	resp := ts.do(t, admin, "DELETE", "/admin/sessions/"+operatorSessions[0].ID, "", csrf, &revoked)
+	if resp.StatusCode != http.StatusOK || revoked.Revoked != 1 {
+		t.Fatalf("revoke = %d %+v", resp.StatusCode, revoked)
+	}
+	authenticated := ts.validate(t, operator1).Authenticated
+	if authenticated == ts.validate(t, operator2).Authenticated {
+		t.Fatal("revoking one session did not end exactly one of the two")
+	}
+	if resp := ts.do(t, admin, "DELETE", "/admin/sessions/"+operatorSessions[0].ID, "", csrf, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("revoking the session again = %d", resp.StatusCode)
+	}
+
+	revoked = revokeResponse{}
+	if resp := ts.do(t, admin, "DELETE", "/admin/users/operator/sessions/", "", csrf, &revoked); resp.StatusCode != http.StatusOK || revoked.Revoked != 1 {
+		t.Fatalf("revoke user = %d %+v", resp.StatusCode, revoked)
+	}
+	if ts.validate(t, operator1).Authenticated || ts.validate(t, operator2).Authenticated {
+		t.Fatal("a session of operator survived revoking all of them")
+	}
+	if keys := ts.indexKeys(t); len(keys) != 1 || !strings.HasPrefix(keys[0], indexPrefix("admin")) {
+		t.Fatalf("index after the revocations: %v", keys)
+	}
+}
+
+func TestHTTPAdminSessionIndexCleanup(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Session.IdleTimeout = 1.0 / 60
+		c.Session.RenewInterval = 0
+	})
+	admin, operator := ts.client(t), ts.client(t)
+
+	// logging out removes the index entry
+	ts.login(t, operator, "operator", "operator-pw")
+	if keys := ts.indexKeys(t); len(keys) != 1 {
+		t.Fatalf("index after login: %v", keys)
+	}
+	ts.do(t, operator, "DELETE", "/logoutuser/", "", nil, nil)
+	if keys := ts.indexKeys(t); len(keys) != 0 {
+		t.Fatalf("index after logout: %v", keys)
+	}
+
+	// an index entry whose session is gone is dropped when listing
+	ts.login(t, operator, "operator", "operator-pw")
+	backend := ts.service.store.(*kvStore).backend
+	values, _ := backend.list(indexPrefix("operator"))
+	for _, value := range values {
+		var entry indexEntry
+		json.Unmarshal(value, &entry)
+		backend.delete(entry.SessionID)
+	}
+	ts.login(t, admin, "admin", "admin-pw")
+	var list []sessionInfo
+	ts.do(t, admin, "GET", "/admin/sessions/", "", nil, &list)
+	if len(list) != 1 || list[0].Username != "admin" {
+		t.Fatalf("list with a stale entry = %+v", list)
+	}
+	if keys := ts.indexKeys(t); len(keys) != 1 || !strings.HasPrefix(keys[0], indexPrefix("admin")) {
+		t.Fatalf("index after listing: %v", keys)
+	}
+
+	// expired sessions leave neither a listing nor an index entry
+	ts.login(t, operator, "operator", "operator-pw")
+	time.Sleep(1100 * time.Millisecond)
+	ts.login(t, admin, "admin", "admin-pw")
+	list = nil
+	ts.do(t, admin, "GET", "/admin/sessions/", "", nil, &list)
+	if len(list) != 1 || list[0].Username != "admin" {
+		t.Fatalf("list after expiry = %+v", list)
+	}
+	if keys := ts.indexKeys(t); len(keys) != 1 {
+		t.Fatalf("index after expiry: %v", keys)
+	}
+}